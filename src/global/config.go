@@ -3,10 +3,13 @@ package global
 import (
 	"errors"
 	"flag"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
+	"github.com/miekg/dns"
 	"github.com/pelletier/go-toml/v2"
 	"github.com/rs/zerolog/log"
 )
@@ -15,18 +18,41 @@ import (
 var LaunchFlag struct {
 	ConfigSource string // 配置来源(file或者服务中心地址'127.0.0.1:10000')
 	Env          string // 环境变量
+	Migrate      bool   // 转换存储器中旧的数据格式后退出
 }
 
+// 当前生效的运行时配置
+var currentConfig atomic.Pointer[Configuration]
+
 // 运行时配置
-var Config struct {
+type Configuration struct {
 	Debug bool `toml:"-"`
 
 	Service struct {
 		Upstream struct {
-			Count     int      `toml:"-"`
-			Addrs     []string `toml:"addrs"`
-			HTTPProxy string   `toml:"httpProxy"`
+			Count       int               `toml:"-"`
+			Addrs       []string          `toml:"addrs"`
+			HTTPProxy   string            `toml:"httpProxy"`
+			Proxy       string            `toml:"proxy"`
+			Proxies     map[string]string `toml:"proxies"`
+			Strategy    string            `toml:"strategy"`
+			Parallel    int               `toml:"parallel"`
+			PoolSize    int               `toml:"poolSize"`
+			IdleTimeout uint              `toml:"idleTimeout"`
+			Health      struct {
+				Interval  uint   `toml:"interval"`
+				Failures  int    `toml:"failures"`
+				ProbeName string `toml:"probeName"`
+			} `toml:"health"`
 		} `toml:"upstream"`
+		Forward []struct {
+			Suffix string   `toml:"suffix"`
+			Addrs  []string `toml:"addrs"`
+		} `toml:"forward"`
+		Cache struct {
+			Size   int    `toml:"size"`
+			MaxTTL uint32 `toml:"maxTTL"`
+		} `toml:"cache"`
 		TLS struct {
 			Port     uint16 `toml:"port"`
 			CertFile string `toml:"certFile"`
@@ -43,12 +69,20 @@ var Config struct {
 			JSONQueryPath string `toml:"jsonQueryPath"`
 			RegisterPath  string `toml:"registerPath"`
 			DeletePath    string `toml:"deletePath"`
+			UpstreamPath  string `toml:"upstreamPath"`
+			ReloadPath    string `toml:"reloadPath"`
+			MetricsPath   string `toml:"metricsPath"`
+			HealthPath    string `toml:"healthPath"`
+			ListPath      string `toml:"listPath"`
 			Port          uint16 `toml:"port"`
 			SSLPort       uint16 `toml:"sslPort"`
+			HTTP3         bool   `toml:"http3"`
 			DNSQueryAuth  bool   `toml:"dnsQueryAuth"`
 			JSONQueryAuth bool   `toml:"jsonQueryAuth"`
 			RegisterAuth  bool   `toml:"registerAuth"`
 			DeleteAuth    bool   `toml:"registerAuth"`
+			UpstreamAuth  bool   `toml:"upstreamAuth"`
+			MetricsAuth   bool   `toml:"metricsAuth"`
 		} `toml:"http"`
 		UDP struct {
 			Port uint16 `toml:"port"`
@@ -56,12 +90,36 @@ var Config struct {
 		TCP struct {
 			Port uint16 `toml:"port"`
 		} `toml:"tcp"`
+		QUIC struct {
+			Port uint16 `toml:"port"`
+		} `toml:"quic"`
+		Zones []struct {
+			Suffix  string   `toml:"suffix"`
+			NS      []string `toml:"ns"`
+			Mbox    string   `toml:"mbox"`
+			TTL     uint32   `toml:"ttl"`
+			Refresh uint32   `toml:"refresh"`
+			Retry   uint32   `toml:"retry"`
+			Expire  uint32   `toml:"expire"`
+			MinTTL  uint32   `toml:"minTTL"`
+			Flatten bool     `toml:"flatten"`
+		} `toml:"zones"`
 	} `toml:"service"`
 	Storage struct {
 		UseExpire bool   `toml:"useExpire"`
 		Type      string `toml:"type"`
 		Config    string `toml:"config"`
+		Timeout   uint16 `toml:"timeout"`
+		Cache     struct {
+			Size int    `toml:"size"`
+			TTL  uint32 `toml:"ttl"`
+		} `toml:"cache"`
 	} `toml:"storage"`
+	QueryLog struct {
+		File   string `toml:"file"`
+		Logger bool   `toml:"logger"`
+		Dnstap string `toml:"dnstap"`
+	} `toml:"queryLog"`
 	Logger struct {
 		Level      string      `toml:"level"`
 		Output     string      `toml:"output"`
@@ -72,89 +130,288 @@ var Config struct {
 	} `toml:"logger"`
 }
 
-// 设置本地默认配置
-func defaultConfig() {
-	// 环境变量
-	LaunchFlag.ConfigSource = "file"
+// 获取当前生效的运行时配置，返回的配置不允许修改
+func Config() *Configuration {
+	if conf := currentConfig.Load(); conf != nil {
+		return conf
+	}
+	return defaultConfig()
+}
+
+// 配置中是否启用了DNS转发
+func (conf *Configuration) HasUpstream() bool {
+	return conf.Service.Upstream.Count > 0 || len(conf.Service.Forward) > 0
+}
+
+// 替换当前生效的运行时配置
+func SetConfig(conf *Configuration) {
+	currentConfig.Store(conf)
+}
+
+// 生成本地默认配置
+func defaultConfig() *Configuration {
+	conf := new(Configuration)
 
-	Config.Debug = true
-	Config.Service.QuitWaitTimeout = 5
+	conf.Debug = true
+	conf.Service.QuitWaitTimeout = 5
+	conf.Service.Upstream.Health.Failures = 3
+	conf.Service.Upstream.PoolSize = 4
+	conf.Service.Upstream.IdleTimeout = 30
+	conf.Service.Upstream.Health.ProbeName = "."
+	conf.Storage.Timeout = 5
 
-	Config.Logger.Level = "debug"
-	Config.Logger.FileMode = 0600
-	Config.Logger.Encode = "console"
-	Config.Logger.TimeFormat = "y-m-d h:i:s"
+	conf.Logger.Level = "debug"
+	conf.Logger.FileMode = 0600
+	conf.Logger.Encode = "console"
+	conf.Logger.TimeFormat = "y-m-d h:i:s"
+	return conf
 }
 
 // 加载配置
 func LoadConfig() (err error) {
-	// 加载本地默认配置
-	defaultConfig()
+	var conf *Configuration
+
+	// 环境变量
+	LaunchFlag.ConfigSource = "file"
 
 	// 解析启动参数
 	flag.StringVar(&LaunchFlag.Env, "env", LaunchFlag.Env, "环境变量，默认为空")
+	flag.BoolVar(&LaunchFlag.Migrate, "migrate", false, "转换 Redis 存储器中旧的键布局或升级 VoltDB 存储器旧的表后退出")
 	flag.Parse()
 
 	LaunchFlag.Env = strings.ToLower(LaunchFlag.Env)
 
 	log.Info().Str("env", LaunchFlag.Env).Msg("启动参数")
 
+	conf, err = ParseConfig()
+	if err != nil {
+		return
+	}
+	SetConfig(conf)
+	return
+}
+
+// 重新读取并校验配置，不会替换当前生效的配置
+func ParseConfig() (conf *Configuration, err error) {
+	// 加载本地默认配置
+	conf = defaultConfig()
+
 	// 加载本地配置文件
 	if LaunchFlag.ConfigSource == "file" {
 		// 加载本地配置文件
-		if err = loadConfigFile(); err != nil {
+		if err = loadConfigFile(conf); err != nil {
 			log.Err(err).Caller().Msg("加载配置文件失败")
-			return
+			return nil, err
 		}
 	}
 
-	if (Config.Service.HTTP.Port > 0 ||
-		Config.Service.HTTP.SSLPort > 0) &&
-		Config.Service.HTTP.DNSQueryPath != "" &&
-		Config.Service.HTTP.RegisterPath != "" &&
-		Config.Service.HTTP.DNSQueryPath == Config.Service.HTTP.JSONQueryPath {
-		log.Fatal().Caller().Msg("dnsQueryPath 与 jsonQueryPath 的参数值不能相同")
+	if err = checkConfig(conf); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// 校验配置并规范化参数值
+func checkConfig(conf *Configuration) (err error) {
+	if (conf.Service.HTTP.Port > 0 ||
+		conf.Service.HTTP.SSLPort > 0) &&
+		conf.Service.HTTP.DNSQueryPath != "" &&
+		conf.Service.HTTP.RegisterPath != "" &&
+		conf.Service.HTTP.DNSQueryPath == conf.Service.HTTP.JSONQueryPath {
+		err = errors.New("dnsQueryPath 与 jsonQueryPath 的参数值不能相同")
+		log.Err(err).Caller().Msg("解析配置失败")
 		return
 	}
 
-	Config.Service.Upstream.Count = len(Config.Service.Upstream.Addrs)
+	if conf.Service.HTTP.ReloadPath != "" && conf.Service.HTTP.Authorization == "" {
+		err = errors.New("启用reloadPath时，authorization参数值不能为空")
+		log.Err(err).Caller().Msg("解析配置失败")
+		return
+	}
+
+	conf.Service.Upstream.Count = len(conf.Service.Upstream.Addrs)
 
-	if Config.Service.TLS.Port > 0 {
-		if Config.Service.TLS.CertFile == "" {
+	conf.Service.Upstream.Strategy = strings.ToLower(conf.Service.Upstream.Strategy)
+	switch conf.Service.Upstream.Strategy {
+	case "":
+		conf.Service.Upstream.Strategy = "sequential"
+	case "sequential", "round_robin", "random", "fastest":
+	case "parallel":
+		if conf.Service.Upstream.Parallel < 2 {
+			conf.Service.Upstream.Parallel = 2
+		}
+	default:
+		err = errors.New("strategy参数值只支持sequential/round_robin/random/fastest/parallel")
+		log.Err(err).Caller().Str("strategy", conf.Service.Upstream.Strategy).Msg("解析配置失败")
+		return
+	}
+
+	if conf.Service.TLS.Port > 0 {
+		if conf.Service.TLS.CertFile == "" {
 			err = errors.New("启用DNS over TLS服务时，certFile参数值不能为空")
 			log.Err(err).Caller().Msg("解析配置失败")
 			return
 		}
-		if Config.Service.TLS.KeyFile == "" {
+		if conf.Service.TLS.KeyFile == "" {
 			err = errors.New("启用DNS over TLS服务时，keyFile参数值不能为空")
 			log.Err(err).Caller().Msg("解析配置失败")
 			return
 		}
 	}
-	if Config.Service.HTTP.SSLPort > 0 {
-		if Config.Service.HTTP.CertFile == "" {
+	if conf.Service.QUIC.Port > 0 {
+		if conf.Service.TLS.CertFile == "" || conf.Service.TLS.KeyFile == "" {
+			err = errors.New("启用DNS over QUIC服务时，service.tls的certFile和keyFile参数值不能为空")
+			log.Err(err).Caller().Msg("解析配置失败")
+			return
+		}
+	}
+	if conf.Service.HTTP.SSLPort > 0 {
+		if conf.Service.HTTP.CertFile == "" {
 			err = errors.New("启用HTTPS服务时，certFile参数值不能为空")
 			log.Err(err).Caller().Msg("解析配置失败")
 			return
 		}
-		if Config.Service.HTTP.KeyFile == "" {
+		if conf.Service.HTTP.KeyFile == "" {
 			err = errors.New("启用HTTPS服务时，keyFile参数值不能为空")
 			log.Err(err).Caller().Msg("解析配置失败")
 			return
 		}
 	}
 
-	for k := range Config.Service.InternalSuffix {
-		if !strings.HasSuffix(Config.Service.InternalSuffix[k], ".") {
-			Config.Service.InternalSuffix[k] += "."
+	if conf.Service.Upstream.IdleTimeout == 0 {
+		conf.Service.Upstream.IdleTimeout = 30
+	}
+
+	// httpProxy参数已被proxy参数替代，保留兼容
+	if conf.Service.Upstream.Proxy == "" {
+		conf.Service.Upstream.Proxy = conf.Service.Upstream.HTTPProxy
+	}
+	if err = checkProxy(conf.Service.Upstream.Proxy); err != nil {
+		log.Err(err).Caller().Str("proxy", conf.Service.Upstream.Proxy).Msg("解析配置失败")
+		return
+	}
+	for addr, proxy := range conf.Service.Upstream.Proxies {
+		if proxy == "direct" {
+			continue
+		}
+		if err = checkProxy(proxy); err != nil {
+			log.Err(err).Caller().Str("addr", addr).Str("proxy", proxy).Msg("解析配置失败")
+			return
+		}
+	}
+
+	if conf.Service.Upstream.Health.Failures < 1 {
+		conf.Service.Upstream.Health.Failures = 1
+	}
+	conf.Service.Upstream.Health.ProbeName = dns.Fqdn(conf.Service.Upstream.Health.ProbeName)
+
+	for k := range conf.Service.Forward {
+		if conf.Service.Forward[k].Suffix == "" {
+			err = errors.New("转发规则的suffix参数值不能为空")
+			log.Err(err).Caller().Msg("解析配置失败")
+			return
+		}
+		if len(conf.Service.Forward[k].Addrs) == 0 {
+			err = errors.New("转发规则的addrs参数值不能为空")
+			log.Err(err).Caller().Str("suffix", conf.Service.Forward[k].Suffix).Msg("解析配置失败")
+			return
+		}
+		// 后缀统一为小写、去掉开头的点并以点结尾，根域名会匹配所有域名，应使用upstream.addrs
+		suffix := dns.Fqdn(strings.TrimPrefix(strings.ToLower(conf.Service.Forward[k].Suffix), "."))
+		if suffix == "." {
+			err = errors.New("转发规则的suffix参数值不能为根域名，转发所有域名请使用upstream.addrs参数")
+			log.Err(err).Caller().Str("suffix", conf.Service.Forward[k].Suffix).Msg("解析配置失败")
+			return
+		}
+		conf.Service.Forward[k].Suffix = suffix
+	}
+
+	// 未指定存储器类型时使用内存存储器
+	if conf.Storage.Type == "" {
+		conf.Storage.Type = "memory"
+	}
+	if conf.Storage.Timeout == 0 {
+		conf.Storage.Timeout = 5
+	}
+	if conf.Storage.Cache.Size > 0 && conf.Storage.Cache.TTL == 0 {
+		conf.Storage.Cache.TTL = 60
+	}
+
+	for k := range conf.Service.InternalSuffix {
+		if !strings.HasSuffix(conf.Service.InternalSuffix[k], ".") {
+			conf.Service.InternalSuffix[k] += "."
 		}
 	}
 
+	for k := range conf.Service.Zones {
+		zone := &conf.Service.Zones[k]
+		zone.Suffix = strings.ToLower(zone.Suffix)
+		if !strings.HasSuffix(zone.Suffix, ".") {
+			zone.Suffix += "."
+		}
+		found := false
+		for i := range conf.Service.InternalSuffix {
+			if strings.EqualFold(conf.Service.InternalSuffix[i], zone.Suffix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			err = errors.New("区域的suffix参数值必须是internalSuffix中的后缀")
+			log.Err(err).Caller().Str("suffix", zone.Suffix).Msg("解析配置失败")
+			return
+		}
+		for i := range zone.NS {
+			zone.NS[i] = dns.Fqdn(strings.ToLower(zone.NS[i]))
+		}
+		if zone.Mbox != "" {
+			zone.Mbox = dns.Fqdn(strings.ToLower(zone.Mbox))
+		}
+	}
+
+	conf.Logger.Level = strings.ToLower(conf.Logger.Level)
+	switch conf.Logger.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		err = errors.New("level参数值无效")
+		log.Err(err).Caller().Str("level", conf.Logger.Level).Msg("解析配置失败")
+		return
+	}
+	conf.Logger.Encode = strings.ToLower(conf.Logger.Encode)
+	switch conf.Logger.Encode {
+	case "", "console", "json":
+	default:
+		err = errors.New("encode参数值只支持json和console")
+		log.Err(err).Caller().Str("encode", conf.Logger.Encode).Msg("解析配置失败")
+		return
+	}
+	conf.Logger.TimeFormat = strings.ToLower(conf.Logger.TimeFormat)
+
 	return
 }
 
+// 检查代理地址，只支持http/https/socks5协议
+func checkProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return errors.New("代理地址只支持http://、https://和socks5://协议")
+	}
+	if proxyURL.Host == "" {
+		return errors.New("代理地址缺少主机名")
+	}
+	return nil
+}
+
 // 加载本地配置文件
-func loadConfigFile() (err error) {
+func loadConfigFile(conf *Configuration) (err error) {
 	var (
 		filePath string
 		file     *os.File
@@ -169,9 +426,14 @@ func loadConfigFile() (err error) {
 		log.Err(err).Caller().Str("path", filePath).Send()
 		return
 	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			log.Warn().Err(closeErr).Caller().Str("path", filePath).Send()
+		}
+	}()
 
-	// 解析配置文件到Config
-	err = toml.NewDecoder(file).Decode(&Config)
+	// 解析配置文件到conf
+	err = toml.NewDecoder(file).Decode(conf)
 	if err != nil {
 		log.Err(err).Caller().Msg("加载配置文件失败")
 		return
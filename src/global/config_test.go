@@ -0,0 +1,38 @@
+package global
+
+import (
+	"testing"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// 测试转发规则的后缀规范化为小写并以点结尾，根域名的后缀返回错误
+func TestCheckConfigForward(t *testing.T) {
+	for suffix, want := range map[string]string{
+		"Corp.Example":  "corp.example.",
+		".consul.":      "consul.",
+		"corp.example.": "corp.example.",
+		".":             "",
+		"..":            "",
+		"":              "",
+	} {
+		conf := defaultConfig()
+		if err := toml.Unmarshal([]byte(`
+[[service.forward]]
+suffix = "`+suffix+`"
+addrs = ["udp://10.0.0.1:53"]
+`), conf); err != nil {
+			t.Fatal(err)
+		}
+		err := checkConfig(conf)
+		if want == "" {
+			if err == nil {
+				t.Error("无效的后缀未返回错误", suffix)
+			}
+			continue
+		}
+		if err != nil || conf.Service.Forward[0].Suffix != want {
+			t.Error("后缀规范化的结果错误", suffix, conf.Service.Forward[0].Suffix, err)
+		}
+	}
+}
@@ -10,6 +10,9 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+// 当前日志使用的文件，重新配置logger时关闭
+var loggerFile *os.File
+
 // 使用默认参数设置logger，用于没有读取配置时临时替代标准包的log使用
 func UseDefaultLogger() {
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -42,13 +45,14 @@ func SetupLogger() (err error) {
 		logFile *os.File
 	)
 
+	conf := Config()
+
 	// 设置级别
-	Config.Logger.Level = strings.ToLower(Config.Logger.Level)
 	// 如果是debug模式，则日志记录自动为debug级别
-	if Config.Debug {
+	if conf.Debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	} else {
-		switch Config.Logger.Level {
+		switch conf.Logger.Level {
 		case "":
 		case "debug":
 			zerolog.SetGlobalLevel(zerolog.DebugLevel)
@@ -60,24 +64,23 @@ func SetupLogger() (err error) {
 			zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 		default:
 			err = errors.New("level参数值无效")
-			log.Err(err).Str("level", Config.Logger.Level).Msg("配置Logger失败")
+			log.Err(err).Str("level", conf.Logger.Level).Msg("配置Logger失败")
 			return
 		}
 	}
 
 	// 设置时间格式
-	Config.Logger.TimeFormat = strings.ToLower(Config.Logger.TimeFormat)
-	if Config.Logger.TimeFormat == "timestamp" {
+	if conf.Logger.TimeFormat == "timestamp" {
 		zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	} else {
-		zerolog.TimeFieldFormat = FormatTime(Config.Logger.TimeFormat)
+		zerolog.TimeFieldFormat = FormatTime(conf.Logger.TimeFormat)
 	}
 
 	// 设置日志输出方式
 	// 输出到日志文件，否则默认是输出到控制台
-	if Config.Logger.Output != "" {
+	if conf.Logger.Output != "" {
 		// 打开文件
-		logFile, err = os.OpenFile(Config.Logger.Output, os.O_RDWR|os.O_CREATE|os.O_APPEND, Config.Logger.FileMode)
+		logFile, err = os.OpenFile(conf.Logger.Output, os.O_RDWR|os.O_CREATE|os.O_APPEND, conf.Logger.FileMode)
 		if nil != err {
 			log.Err(err).Caller().Msg("配置Logger失败")
 			return
@@ -85,8 +88,7 @@ func SetupLogger() (err error) {
 	}
 
 	// 设置日志编码格式
-	Config.Logger.Encode = strings.ToLower(Config.Logger.Encode)
-	switch Config.Logger.Encode {
+	switch conf.Logger.Encode {
 	case "":
 	case "console":
 		if logFile != nil {
@@ -98,7 +100,7 @@ func SetupLogger() (err error) {
 		} else {
 			output = zerolog.ConsoleWriter{
 				Out:        os.Stdout,
-				NoColor:    Config.Logger.NoColor,
+				NoColor:    conf.Logger.NoColor,
 				TimeFormat: zerolog.TimeFieldFormat,
 			}
 		}
@@ -111,11 +113,23 @@ func SetupLogger() (err error) {
 		}
 	default:
 		err = errors.New("encode参数值只支持json和console")
-		log.Fatal().Err(err).Caller().Msg("配置Logger失败")
+		log.Err(err).Caller().Msg("配置Logger失败")
+		if logFile != nil {
+			_ = logFile.Close()
+		}
 		return
 	}
 
 	log.Logger = log.Output(output)
 
+	// 关闭之前使用的日志文件
+	if loggerFile != nil {
+		if err = loggerFile.Close(); err != nil {
+			log.Warn().Err(err).Caller().Msg("关闭日志文件失败")
+			err = nil
+		}
+	}
+	loggerFile = logFile
+
 	return
 }
@@ -3,6 +3,8 @@ package global
 import (
 	"crypto/md5" //nolint:gosec
 	"encoding/hex"
+	"os"
+	"strconv"
 	"strings"
 	"unsafe"
 
@@ -21,6 +23,15 @@ func StrToBytes(s string) []byte {
 	return *(*[]byte)(unsafe.Pointer(&h))
 }
 
+// 文件的版本标识，文件被替换或修改后会变化，文件不存在时返回空字符串
+func FileVersion(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10) + "-" + strconv.FormatInt(info.Size(), 10)
+}
+
 // 对字符串生成MD5 16Bit签名
 func KeySign(rr dns.RR) (cipher string, err error) {
 	data := strings.TrimPrefix(rr.String(), rr.Header().String())
@@ -35,10 +46,16 @@ func KeySign(rr dns.RR) (cipher string, err error) {
 
 // 查询是否是内部域名
 func IsInternal(name string) bool {
-	for k := range Config.Service.InternalSuffix {
-		if strings.HasSuffix(name, Config.Service.InternalSuffix[k]) {
+	conf := Config()
+	for k := range conf.Service.InternalSuffix {
+		if strings.HasSuffix(name, conf.Service.InternalSuffix[k]) {
 			return true
 		}
 	}
 	return false
 }
+
+// 是否启用了DNS转发
+func HasUpstream() bool {
+	return Config().HasUpstream()
+}
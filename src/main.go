@@ -1,8 +1,11 @@
 package main
 
 import (
+	"os"
+
 	"local/global"
 	"local/service"
+	"local/storage"
 )
 
 func main() {
@@ -21,6 +24,14 @@ func main() {
 		return
 	}
 
+	// 转换存储器的数据格式后退出
+	if global.LaunchFlag.Migrate {
+		if err = storage.Migrate(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// 启动socket服务
 	service.Start()
 }
@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 指标名称的前缀
+const namespace = "dns"
+
+// 解析来源
+const (
+	SourceInternal = "internal" // 内部存储器
+	SourceUpstream = "upstream" // 转发到上游服务
+	SourceCache    = "cache"    // 上游响应缓存
+)
+
+// 响应耗时的分桶，从0.5毫秒到约4秒
+var durationBuckets = prometheus.ExponentialBuckets(0.0005, 2, 14)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "按监听服务、记录类型和响应码统计的查询次数",
+	}, []string{"listener", "qtype", "rcode"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "按监听服务统计的查询处理耗时",
+		Buckets:   durationBuckets,
+	}, []string{"listener"})
+
+	resolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resolutions_total",
+		Help:      "按解析来源(internal/upstream/cache)统计的解析次数",
+	}, []string{"source"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "按上游服务统计的查询耗时",
+		Buckets:   durationBuckets,
+	}, []string{"upstream"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "按上游服务统计的查询失败次数",
+	}, []string{"upstream"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_duration_seconds",
+		Help:      "按操作统计的存储器耗时",
+		Buckets:   durationBuckets,
+	}, []string{"operation"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "按操作统计的存储器失败次数",
+	}, []string{"operation"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		queries,
+		queryDuration,
+		resolutions,
+		upstreamDuration,
+		upstreamErrors,
+		storageDuration,
+		storageErrors,
+	)
+}
+
+// 输出指标的HTTP处理器
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// 注册的所有指标，用于读取指标的当前值
+func Gatherer() prometheus.Gatherer {
+	return registry
+}
+
+// 记录一次查询，未知的记录类型统一记为OTHER，避免标签值无限增长
+func ObserveQuery(listener string, qtype uint16, rcode int, elapsed time.Duration) {
+	typeStr, exist := dns.TypeToString[qtype]
+	if !exist {
+		typeStr = "OTHER"
+	}
+	rcodeStr, exist := dns.RcodeToString[rcode]
+	if !exist {
+		rcodeStr = "OTHER"
+	}
+	queries.WithLabelValues(listener, typeStr, rcodeStr).Inc()
+	queryDuration.WithLabelValues(listener).Observe(elapsed.Seconds())
+}
+
+// 记录一次解析的来源
+func ObserveResolve(source string) {
+	resolutions.WithLabelValues(source).Inc()
+}
+
+// 记录一次上游查询
+func ObserveUpstream(addr string, elapsed time.Duration, err error) {
+	upstreamDuration.WithLabelValues(addr).Observe(elapsed.Seconds())
+	if err != nil {
+		upstreamErrors.WithLabelValues(addr).Inc()
+	}
+}
+
+// 记录一次存储器操作
+func ObserveStorage(operation string, elapsed time.Duration, err error) {
+	storageDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+	if err != nil {
+		storageErrors.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// 测试查询按监听服务、记录类型和响应码计数，未知的类型和响应码记为OTHER
+func TestObserveQuery(t *testing.T) {
+	known := queries.WithLabelValues("test", "A", "NXDOMAIN")
+	other := queries.WithLabelValues("test", "OTHER", "OTHER")
+	knownBefore, otherBefore := testutil.ToFloat64(known), testutil.ToFloat64(other)
+
+	ObserveQuery("test", dns.TypeA, dns.RcodeNameError, time.Millisecond)
+	ObserveQuery("test", 65000, 4000, time.Millisecond)
+	if testutil.ToFloat64(known) != knownBefore+1 || testutil.ToFloat64(other) != otherBefore+1 {
+		t.Fatal("查询次数错误", testutil.ToFloat64(known), testutil.ToFloat64(other))
+	}
+	if testutil.CollectAndCount(queryDuration, "dns_query_duration_seconds") < 1 {
+		t.Fatal("未记录查询耗时")
+	}
+}
+
+// 测试上游及存储器的耗时和失败次数，只有失败时增加失败次数
+func TestObserveUpstreamAndStorage(t *testing.T) {
+	upstreamBefore := testutil.ToFloat64(upstreamErrors.WithLabelValues("udp://10.0.0.1:53"))
+	ObserveUpstream("udp://10.0.0.1:53", time.Millisecond, nil)
+	ObserveUpstream("udp://10.0.0.1:53", time.Millisecond, errors.New("timeout"))
+	if testutil.ToFloat64(upstreamErrors.WithLabelValues("udp://10.0.0.1:53")) != upstreamBefore+1 {
+		t.Fatal("上游失败次数错误")
+	}
+
+	storageBefore := testutil.ToFloat64(storageErrors.WithLabelValues("set"))
+	ObserveStorage("set", time.Millisecond, nil)
+	ObserveStorage("set", time.Millisecond, errors.New("timeout"))
+	if testutil.ToFloat64(storageErrors.WithLabelValues("set")) != storageBefore+1 {
+		t.Fatal("存储器失败次数错误")
+	}
+
+	// 输出的指标通过格式检查
+	problems, err := testutil.GatherAndLint(Gatherer(), "dns_upstream_duration_seconds", "dns_storage_duration_seconds")
+	if err != nil || len(problems) > 0 {
+		t.Fatal("指标格式错误", problems, err)
+	}
+	expected := `
+# HELP dns_resolutions_total 按解析来源(internal/upstream/cache)统计的解析次数
+# TYPE dns_resolutions_total counter
+dns_resolutions_total{source="cache"} 1
+`
+	resolutions.Reset()
+	ObserveResolve(SourceCache)
+	if err = testutil.GatherAndCompare(Gatherer(), strings.NewReader(expected), "dns_resolutions_total"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,149 @@
+package querylog
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"google.golang.org/protobuf/proto"
+)
+
+// dnstap.proto中DNS over QUIC的传输协议取值，golang-dnstap v0.4.0中未定义
+const socketProtocolDOQ dnstap.SocketProtocol = 7
+
+// 以dnstap格式输出的输出端，地址以unix://开头时写入Unix socket，否则写入文件
+type dnstapSink struct {
+	output dnstap.Output
+	done   chan struct{}
+}
+
+func newDnstapSink(addr string) (sink *dnstapSink, err error) {
+	var output dnstap.Output
+	if strings.HasPrefix(addr, "unix://") {
+		var sockOutput *dnstap.FrameStreamSockOutput
+		sockOutput, err = dnstap.NewFrameStreamSockOutput(&net.UnixAddr{
+			Name: strings.TrimPrefix(addr, "unix://"),
+			Net:  "unix",
+		})
+		if err != nil {
+			return
+		}
+		sockOutput.SetTimeout(5 * time.Second)
+		sockOutput.SetRetryInterval(5 * time.Second)
+		output = sockOutput
+	} else {
+		output, err = dnstap.NewFrameStreamOutputFromFilename(addr)
+		if err != nil {
+			return
+		}
+	}
+	sink = &dnstapSink{
+		output: output,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		output.RunOutputLoop()
+		close(sink.done)
+	}()
+	return
+}
+
+// 每条查询日志输出CLIENT_QUERY和CLIENT_RESPONSE两条消息
+func (sink *dnstapSink) Write(entry *Entry) error {
+	if entry.ReqMsg == nil {
+		return nil
+	}
+	queryMsg, err := entry.ReqMsg.Pack()
+	if err != nil {
+		return err
+	}
+
+	query := newDnstapMessage(entry, dnstap.Message_CLIENT_QUERY)
+	query.QueryMessage = queryMsg
+	if err = sink.send(query); err != nil {
+		return err
+	}
+
+	if entry.RespMsg == nil {
+		return nil
+	}
+	respMsg, err := entry.RespMsg.Pack()
+	if err != nil {
+		return err
+	}
+	resp := newDnstapMessage(entry, dnstap.Message_CLIENT_RESPONSE)
+	resp.ResponseMessage = respMsg
+	respTime := entry.Time.Add(time.Duration(entry.Latency * float64(time.Millisecond)))
+	respSec, respNsec := uint64(respTime.Unix()), uint32(respTime.Nanosecond())
+	resp.ResponseTimeSec = &respSec
+	resp.ResponseTimeNsec = &respNsec
+	return sink.send(resp)
+}
+
+func (sink *dnstapSink) send(msg *dnstap.Message) error {
+	typ := dnstap.Dnstap_MESSAGE
+	data, err := proto.Marshal(&dnstap.Dnstap{
+		Type:    &typ,
+		Message: msg,
+	})
+	if err != nil {
+		return err
+	}
+	sink.output.GetOutputChannel() <- data
+	return nil
+}
+
+func (sink *dnstapSink) Close() error {
+	sink.output.Close()
+	<-sink.done
+	return nil
+}
+
+// 填充消息的公共字段
+func newDnstapMessage(entry *Entry, typ dnstap.Message_Type) *dnstap.Message {
+	var (
+		family   = dnstap.SocketFamily_INET
+		protocol dnstap.SocketProtocol
+		querySec = uint64(entry.Time.Unix())
+		queryNs  = uint32(entry.Time.Nanosecond())
+	)
+	switch entry.Protocol {
+	case "tcp":
+		protocol = dnstap.SocketProtocol_TCP
+	case "tls":
+		protocol = dnstap.SocketProtocol_DOT
+	case "quic":
+		protocol = socketProtocolDOQ
+	case "doh", "json":
+		protocol = dnstap.SocketProtocol_DOH
+	default:
+		protocol = dnstap.SocketProtocol_UDP
+	}
+	msg := &dnstap.Message{
+		Type:           &typ,
+		SocketFamily:   &family,
+		SocketProtocol: &protocol,
+		QueryTimeSec:   &querySec,
+		QueryTimeNsec:  &queryNs,
+	}
+
+	host, portStr, err := net.SplitHostPort(entry.Client)
+	if err != nil {
+		return msg
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg.QueryAddress = ip4
+		} else {
+			family = dnstap.SocketFamily_INET6
+			msg.QueryAddress = ip.To16()
+		}
+	}
+	if port, err := strconv.ParseUint(portStr, 10, 16); err == nil {
+		queryPort := uint32(port)
+		msg.QueryPort = &queryPort
+	}
+	return msg
+}
@@ -0,0 +1,233 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+// Frame Streams的控制帧类型及字段类型
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+	fstrmContentType   = 0x01
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams的帧，control为0时是数据帧
+type fstrmFrame struct {
+	control     uint32
+	contentType string
+	data        []byte
+}
+
+// 读取一帧：数据帧为4字节长度及数据；控制帧以4字节0开头，之后为4字节长度、4字节控制类型及字段
+func readFrame(reader io.Reader) (frame fstrmFrame, err error) {
+	var length uint32
+	if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return
+	}
+	if length > 0 {
+		frame.data = make([]byte, length)
+		_, err = io.ReadFull(reader, frame.data)
+		return
+	}
+
+	if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return
+	}
+	control := make([]byte, length)
+	if _, err = io.ReadFull(reader, control); err != nil {
+		return
+	}
+	frame.control = binary.BigEndian.Uint32(control)
+	for fields := control[4:]; len(fields) >= 8; {
+		fieldType, fieldLength := binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:])
+		if fieldType == fstrmContentType {
+			frame.contentType = string(fields[8 : 8+fieldLength])
+		}
+		fields = fields[8+fieldLength:]
+	}
+	return
+}
+
+// 写入控制帧
+func writeControl(writer io.Writer, control uint32, contentType string) error {
+	payload := binary.BigEndian.AppendUint32(nil, control)
+	if contentType != "" {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(contentType)))
+		payload = append(payload, contentType...)
+	}
+	buf := binary.BigEndian.AppendUint32(nil, 0)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	_, err := writer.Write(append(buf, payload...))
+	return err
+}
+
+// 读取START控制帧、全部数据帧直到STOP控制帧，返回解码后的dnstap消息
+func readDnstapStream(reader io.Reader) (messages []*dnstap.Message, err error) {
+	frame, err := readFrame(reader)
+	if err != nil {
+		return
+	}
+	if frame.control != fstrmControlStart || frame.contentType != dnstapContentType {
+		return nil, fmt.Errorf("START控制帧错误 %+v", frame)
+	}
+	for {
+		if frame, err = readFrame(reader); err != nil {
+			return
+		}
+		if frame.control == fstrmControlStop {
+			return
+		}
+		if frame.control != 0 {
+			return nil, fmt.Errorf("意外的控制帧 %d", frame.control)
+		}
+		var payload dnstap.Dnstap
+		if err = proto.Unmarshal(frame.data, &payload); err != nil {
+			return
+		}
+		if payload.GetType() != dnstap.Dnstap_MESSAGE {
+			return nil, fmt.Errorf("dnstap的类型错误 %v", payload.GetType())
+		}
+		messages = append(messages, payload.GetMessage())
+	}
+}
+
+// 核对一条查询日志输出的CLIENT_QUERY及CLIENT_RESPONSE消息
+func checkDnstapMessages(t *testing.T, entry *Entry, messages []*dnstap.Message) {
+	t.Helper()
+	if len(messages) != 2 {
+		t.Fatal("消息数量错误", len(messages))
+	}
+	query, resp := messages[0], messages[1]
+	if query.GetType() != dnstap.Message_CLIENT_QUERY || resp.GetType() != dnstap.Message_CLIENT_RESPONSE {
+		t.Fatal("消息类型错误", query.GetType(), resp.GetType())
+	}
+	for _, msg := range messages {
+		if msg.GetSocketFamily() != dnstap.SocketFamily_INET || msg.GetSocketProtocol() != dnstap.SocketProtocol_DOT {
+			t.Error("传输协议错误", msg.GetSocketFamily(), msg.GetSocketProtocol())
+		}
+		if !net.IP(msg.GetQueryAddress()).Equal(net.ParseIP("192.0.2.1")) || msg.GetQueryPort() != 5353 {
+			t.Error("客户端地址错误", net.IP(msg.GetQueryAddress()), msg.GetQueryPort())
+		}
+		if msg.GetQueryTimeSec() != uint64(entry.Time.Unix()) || msg.GetQueryTimeNsec() != uint32(entry.Time.Nanosecond()) {
+			t.Error("查询时间错误", msg.GetQueryTimeSec(), msg.GetQueryTimeNsec())
+		}
+	}
+
+	queryMsg := new(dns.Msg)
+	if err := queryMsg.Unpack(query.GetQueryMessage()); err != nil || queryMsg.Question[0].Name != entry.Name {
+		t.Fatal("查询消息错误", queryMsg, err)
+	}
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(resp.GetResponseMessage()); err != nil || len(respMsg.Answer) != 1 {
+		t.Fatal("响应消息错误", respMsg, err)
+	}
+	respTime := time.Unix(int64(resp.GetResponseTimeSec()), int64(resp.GetResponseTimeNsec()))
+	if want := entry.Time.Add(1500 * time.Microsecond); !respTime.Equal(want) {
+		t.Fatal("响应时间错误", respTime, want)
+	}
+}
+
+// 测试写入文件的dnstap输出以START控制帧开头、STOP控制帧结尾，数据帧为dnstap消息
+func TestDnstapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.dnstap")
+	sink, err := newDnstapSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := newEntry("www.test.")
+	if err = sink.Write(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	messages, err := readDnstapStream(bufio.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDnstapMessages(t, entry, messages)
+}
+
+// 测试写入Unix socket的dnstap输出完成双向握手：READY/ACCEPT，结束时STOP/FINISH
+func TestDnstapSocket(t *testing.T) {
+	// Unix socket的路径长度有限，不使用t.TempDir
+	dir, err := os.MkdirTemp("", "dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "dnstap.sock")
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []*dnstap.Message, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		frame, err := readFrame(reader)
+		if err != nil || frame.control != fstrmControlReady || frame.contentType != dnstapContentType {
+			t.Error("READY控制帧错误", frame, err)
+			return
+		}
+		if err = writeControl(conn, fstrmControlAccept, dnstapContentType); err != nil {
+			t.Error(err)
+			return
+		}
+		messages, err := readDnstapStream(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = writeControl(conn, fstrmControlFinish, "")
+		received <- messages
+	}()
+
+	sink, err := newDnstapSink("unix://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := newEntry("www.test.")
+	if err = sink.Write(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case messages := <-received:
+		checkDnstapMessages(t, entry, messages)
+	case <-time.After(5 * time.Second):
+		t.Fatal("未收到dnstap消息")
+	}
+}
@@ -0,0 +1,158 @@
+package querylog
+
+import (
+	"sync"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// 等待写入的查询日志数量上限，超出时丢弃新的日志，避免阻塞查询
+const queueSize = 4096
+
+// 查询日志条目
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`             // 客户端地址(ip:port)
+	Protocol string    `json:"protocol"`           // 下游协议，udp/tcp/tls/quic/doh/json
+	Name     string    `json:"name"`               // 查询的域名
+	Type     string    `json:"type"`               // 查询的记录类型
+	Class    string    `json:"class"`              // 查询的记录类别
+	Rcode    string    `json:"rcode"`              // 响应码
+	Answers  int       `json:"answers"`            // 应答记录数量
+	Source   string    `json:"source"`             // 解析来源，internal/upstream/cache
+	Upstream string    `json:"upstream,omitempty"` // 实际使用的上游服务
+	Latency  float64   `json:"latency"`            // 处理耗时(毫秒)
+
+	ReqMsg  *dns.Msg `json:"-"`
+	RespMsg *dns.Msg `json:"-"`
+}
+
+// 查询日志的输出端
+type Sink interface {
+	Write(entry *Entry) error
+	Close() error
+}
+
+// 当前使用的输出端
+var current struct {
+	sync.Mutex
+	file   string
+	logger bool
+	dnstap string
+	sinks  []Sink
+	queue  chan *Entry
+	done   chan struct{} // 输出端全部关闭后关闭
+}
+
+// 按当前配置设置查询日志的输出端，配置未变化时沿用已有的输出端
+func Setup() (err error) {
+	var sinks []Sink
+	conf := global.Config().QueryLog
+
+	current.Lock()
+	defer current.Unlock()
+	if current.queue != nil && current.file == conf.File && current.logger == conf.Logger && current.dnstap == conf.Dnstap {
+		return
+	}
+
+	if conf.File != "" {
+		var sink Sink
+		if sink, err = newFileSink(conf.File); err != nil {
+			log.Err(err).Caller().Str("file", conf.File).Msg("打开查询日志文件失败")
+			closeSinks(sinks)
+			return
+		}
+		sinks = append(sinks, sink)
+	}
+	if conf.Logger {
+		sinks = append(sinks, loggerSink{})
+	}
+	if conf.Dnstap != "" {
+		var sink Sink
+		if sink, err = newDnstapSink(conf.Dnstap); err != nil {
+			log.Err(err).Caller().Str("dnstap", conf.Dnstap).Msg("打开dnstap输出失败")
+			closeSinks(sinks)
+			return
+		}
+		sinks = append(sinks, sink)
+	}
+
+	// 关闭旧的输出端，旧队列中剩余的日志写完后再关闭
+	if current.queue != nil {
+		close(current.queue)
+	}
+	current.file = conf.File
+	current.logger = conf.Logger
+	current.dnstap = conf.Dnstap
+	current.sinks = sinks
+	current.queue = nil
+	current.done = nil
+	if len(sinks) > 0 {
+		current.queue = make(chan *Entry, queueSize)
+		current.done = make(chan struct{})
+		go dispatch(current.queue, sinks, current.done)
+		log.Info().Str("file", conf.File).Bool("logger", conf.Logger).Str("dnstap", conf.Dnstap).Msg("启用查询日志")
+	}
+	return
+}
+
+// 是否启用了查询日志
+func Enabled() bool {
+	current.Lock()
+	defer current.Unlock()
+	return current.queue != nil
+}
+
+// 记录一条查询日志，队列已满时丢弃
+func Record(entry *Entry) {
+	current.Lock()
+	defer current.Unlock()
+	if current.queue == nil {
+		return
+	}
+	select {
+	case current.queue <- entry:
+	default:
+		log.Warn().Str("name", entry.Name).Msg("查询日志队列已满，丢弃日志")
+	}
+}
+
+// 关闭所有输出端，等待队列中剩余的日志写完
+func Close() {
+	current.Lock()
+	queue, done := current.queue, current.done
+	current.queue = nil
+	current.done = nil
+	current.sinks = nil
+	current.Unlock()
+
+	if queue != nil {
+		close(queue)
+		<-done
+	}
+}
+
+// 将队列中的日志写入所有输出端，队列关闭后关闭输出端
+func dispatch(queue chan *Entry, sinks []Sink, done chan struct{}) {
+	for entry := range queue {
+		for _, sink := range sinks {
+			if err := sink.Write(entry); err != nil {
+				log.Warn().Err(err).Caller().Msg("写入查询日志失败")
+			}
+		}
+	}
+	closeSinks(sinks)
+	close(done)
+}
+
+func closeSinks(sinks []Sink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Warn().Err(err).Caller().Msg("关闭查询日志输出端失败")
+		}
+	}
+}
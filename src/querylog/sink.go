@@ -0,0 +1,132 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 缓冲区中的日志最长的写入间隔
+const flushInterval = time.Second
+
+// 以JSON lines格式写入文件的输出端，文件被轮转(移走或删除)后在原路径重新创建文件
+type fileSink struct {
+	path   string
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	done   chan struct{}
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	path = filepath.Clean(path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sink := &fileSink{
+		path:   path,
+		file:   file,
+		writer: bufio.NewWriter(file),
+		done:   make(chan struct{}),
+	}
+	go sink.flushLoop()
+	return sink, nil
+}
+
+func (sink *fileSink) Write(entry *Entry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if _, err = sink.writer.Write(data); err != nil {
+		return err
+	}
+	return sink.writer.WriteByte('\n')
+}
+
+// 定时将缓冲区写入文件，并检查文件是否已被轮转
+func (sink *fileSink) flushLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sink.mutex.Lock()
+			if err := sink.writer.Flush(); err != nil {
+				log.Warn().Err(err).Caller().Msg("写入查询日志文件失败")
+			}
+			if err := sink.reopen(); err != nil {
+				log.Warn().Err(err).Caller().Str("file", sink.path).Msg("重新打开查询日志文件失败")
+			}
+			sink.mutex.Unlock()
+		case <-sink.done:
+			return
+		}
+	}
+}
+
+// 原路径的文件已不是当前写入的文件时重新打开原路径，调用时需持有锁
+func (sink *fileSink) reopen() error {
+	info, err := os.Stat(sink.path)
+	if err == nil {
+		current, err := sink.file.Stat()
+		if err == nil && os.SameFile(info, current) {
+			return nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_ = sink.file.Close()
+	sink.file = file
+	sink.writer.Reset(file)
+	return nil
+}
+
+func (sink *fileSink) Close() error {
+	close(sink.done)
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if err := sink.writer.Flush(); err != nil {
+		_ = sink.file.Close()
+		return err
+	}
+	return sink.file.Close()
+}
+
+// 使用程序日志记录器输出
+type loggerSink struct{}
+
+func (loggerSink) Write(entry *Entry) error {
+	log.Info().
+		Str("client", entry.Client).
+		Str("protocol", entry.Protocol).
+		Str("name", entry.Name).
+		Str("type", entry.Type).
+		Str("class", entry.Class).
+		Str("rcode", entry.Rcode).
+		Int("answers", entry.Answers).
+		Str("source", entry.Source).
+		Str("upstream", entry.Upstream).
+		Float64("latency", entry.Latency).
+		Msg("查询日志")
+	return nil
+}
+
+func (loggerSink) Close() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// 构造一条查询日志，请求及响应消息按查询的域名生成
+func newEntry(name string) *Entry {
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion(name, dns.TypeA)
+	respMsg := new(dns.Msg)
+	respMsg.SetReply(reqMsg)
+	rr, _ := dns.NewRR(name + " 60 IN A 10.0.0.1")
+	respMsg.Answer = append(respMsg.Answer, rr)
+	return &Entry{
+		Time:     time.Unix(1700000000, 500),
+		Client:   "192.0.2.1:5353",
+		Protocol: "tls",
+		Name:     name,
+		Type:     "A",
+		Class:    "IN",
+		Rcode:    "NOERROR",
+		Answers:  1,
+		Source:   "upstream",
+		Upstream: "udp://10.0.0.53:53",
+		Latency:  1.5,
+		ReqMsg:   reqMsg,
+		RespMsg:  respMsg,
+	}
+}
+
+// 读取JSON lines文件中的查询日志
+func readEntries(t *testing.T, path string) (entries []Entry) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry Entry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// 测试文件输出端以JSON lines格式写入，关闭时写入缓冲区中剩余的日志
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	sink, err := newFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.test.", "b.test."} {
+		if err = sink.Write(newEntry(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readEntries(t, path)
+	if len(entries) != 2 || entries[0].Name != "a.test." || entries[1].Name != "b.test." {
+		t.Fatal("写入的日志错误", entries)
+	}
+	if entries[0].Client != "192.0.2.1:5353" || entries[0].Upstream != "udp://10.0.0.53:53" || entries[0].Latency != 1.5 || entries[0].Answers != 1 {
+		t.Fatal("日志的字段错误", entries[0])
+	}
+}
+
+// 测试文件被移走或删除后在原路径重新创建文件，轮转前的日志留在旧文件中
+func TestFileSinkRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "query.log")
+	sink, err := newFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	_ = sink.Write(newEntry("before.test."))
+	if err = os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	// 等待定时写入时发现文件已被移走
+	time.Sleep(flushInterval + 200*time.Millisecond)
+	_ = sink.Write(newEntry("moved.test."))
+
+	if err = os.Remove(path); err != nil {
+		t.Fatal("未在原路径重新创建文件", err)
+	}
+	time.Sleep(flushInterval + 200*time.Millisecond)
+	_ = sink.Write(newEntry("removed.test."))
+	time.Sleep(flushInterval + 200*time.Millisecond)
+
+	if entries := readEntries(t, path+".1"); len(entries) != 1 || entries[0].Name != "before.test." {
+		t.Fatal("轮转前的日志错误", entries)
+	}
+	if entries := readEntries(t, path); len(entries) != 1 || entries[0].Name != "removed.test." {
+		t.Fatal("删除文件后的日志错误", entries)
+	}
+}
+
+// 测试程序日志输出端输出查询日志的字段
+func TestLoggerSink(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() {
+		log.Logger = logger
+	}()
+
+	if err := (loggerSink{}).Write(newEntry("www.test.")); err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"client":   "192.0.2.1:5353",
+		"protocol": "tls",
+		"name":     "www.test.",
+		"rcode":    "NOERROR",
+		"answers":  float64(1),
+		"source":   "upstream",
+		"upstream": "udp://10.0.0.53:53",
+		"latency":  1.5,
+	} {
+		if fields[key] != want {
+			t.Error("程序日志的字段错误", key, fields[key])
+		}
+	}
+}
+
+// 测试按配置启用输出端，记录的日志在关闭时全部写入
+func TestSetup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	conf := new(global.Configuration)
+	conf.QueryLog.File = path
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	if err := Setup(); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	if !Enabled() {
+		t.Fatal("配置了文件时未启用查询日志")
+	}
+	Record(newEntry("www.test."))
+	Close()
+	if Enabled() {
+		t.Fatal("关闭后仍启用查询日志")
+	}
+	if entries := readEntries(t, path); len(entries) != 1 || entries[0].Name != "www.test." {
+		t.Fatal("记录的日志错误", entries)
+	}
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 上游响应缓存实例，未启用时为nil
+var upstreamCache atomic.Pointer[responseCache]
+
+// 缓存键
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+// 缓存条目
+type cacheEntry struct {
+	key      cacheKey
+	msg      *dns.Msg
+	storedAt time.Time
+	expireAt time.Time
+}
+
+// 上游响应缓存，按LRU淘汰
+type responseCache struct {
+	mutex  sync.Mutex
+	size   int
+	maxTTL uint32
+	list   *list.List
+	items  map[cacheKey]*list.Element
+}
+
+// 新建上游响应缓存
+func newResponseCache(size int, maxTTL uint32) *responseCache {
+	return &responseCache{
+		size:   size,
+		maxTTL: maxTTL,
+		list:   list.New(),
+		items:  make(map[cacheKey]*list.Element, size),
+	}
+}
+
+// 根据请求消息生成缓存键
+func makeCacheKey(reqMsg *dns.Msg) (key cacheKey) {
+	key.name = strings.ToLower(reqMsg.Question[0].Name)
+	key.qtype = reqMsg.Question[0].Qtype
+	key.qclass = reqMsg.Question[0].Qclass
+	key.cd = reqMsg.CheckingDisabled
+	if opt := reqMsg.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return
+}
+
+// 获取缓存的响应消息，返回的是副本，其中记录的TTL已扣除缓存时长
+func (cache *responseCache) Get(reqMsg *dns.Msg) *dns.Msg {
+	key := makeCacheKey(reqMsg)
+
+	cache.mutex.Lock()
+	elem, exist := cache.items[key]
+	if !exist {
+		cache.mutex.Unlock()
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expireAt) {
+		cache.list.Remove(elem)
+		delete(cache.items, key)
+		cache.mutex.Unlock()
+		return nil
+	}
+	cache.list.MoveToFront(elem)
+	respMsg := entry.msg.Copy()
+	cache.mutex.Unlock()
+
+	elapsed := uint32(now.Sub(entry.storedAt) / time.Second)
+	decrementTTL(respMsg.Answer, elapsed)
+	decrementTTL(respMsg.Ns, elapsed)
+	decrementTTL(respMsg.Extra, elapsed)
+
+	respMsg.Id = reqMsg.Id
+	respMsg.Question = make([]dns.Question, len(reqMsg.Question))
+	copy(respMsg.Question, reqMsg.Question)
+	return respMsg
+}
+
+// 写入缓存，不可缓存的响应会被忽略
+func (cache *responseCache) Set(reqMsg *dns.Msg, respMsg *dns.Msg) {
+	if respMsg == nil || len(reqMsg.Question) == 0 {
+		return
+	}
+	ttl := cacheTTL(respMsg)
+	if cache.maxTTL > 0 && ttl > cache.maxTTL {
+		ttl = cache.maxTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:      makeCacheKey(reqMsg),
+		msg:      respMsg.Copy(),
+		storedAt: now,
+		expireAt: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if elem, exist := cache.items[entry.key]; exist {
+		elem.Value = entry
+		cache.list.MoveToFront(elem)
+		return
+	}
+	cache.items[entry.key] = cache.list.PushFront(entry)
+	for cache.list.Len() > cache.size {
+		elem := cache.list.Back()
+		cache.list.Remove(elem)
+		delete(cache.items, elem.Value.(*cacheEntry).key)
+	}
+}
+
+// 计算响应消息可缓存的时长(秒)，返回0表示不可缓存
+// 肯定应答取所有记录中最小的TTL，否定应答按RFC 2308取SOA记录的TTL与MINIMUM中较小的值
+func cacheTTL(respMsg *dns.Msg) (ttl uint32) {
+	if respMsg.Truncated {
+		return 0
+	}
+
+	switch {
+	case respMsg.Rcode == dns.RcodeSuccess && len(respMsg.Answer) > 0:
+		ttl = minTTL(respMsg.Answer, respMsg.Ns, respMsg.Extra)
+	case respMsg.Rcode == dns.RcodeSuccess || respMsg.Rcode == dns.RcodeNameError:
+		for k := range respMsg.Ns {
+			if soa, ok := respMsg.Ns[k].(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return
+			}
+		}
+	}
+	return
+}
+
+// 获取多组记录中最小的TTL，忽略OPT伪记录
+func minTTL(sections ...[]dns.RR) (ttl uint32) {
+	found := false
+	for _, section := range sections {
+		for k := range section {
+			if section[k].Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || section[k].Header().Ttl < ttl {
+				ttl = section[k].Header().Ttl
+				found = true
+			}
+		}
+	}
+	return
+}
+
+// 扣减记录的TTL，忽略OPT伪记录
+func decrementTTL(rrs []dns.RR, elapsed uint32) {
+	for k := range rrs {
+		header := rrs[k].Header()
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		if header.Ttl > elapsed {
+			header.Ttl -= elapsed
+		} else {
+			header.Ttl = 0
+		}
+	}
+}
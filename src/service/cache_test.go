@@ -0,0 +1,84 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// 测试缓存命中时替换消息ID
+func TestResponseCacheHit(t *testing.T) {
+	cache := newResponseCache(10, 0)
+
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion("example.com.", dns.TypeA)
+	respMsg := new(dns.Msg)
+	respMsg.SetReply(reqMsg)
+	rr, err := dns.NewRR("example.com. 300 IN A 127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respMsg.Answer = append(respMsg.Answer, rr)
+	cache.Set(reqMsg, respMsg)
+
+	reqMsg2 := new(dns.Msg)
+	reqMsg2.SetQuestion("EXAMPLE.com.", dns.TypeA)
+	cached := cache.Get(reqMsg2)
+	if cached == nil {
+		t.Fatal("缓存未命中")
+	}
+	if cached.Id != reqMsg2.Id {
+		t.Fatal("消息ID未替换")
+	}
+	if cached.Answer[0].Header().Ttl > 300 {
+		t.Fatal("TTL未扣减")
+	}
+
+	// DO标记不同时不应命中
+	reqMsg2.SetEdns0(4096, true)
+	if cache.Get(reqMsg2) != nil {
+		t.Fatal("DO标记不同时命中了缓存")
+	}
+}
+
+// 测试否定应答使用SOA的MINIMUM作为缓存时长
+func TestResponseCacheNegativeTTL(t *testing.T) {
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion("none.example.com.", dns.TypeA)
+	respMsg := new(dns.Msg)
+	respMsg.SetRcode(reqMsg, dns.RcodeNameError)
+	if cacheTTL(respMsg) != 0 {
+		t.Fatal("没有SOA的否定应答不应缓存")
+	}
+
+	soa, err := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respMsg.Ns = append(respMsg.Ns, soa)
+	if ttl := cacheTTL(respMsg); ttl != 60 {
+		t.Fatal("否定应答的缓存时长错误", ttl)
+	}
+}
+
+// 测试超过容量时淘汰最久未使用的条目
+func TestResponseCacheEvict(t *testing.T) {
+	cache := newResponseCache(1, 0)
+	for _, name := range []string{"a.example.com.", "b.example.com."} {
+		reqMsg := new(dns.Msg)
+		reqMsg.SetQuestion(name, dns.TypeA)
+		respMsg := new(dns.Msg)
+		respMsg.SetReply(reqMsg)
+		rr, err := dns.NewRR(name + " 300 IN A 127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		respMsg.Answer = append(respMsg.Answer, rr)
+		cache.Set(reqMsg, respMsg)
+	}
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion("a.example.com.", dns.TypeA)
+	if cache.Get(reqMsg) != nil {
+		t.Fatal("未淘汰旧条目")
+	}
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// 进行中的上游查询
+type inflightCall struct {
+	done    chan struct{}
+	respMsg *dns.Msg
+	err     error
+}
+
+var (
+	inflightMutex sync.Mutex
+	inflightCalls = make(map[cacheKey]*inflightCall)
+)
+
+// 合并相同的上游查询(域名、类型、类别及DO/CD标记相同)，只有第一个查询会调用fn，
+// 其它同时到达的查询等待其完成，并获得响应的副本(消息ID替换为各自请求的ID)
+func coalesce(reqMsg *dns.Msg, fn func() (*dns.Msg, error)) (respMsg *dns.Msg, err error) {
+	key := makeCacheKey(reqMsg)
+
+	inflightMutex.Lock()
+	if call, exist := inflightCalls[key]; exist {
+		inflightMutex.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		respMsg = call.respMsg.Copy()
+		respMsg.Id = reqMsg.Id
+		respMsg.Question = make([]dns.Question, len(reqMsg.Question))
+		copy(respMsg.Question, reqMsg.Question)
+		return respMsg, nil
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	inflightCalls[key] = call
+	inflightMutex.Unlock()
+
+	respMsg, err = fn()
+	call.err = err
+	if respMsg != nil {
+		// 保存副本，避免调用方修改响应消息时影响等待中的查询
+		call.respMsg = respMsg.Copy()
+	} else if err == nil {
+		call.err = errNoResponse
+	}
+
+	inflightMutex.Lock()
+	delete(inflightCalls, key)
+	inflightMutex.Unlock()
+	close(call.done)
+	return
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 测试相同的查询只会向上游发起一次，并且每个请求获得自己的消息ID
+func TestCoalesce(t *testing.T) {
+	var (
+		calls int32
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reqMsg := new(dns.Msg)
+			reqMsg.SetQuestion("example.com.", dns.TypeA)
+			<-start
+			respMsg, err := coalesce(reqMsg, func() (*dns.Msg, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(50 * time.Millisecond)
+				respMsg := new(dns.Msg)
+				respMsg.SetReply(reqMsg)
+				return respMsg, nil
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if respMsg.Id != reqMsg.Id {
+				t.Error("消息ID未替换")
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatal("上游查询次数错误", calls)
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"github.com/miekg/dns"
+)
+
+// 响应中通告的EDNS0 UDP缓冲区大小(DNS Flag Day 2020推荐值)
+const ednsUDPSize = 1232
+
+// 按客户端请求调整响应的OPT记录，UDP响应按客户端的缓冲区大小截断
+// 请求中有OPT记录时在响应中回应OPT记录，没有时移除响应中的OPT记录(RFC 6891)
+// 截断时尽量保留各节点的记录，放不下时设置TC标记，让客户端改用TCP重试
+func fitResponse(reqMsg *dns.Msg, respMsg *dns.Msg, udp bool) {
+	reqOpt := reqMsg.IsEdns0()
+	respOpt := respMsg.IsEdns0()
+
+	switch {
+	case reqOpt == nil && respOpt != nil:
+		removeOPT(respMsg)
+	case reqOpt != nil && respOpt == nil:
+		respMsg.SetEdns0(ednsUDPSize, reqOpt.Do())
+	case reqOpt != nil:
+		respOpt.SetUDPSize(ednsUDPSize)
+		if !reqOpt.Do() {
+			respOpt.SetDo(false)
+		}
+	}
+
+	if !udp {
+		return
+	}
+	size := dns.MinMsgSize
+	if reqOpt != nil && int(reqOpt.UDPSize()) > size {
+		size = int(reqOpt.UDPSize())
+	}
+	respMsg.Truncate(size)
+}
+
+// 移除附加节点中的OPT记录
+func removeOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// 生成包含多条A记录的响应
+func largeResponse(t *testing.T, reqMsg *dns.Msg, count int) *dns.Msg {
+	respMsg := new(dns.Msg)
+	respMsg.SetReply(reqMsg)
+	for k := 0; k < count; k++ {
+		rr, err := dns.NewRR("example.com. 300 IN A 10.0.0." + strconv.Itoa(k%250))
+		if err != nil {
+			t.Fatal(err)
+		}
+		respMsg.Answer = append(respMsg.Answer, rr)
+	}
+	ns, err := dns.NewRR("example.com. 300 IN NS ns1.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	respMsg.Ns = append(respMsg.Ns, ns)
+	return respMsg
+}
+
+// 测试没有OPT记录的UDP请求按512字节截断
+func TestFitResponseWithoutEDNS(t *testing.T) {
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion("example.com.", dns.TypeA)
+
+	respMsg := largeResponse(t, reqMsg, 100)
+	respMsg.SetEdns0(4096, false)
+	fitResponse(reqMsg, respMsg, true)
+	if respMsg.IsEdns0() != nil {
+		t.Fatal("请求中没有OPT记录时响应不应包含OPT记录")
+	}
+	if !respMsg.Truncated {
+		t.Fatal("未设置TC标记")
+	}
+	if respMsg.Len() > dns.MinMsgSize {
+		t.Fatal("响应超过了512字节")
+	}
+
+	// 能放下时保留所有节点
+	respMsg = largeResponse(t, reqMsg, 2)
+	fitResponse(reqMsg, respMsg, true)
+	if respMsg.Truncated || len(respMsg.Ns) != 1 {
+		t.Fatal("能放下的响应不应被截断")
+	}
+}
+
+// 测试按客户端的EDNS0缓冲区大小截断并回应OPT记录
+func TestFitResponseWithEDNS(t *testing.T) {
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion("example.com.", dns.TypeA)
+	reqMsg.SetEdns0(4096, true)
+
+	respMsg := largeResponse(t, reqMsg, 100)
+	fitResponse(reqMsg, respMsg, true)
+	opt := respMsg.IsEdns0()
+	if opt == nil {
+		t.Fatal("响应中没有回应OPT记录")
+	}
+	if !opt.Do() {
+		t.Fatal("未回应DO标记")
+	}
+	if respMsg.Truncated || len(respMsg.Answer) != 100 || len(respMsg.Ns) != 1 {
+		t.Fatal("缓冲区足够时不应截断")
+	}
+
+	// TCP响应不截断
+	reqMsg.IsEdns0().SetUDPSize(512)
+	respMsg = largeResponse(t, reqMsg, 100)
+	fitResponse(reqMsg, respMsg, false)
+	if respMsg.Truncated || len(respMsg.Answer) != 100 {
+		t.Fatal("TCP响应不应截断")
+	}
+}
@@ -1,7 +1,9 @@
 package service
 
 import (
+	"context"
 	"strings"
+	"time"
 
 	"local/global"
 
@@ -9,12 +11,17 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-type GeneralHandler struct{}
+// DNS查询处理器，Protocol为监听服务的协议(udp/tcp/tls/quic)，用于统计指标
+type GeneralHandler struct {
+	Protocol string
+}
 
 func (handler GeneralHandler) ServeDNS(resp dns.ResponseWriter, reqMsg *dns.Msg) {
 	var (
-		err     error
-		respMsg = new(dns.Msg)
+		err      error
+		respMsg  = new(dns.Msg)
+		upstream *Upstream
+		begin    = time.Now()
 	)
 	defer func() {
 		if resp != nil {
@@ -30,19 +37,22 @@ func (handler GeneralHandler) ServeDNS(resp dns.ResponseWriter, reqMsg *dns.Msg)
 
 	// 查询内部域的记录
 	if global.IsInternal(reqMsg.Question[0].Name) {
-		respMsg, err = queryStorage(reqMsg)
+		respMsg, err = queryStorage(context.Background(), reqMsg)
 		if err != nil {
 			log.Err(err).Caller().Msg("解析内部域名失败")
 		}
-	} else if global.Config.Service.Upstream.Count > 0 {
+	} else if global.HasUpstream() {
 		// 查询上游服务
-		upstream := Upstream{
+		upstream = &Upstream{
 			ReqMsg: reqMsg,
 		}
 		respMsg, err = upstream.Query()
 		if err != nil {
 			log.Err(err).Caller().Msg("查询上游服务失败")
 		}
+	} else {
+		// 既不是内部域名也未启用DNS转发，响应域名不存在
+		respMsg.SetRcode(reqMsg, dns.RcodeNameError)
 	}
 
 	if err != nil {
@@ -51,20 +61,13 @@ func (handler GeneralHandler) ServeDNS(resp dns.ResponseWriter, reqMsg *dns.Msg)
 		respMsg.Rcode = dns.RcodeServerFailure
 	}
 
-	if len(respMsg.Answer) == 0 {
-		respMsg.SetReply(reqMsg)
-		respMsg.Rcode = dns.RcodeNameError
-	}
-
-	// 防止UDP客户端无法接收超过512字节的数据，清空ns(AUTHORITY SECTION)和extra(ADDITIONAL SECTION)节点
-	if resp.LocalAddr().Network() == "udp" {
-		respMsg.Extra = nil
-		respMsg.Ns = nil
-	}
+	// 回应OPT记录，UDP响应按客户端的缓冲区大小截断
+	fitResponse(reqMsg, respMsg, resp.LocalAddr().Network() == "udp")
 
 	// 发送响应消息
 	err = resp.WriteMsg(respMsg)
 	if err != nil {
 		log.Err(err).Caller().Msg("响应消息失败")
 	}
+	recordQuery(handler.Protocol, resp.RemoteAddr().String(), reqMsg, respMsg, upstream, begin)
 }
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"local/global"
+	"local/metrics"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// 指标的当前值，计数器为计数，直方图为样本数，没有该序列时为0
+func metricValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	families, err := metrics.Gatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	next:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if want, ok := labels[pair.GetName()]; ok && want != pair.GetValue() {
+					continue next
+				}
+			}
+			if metric.GetHistogram() != nil {
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// 测试经由处理器的查询更新查询次数、耗时、解析来源、上游及存储器操作的指标
+func TestHandlerMetrics(t *testing.T) {
+	resetUpstreamStates()
+	upstream := startUDPServer(t, func(resp dns.ResponseWriter, reqMsg *dns.Msg) {
+		_ = resp.WriteMsg(answerMsg(reqMsg))
+	})
+	setupInternal(t, `
+[service]
+internalSuffix = ["app.test."]
+`, "www.app.test. 60 IN A 10.0.0.1")
+	global.Config().Service.Upstream.Addrs = []string{upstream}
+	global.Config().Service.Upstream.Count = 1
+	addr := strings.TrimPrefix(startUDPServer(t, GeneralHandler{Protocol: "udp"}.ServeDNS), "udp://")
+
+	series := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{"dns_queries_total", map[string]string{"listener": "udp", "qtype": "A", "rcode": "NOERROR"}},
+		{"dns_query_duration_seconds", map[string]string{"listener": "udp"}},
+		{"dns_resolutions_total", map[string]string{"source": metrics.SourceInternal}},
+		{"dns_resolutions_total", map[string]string{"source": metrics.SourceUpstream}},
+		{"dns_upstream_duration_seconds", map[string]string{"upstream": upstream}},
+		{"dns_storage_duration_seconds", map[string]string{"operation": "get"}},
+	}
+	before := make([]float64, len(series))
+	for k, item := range series {
+		before[k] = metricValue(t, item.name, item.labels)
+	}
+
+	for _, name := range []string{"www.app.test.", "www.example.test."} {
+		reqMsg := new(dns.Msg)
+		reqMsg.SetQuestion(name, dns.TypeA)
+		respMsg, err := dns.Exchange(reqMsg, addr)
+		if err != nil || len(respMsg.Answer) != 1 {
+			t.Fatal("查询失败", name, respMsg, err)
+		}
+	}
+
+	// 指标在发送响应后记录
+	waitFor(t, func() bool {
+		return metricValue(t, series[0].name, series[0].labels) == before[0]+2
+	})
+	for k, item := range series[1:] {
+		if metricValue(t, item.name, item.labels) <= before[k+1] {
+			t.Error("指标未更新", item.name, item.labels)
+		}
+	}
+	if count, err := testutil.GatherAndCount(metrics.Gatherer(), "dns_queries_total", "dns_storage_duration_seconds"); err != nil || count < 2 {
+		t.Fatal("未输出查询及存储器的指标", count, err)
+	}
+}
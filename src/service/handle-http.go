@@ -3,14 +3,20 @@ package service
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"local/global"
+	"local/metrics"
 	"local/storage"
+	"local/storage/rrutil"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog/log"
 )
 
@@ -23,9 +29,10 @@ func (hh HTTPHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	hh.resp = resp
 	hh.req = req
 
+	conf := global.Config().Service.HTTP
 	switch req.URL.Path {
-	case global.Config.Service.HTTP.DNSQueryPath:
-		if global.Config.Service.HTTP.DNSQueryPath == "" {
+	case conf.DNSQueryPath:
+		if conf.DNSQueryPath == "" {
 			break
 		}
 		if req.Method == http.MethodGet {
@@ -36,8 +43,8 @@ func (hh HTTPHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			break
 		}
 		hh.respStatus(http.StatusMethodNotAllowed, "")
-	case global.Config.Service.HTTP.JSONQueryPath:
-		if global.Config.Service.HTTP.JSONQueryPath == "" {
+	case conf.JSONQueryPath:
+		if conf.JSONQueryPath == "" {
 			break
 		}
 		if req.Method != http.MethodGet {
@@ -45,8 +52,8 @@ func (hh HTTPHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			break
 		}
 		hh.jsonQueryHandler() //nolint:contextcheck
-	case global.Config.Service.HTTP.RegisterPath:
-		if global.Config.Service.HTTP.RegisterPath == "" {
+	case conf.RegisterPath:
+		if conf.RegisterPath == "" {
 			break
 		}
 		if req.Method == http.MethodPost {
@@ -58,8 +65,8 @@ func (hh HTTPHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			break
 		}
 		hh.respStatus(http.StatusMethodNotAllowed, "")
-	case global.Config.Service.HTTP.DeletePath:
-		if global.Config.Service.HTTP.DeletePath == "" {
+	case conf.DeletePath:
+		if conf.DeletePath == "" {
 			break
 		}
 		if req.Method == http.MethodDelete {
@@ -67,11 +74,73 @@ func (hh HTTPHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 			break
 		}
 		hh.respStatus(http.StatusMethodNotAllowed, "")
+	case conf.UpstreamPath:
+		if conf.UpstreamPath == "" {
+			break
+		}
+		if req.Method != http.MethodGet {
+			hh.respStatus(http.StatusMethodNotAllowed, "")
+			break
+		}
+		hh.upstreamStatus()
+	case conf.MetricsPath:
+		if conf.MetricsPath == "" {
+			break
+		}
+		if req.Method != http.MethodGet {
+			hh.respStatus(http.StatusMethodNotAllowed, "")
+			break
+		}
+		if conf.MetricsAuth && req.Header.Get("Authorization") != conf.Authorization {
+			hh.respStatus(http.StatusUnauthorized, "")
+			break
+		}
+		metrics.Handler().ServeHTTP(resp, req)
+	case conf.ReloadPath:
+		if conf.ReloadPath == "" {
+			break
+		}
+		if req.Method != http.MethodPost {
+			hh.respStatus(http.StatusMethodNotAllowed, "")
+			break
+		}
+		hh.reload()
+	case conf.HealthPath:
+		if conf.HealthPath == "" {
+			break
+		}
+		if req.Method != http.MethodGet {
+			hh.respStatus(http.StatusMethodNotAllowed, "")
+			break
+		}
+		hh.health()
+	case conf.ListPath:
+		if conf.ListPath == "" {
+			break
+		}
+		if req.Method != http.MethodGet {
+			hh.respStatus(http.StatusMethodNotAllowed, "")
+			break
+		}
+		hh.list()
 	default:
 		hh.respStatus(http.StatusNotFound, "")
 	}
 }
 
+// 在响应头中通告HTTP/3服务(Alt-Svc)
+type altSvcHandler struct {
+	handler http.Handler
+	server  *http3.Server
+}
+
+func (handler altSvcHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if err := handler.server.SetQUICHeaders(resp.Header()); err != nil {
+		log.Debug().Err(err).Caller().Msg("设置Alt-Svc响应头失败")
+	}
+	handler.handler.ServeHTTP(resp, req)
+}
+
 func (hh *HTTPHandler) respStatus(status int, message string) {
 	hh.resp.WriteHeader(status)
 	if status == http.StatusNoContent {
@@ -95,9 +164,11 @@ func (hh *HTTPHandler) dnsQueryByGET() {
 		reqMsg     dns.Msg
 		respMsg    *dns.Msg
 		respData   []byte
+		upstream   *Upstream
+		begin      = time.Now()
 	)
 
-	if global.Config.Service.HTTP.DNSQueryAuth && hh.req.Header.Get("Authorization") != global.Config.Service.HTTP.Authorization {
+	if conf := global.Config().Service.HTTP; conf.DNSQueryAuth && hh.req.Header.Get("Authorization") != conf.Authorization {
 		hh.respStatus(http.StatusUnauthorized, "")
 		return
 	}
@@ -136,10 +207,13 @@ func (hh *HTTPHandler) dnsQueryByGET() {
 	if !strings.HasSuffix(reqMsg.Question[0].Name, ".") {
 		reqMsg.Question[0].Name += "."
 	}
+	defer func() {
+		recordQuery("doh", hh.req.RemoteAddr, &reqMsg, respMsg, upstream, begin)
+	}()
 
 	// 查询内部域的记录
 	if global.IsInternal(reqMsg.Question[0].Name) {
-		respMsg, err = queryStorage(&reqMsg)
+		respMsg, err = queryStorage(hh.req.Context(), &reqMsg)
 		if err != nil {
 			log.Err(err).Caller().Send()
 			hh.respStatus(http.StatusInternalServerError, "")
@@ -147,7 +221,7 @@ func (hh *HTTPHandler) dnsQueryByGET() {
 		}
 	} else {
 		// 查询上游服务
-		upstream := Upstream{
+		upstream = &Upstream{
 			ReqMsg:      &reqMsg,
 			MethodByDoT: hh.req.Method,
 		}
@@ -159,6 +233,7 @@ func (hh *HTTPHandler) dnsQueryByGET() {
 		}
 	}
 
+	fitResponse(&reqMsg, respMsg, false)
 	respData, err = respMsg.Pack()
 	if err != nil {
 		log.Err(err).Caller().Msg("编码响应数据失败")
@@ -180,9 +255,11 @@ func (hh *HTTPHandler) dnsQueryByPOST() {
 		respData []byte
 		reqMsg   dns.Msg
 		respMsg  *dns.Msg
+		upstream *Upstream
+		begin    = time.Now()
 	)
 
-	if global.Config.Service.HTTP.DNSQueryAuth && hh.req.Header.Get("Authorization") != global.Config.Service.HTTP.Authorization {
+	if conf := global.Config().Service.HTTP; conf.DNSQueryAuth && hh.req.Header.Get("Authorization") != conf.Authorization {
 		hh.respStatus(http.StatusUnauthorized, "")
 		return
 	}
@@ -211,10 +288,13 @@ func (hh *HTTPHandler) dnsQueryByPOST() {
 	if !strings.HasSuffix(reqMsg.Question[0].Name, ".") {
 		reqMsg.Question[0].Name += "."
 	}
+	defer func() {
+		recordQuery("doh", hh.req.RemoteAddr, &reqMsg, respMsg, upstream, begin)
+	}()
 
 	// 查询内部域的记录
 	if global.IsInternal(reqMsg.Question[0].Name) {
-		respMsg, err = queryStorage(&reqMsg)
+		respMsg, err = queryStorage(hh.req.Context(), &reqMsg)
 		if err != nil {
 			log.Err(err).Caller().Msg("查询存储器失败")
 			hh.respStatus(http.StatusInternalServerError, "")
@@ -222,7 +302,7 @@ func (hh *HTTPHandler) dnsQueryByPOST() {
 		}
 	} else {
 		// 查询上游服务
-		upstream := Upstream{
+		upstream = &Upstream{
 			ReqMsg:      &reqMsg,
 			MethodByDoT: hh.req.Method,
 		}
@@ -234,6 +314,7 @@ func (hh *HTTPHandler) dnsQueryByPOST() {
 		}
 	}
 
+	fitResponse(&reqMsg, respMsg, false)
 	respData, err = respMsg.Pack()
 	if err != nil {
 		log.Err(err).Caller().Msg("编码响应数据失败")
@@ -254,9 +335,11 @@ func (hh *HTTPHandler) jsonQueryHandler() {
 		reqMsg   = new(dns.Msg)
 		respData []byte
 		respMsg  *dns.Msg
+		upstream *Upstream
+		begin    = time.Now()
 	)
 
-	if global.Config.Service.HTTP.JSONQueryAuth && hh.req.Header.Get("Authorization") != global.Config.Service.HTTP.Authorization {
+	if conf := global.Config().Service.HTTP; conf.JSONQueryAuth && hh.req.Header.Get("Authorization") != conf.Authorization {
 		hh.respStatus(http.StatusUnauthorized, "")
 		return
 	}
@@ -284,16 +367,19 @@ func (hh *HTTPHandler) jsonQueryHandler() {
 	if !strings.HasSuffix(reqMsg.Question[0].Name, ".") {
 		reqMsg.Question[0].Name += "."
 	}
+	defer func() {
+		recordQuery("json", hh.req.RemoteAddr, reqMsg, respMsg, upstream, begin)
+	}()
 
 	if global.IsInternal(reqMsg.Question[0].Name) {
-		respMsg, err = queryStorage(reqMsg)
+		respMsg, err = queryStorage(hh.req.Context(), reqMsg)
 		if err != nil {
 			log.Err(err).Caller().Msg("查询存储器失败")
 			hh.respStatus(http.StatusInternalServerError, "")
 			return
 		}
 	} else {
-		upstream := Upstream{
+		upstream = &Upstream{
 			MethodByDoT: hh.req.Method,
 			ReqMsg:      reqMsg,
 		}
@@ -326,7 +412,7 @@ func (hh *HTTPHandler) register(replace bool) {
 		oldRR []dns.RR
 	)
 
-	if global.Config.Service.HTTP.RegisterAuth && hh.req.Header.Get("Authorization") != global.Config.Service.HTTP.Authorization {
+	if conf := global.Config().Service.HTTP; conf.RegisterAuth && hh.req.Header.Get("Authorization") != conf.Authorization {
 		hh.respStatus(http.StatusUnauthorized, "")
 		return
 	}
@@ -361,8 +447,11 @@ func (hh *HTTPHandler) register(replace bool) {
 		return
 	}
 
+	ctx, cancel := storageContext(hh.req.Context())
+	defer cancel()
+
 	if !replace {
-		if oldRR, err = storage.Storage.Get(dns.Question{
+		if oldRR, err = storage.Storage().Get(ctx, dns.Question{
 			Name:   rr.Header().Name,
 			Qtype:  rr.Header().Rrtype,
 			Qclass: rr.Header().Class,
@@ -378,8 +467,14 @@ func (hh *HTTPHandler) register(replace bool) {
 		}
 	}
 
-	err = storage.Storage.Set(rr)
+	err = changeZone(ctx, rr.Header().Name, func() error {
+		return storage.Storage().Set(ctx, rr)
+	})
 	if err != nil {
+		if errors.Is(err, rrutil.ErrReadOnly) {
+			hh.respStatus(http.StatusForbidden, "The storage is read-only")
+			return
+		}
 		log.Err(err).Caller().Str("name", rr.Header().Name).Str("type", dns.TypeToString[rr.Header().Rrtype]).Str("data", strings.TrimPrefix(rr.String(), rr.Header().String())).Msg("写入记录失败")
 		hh.respStatus(http.StatusInternalServerError, "")
 		return
@@ -396,7 +491,7 @@ func (hh *HTTPHandler) delete() {
 		rr    dns.RR
 	)
 
-	if global.Config.Service.HTTP.DeleteAuth && hh.req.Header.Get("Authorization") != global.Config.Service.HTTP.Authorization {
+	if conf := global.Config().Service.HTTP; conf.DeleteAuth && hh.req.Header.Get("Authorization") != conf.Authorization {
 		hh.respStatus(http.StatusUnauthorized, "")
 		return
 	}
@@ -427,8 +522,16 @@ func (hh *HTTPHandler) delete() {
 		return
 	}
 
-	err = storage.Storage.Del(rr)
+	ctx, cancel := storageContext(hh.req.Context())
+	defer cancel()
+	err = changeZone(ctx, rr.Header().Name, func() error {
+		return storage.Storage().Del(ctx, rr)
+	})
 	if err != nil {
+		if errors.Is(err, rrutil.ErrReadOnly) {
+			hh.respStatus(http.StatusForbidden, "The storage is read-only")
+			return
+		}
 		log.Err(err).Caller().Str("name", rr.Header().Name).Str("type", dns.TypeToString[rr.Header().Rrtype]).Str("data", strings.TrimPrefix(rr.String(), rr.Header().String())).Msg("删除记录失败")
 		hh.respStatus(http.StatusInternalServerError, "")
 		return
@@ -437,6 +540,181 @@ func (hh *HTTPHandler) delete() {
 	hh.respStatus(http.StatusNoContent, "")
 }
 
+// 查询上游服务的健康状态
+func (hh *HTTPHandler) upstreamStatus() {
+	var (
+		err      error
+		respData []byte
+	)
+
+	if conf := global.Config().Service.HTTP; conf.UpstreamAuth && hh.req.Header.Get("Authorization") != conf.Authorization {
+		hh.respStatus(http.StatusUnauthorized, "")
+		return
+	}
+
+	respData, err = json.Marshal(upstreamHealth())
+	if err != nil {
+		log.Err(err).Caller().Msg("编码响应数据失败")
+		hh.respStatus(http.StatusInternalServerError, "")
+		return
+	}
+
+	hh.resp.Header().Set("Content-Type", "application/json")
+	_, err = hh.resp.Write(respData)
+	if err != nil {
+		log.Warn().Err(err).Caller().Msg("响应数据时出错")
+	}
+}
+
+// 健康检查，存储器不可用时响应503，无需认证以便负载均衡器等调用
+func (hh *HTTPHandler) health() {
+	var (
+		err      error
+		respData []byte
+		status   = http.StatusOK
+		result   = map[string]string{"storage": "ok"}
+	)
+
+	// 未启用内部域名解析时不构建存储器，只转发查询的服务视为健康
+	if len(global.Config().Service.InternalSuffix) == 0 {
+		result["storage"] = "disabled"
+	} else {
+		ctx, cancel := storageContext(hh.req.Context())
+		defer cancel()
+		if err = storage.Ping(ctx); err != nil {
+			log.Warn().Err(err).Caller().Msg("检查存储器失败")
+			status = http.StatusServiceUnavailable
+			result["storage"] = err.Error()
+		}
+	}
+
+	respData, err = json.Marshal(result)
+	if err != nil {
+		log.Err(err).Caller().Msg("编码响应数据失败")
+		hh.respStatus(http.StatusInternalServerError, "")
+		return
+	}
+
+	hh.resp.Header().Set("Content-Type", "application/json")
+	hh.resp.WriteHeader(status)
+	_, err = hh.resp.Write(respData)
+	if err != nil {
+		log.Warn().Err(err).Caller().Msg("响应数据时出错")
+	}
+}
+
+// 列出记录的默认及最大分页大小
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// 列出的记录
+type listRecord struct {
+	Name  string `json:"name"`
+	Class string `json:"class"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Data  string `json:"data"`
+}
+
+// 列出存储器中的记录，支持按域名后缀、前缀及类型过滤和分页，必须通过认证
+func (hh *HTTPHandler) list() {
+	var (
+		err      error
+		rr       []dns.RR
+		total    int
+		respData []byte
+		opts     = rrutil.ListOptions{Limit: defaultListLimit}
+		query    = hh.req.URL.Query()
+	)
+
+	if conf := global.Config().Service.HTTP; conf.Authorization == "" || hh.req.Header.Get("Authorization") != conf.Authorization {
+		hh.respStatus(http.StatusUnauthorized, "")
+		return
+	}
+
+	opts.Suffix = query.Get("suffix")
+	opts.Prefix = query.Get("prefix")
+	if value := query.Get("type"); value != "" {
+		if opts.Type = dns.StringToType[strings.ToUpper(value)]; opts.Type == 0 {
+			hh.respStatus(http.StatusBadRequest, "Invalid 'type' parameter")
+			return
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		if opts.Offset, err = strconv.Atoi(value); err != nil || opts.Offset < 0 {
+			hh.respStatus(http.StatusBadRequest, "Invalid 'offset' parameter")
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if opts.Limit, err = strconv.Atoi(value); err != nil || opts.Limit < 1 || opts.Limit > maxListLimit {
+			hh.respStatus(http.StatusBadRequest, "Invalid 'limit' parameter")
+			return
+		}
+	}
+
+	// 未启用内部域名解析时没有存储器
+	inst := storage.Storage()
+	if inst == nil {
+		hh.respStatus(http.StatusServiceUnavailable, "The storage is not available")
+		return
+	}
+	ctx, cancel := storageContext(hh.req.Context())
+	defer cancel()
+	rr, total, err = inst.List(ctx, opts)
+	if err != nil {
+		log.Err(err).Caller().Msg("列出存储器记录时出错")
+		hh.respStatus(http.StatusInternalServerError, "")
+		return
+	}
+
+	result := struct {
+		Total   int          `json:"total"`
+		Records []listRecord `json:"records"`
+	}{
+		Total:   total,
+		Records: make([]listRecord, len(rr)),
+	}
+	for k := range rr {
+		result.Records[k] = listRecord{
+			Name:  rr[k].Header().Name,
+			Class: dns.ClassToString[rr[k].Header().Class],
+			Type:  dns.TypeToString[rr[k].Header().Rrtype],
+			TTL:   rr[k].Header().Ttl,
+			Data:  strings.TrimPrefix(rr[k].String(), rr[k].Header().String()),
+		}
+	}
+	respData, err = json.Marshal(result)
+	if err != nil {
+		log.Err(err).Caller().Msg("编码响应数据失败")
+		hh.respStatus(http.StatusInternalServerError, "")
+		return
+	}
+
+	hh.resp.Header().Set("Content-Type", "application/json")
+	_, err = hh.resp.Write(respData)
+	if err != nil {
+		log.Warn().Err(err).Caller().Msg("响应数据时出错")
+	}
+}
+
+// 重载配置，必须通过认证
+func (hh *HTTPHandler) reload() {
+	if conf := global.Config().Service.HTTP; conf.Authorization == "" || hh.req.Header.Get("Authorization") != conf.Authorization {
+		hh.respStatus(http.StatusUnauthorized, "")
+		return
+	}
+
+	if err := Reload(); err != nil {
+		hh.respStatus(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	hh.respStatus(http.StatusNoContent, "")
+}
+
 func (hh *HTTPHandler) checkContentType() bool {
 	if !strings.HasPrefix(hh.req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
 		hh.respStatus(http.StatusUnsupportedMediaType, "")
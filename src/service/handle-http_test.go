@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"local/global"
+	"local/storage"
+
+	"github.com/miekg/dns"
+)
+
+// 测试健康检查在存储器可用、不可用及未启用时的响应
+func TestHealth(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Service.HTTP.HealthPath = "/health"
+	conf.Service.InternalSuffix = []string{"app.test."}
+	conf.Storage.Type = "memory"
+	conf.Storage.Timeout = 5
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+	if err := storage.MakeStorage(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := httptest.NewRecorder()
+	HTTPHandler{}.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"storage":"ok"}` {
+		t.Fatal("存储器可用时的响应错误", resp.Code, resp.Body.String())
+	}
+
+	storage.Close()
+	resp = httptest.NewRecorder()
+	HTTPHandler{}.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Fatal("存储器不可用时的响应错误", resp.Code, resp.Body.String())
+	}
+
+	// 只转发查询时不构建存储器
+	conf = new(global.Configuration)
+	conf.Service.HTTP.HealthPath = "/health"
+	conf.Service.Upstream.Addrs = []string{"udp://127.0.0.1:53"}
+	global.SetConfig(conf)
+	resp = httptest.NewRecorder()
+	HTTPHandler{}.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"storage":"disabled"}` {
+		t.Fatal("未启用存储器时的响应错误", resp.Code, resp.Body.String())
+	}
+}
+
+// 测试列出记录的认证、参数校验及分页
+func TestList(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Service.HTTP.ListPath = "/records"
+	conf.Service.HTTP.Authorization = "secret"
+	conf.Storage.Type = "memory"
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+	if err := storage.MakeStorage(); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	for _, str := range []string{"app.test. 300 IN A 10.0.0.1", "www.app.test. 300 IN A 10.0.0.2", "www.app.test. 300 IN TXT \"hello\""} {
+		rr, _ := dns.NewRR(str)
+		_ = storage.Storage().Set(t.Context(), rr)
+	}
+
+	request := func(target string, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", auth)
+		resp := httptest.NewRecorder()
+		HTTPHandler{}.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := request("/records", ""); resp.Code != http.StatusUnauthorized {
+		t.Fatal("未认证时的响应错误", resp.Code)
+	}
+	if resp := request("/records?type=UNKNOWN", "secret"); resp.Code != http.StatusBadRequest {
+		t.Fatal("无效的类型参数的响应错误", resp.Code)
+	}
+	resp := request("/records?suffix=app.test&type=a&offset=1&limit=1", "secret")
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"total":2,"records":[{"name":"www.app.test.","class":"IN","type":"A","ttl":300,"data":"10.0.0.2"}]}` {
+		t.Fatal("列出的记录错误", resp.Code, resp.Body.String())
+	}
+}
+
+// 测试HTTPS服务启用HTTP/3时，HTTP/2的响应通告Alt-Svc，DoH查询可经由h3://上游完成
+func TestHTTP3(t *testing.T) {
+	cert := selfSignedCert(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// HTTPS与HTTP/3监听同一端口号的TCP和UDP
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := packetConn.LocalAddr().(*net.UDPAddr).Port
+	_ = packetConn.Close()
+
+	setupInternal(t, fmt.Sprintf(`
+[service]
+ip = "127.0.0.1"
+internalSuffix = ["app.test."]
+
+[service.http]
+sslPort = %d
+http3 = true
+dnsQueryPath = "/dns-query"
+certFile = %q
+keyFile = %q
+`, port, certFile, keyFile), "www.app.test. 60 IN A 10.0.0.1")
+	t.Cleanup(resetConnPools)
+
+	https := newHTTPSListener(global.Config(), HTTPHandler{})
+	go func() {
+		_ = https.serve()
+	}()
+	defer func() {
+		_ = https.stop(context.Background())
+	}()
+
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion("www.app.test.", dns.TypeA)
+	reqBuf, _ := reqMsg.Pack()
+	reqURL := fmt.Sprintf("https://127.0.0.1:%d/dns-query?dns=%s", port, base64.RawURLEncoding.EncodeToString(reqBuf))
+
+	// HTTP/2的响应头中通告相同端口的HTTP/3服务
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: upstreamRootCAs},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+	var resp *http.Response
+	waitFor(t, func() bool {
+		resp, err = client.Get(reqURL)
+		return err == nil
+	})
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatal("HTTP/2的响应错误", resp.StatusCode, resp.Proto)
+	}
+	if altSvc := resp.Header.Get("Alt-Svc"); !strings.Contains(altSvc, fmt.Sprintf(`h3=":%d"`, port)) {
+		t.Fatal("未通告HTTP/3服务", altSvc)
+	}
+
+	// h3://上游只使用HTTP/3，GET及POST查询都能得到内部域名的记录
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		upstream := &Upstream{ReqMsg: reqMsg, MethodByDoT: method}
+		respMsg, err := upstream.queryAddr(fmt.Sprintf("h3://127.0.0.1:%d/dns-query", port))
+		if err != nil || len(respMsg.Answer) != 1 || respMsg.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Fatal("通过HTTP/3查询的结果错误", method, respMsg, err)
+		}
+	}
+}
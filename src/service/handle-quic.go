@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/rs/zerolog/log"
+)
+
+// DoQ的ALPN标识(RFC 9250)
+const doqALPN = "doq"
+
+// DoQ的错误码(RFC 9250)
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqProtocolError quic.StreamErrorCode      = 0x2
+)
+
+// DNS over QUIC服务
+type QUICServer struct {
+	Addr      string
+	TLSConfig *tls.Config
+	Handler   dns.Handler
+
+	mutex    sync.Mutex
+	listener *quic.Listener
+	conns    map[*quic.Conn]struct{}
+	closed   bool
+}
+
+// 监听并处理连接，服务关闭后返回nil
+func (server *QUICServer) ListenAndServe() (err error) {
+	tlsConfig := server.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{doqALPN}
+
+	server.mutex.Lock()
+	server.listener, err = quic.ListenAddr(server.Addr, tlsConfig, &quic.Config{})
+	if err != nil {
+		server.mutex.Unlock()
+		return
+	}
+	server.conns = make(map[*quic.Conn]struct{})
+	server.mutex.Unlock()
+
+	for {
+		conn, err := server.listener.Accept(context.Background())
+		if err != nil {
+			server.mutex.Lock()
+			closed := server.closed
+			server.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		server.mutex.Lock()
+		server.conns[conn] = struct{}{}
+		server.mutex.Unlock()
+		go server.serveConn(conn)
+	}
+}
+
+// 关闭监听和所有连接
+func (server *QUICServer) Shutdown(_ context.Context) (err error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.closed = true
+	if server.listener != nil {
+		err = server.listener.Close()
+	}
+	for conn := range server.conns {
+		_ = conn.CloseWithError(doqNoError, "")
+	}
+	return
+}
+
+// 处理连接中的每个流，每个流承载一次查询
+func (server *QUICServer) serveConn(conn *quic.Conn) {
+	defer func() {
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		server.mutex.Unlock()
+	}()
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go server.serveStream(conn, stream)
+	}
+}
+
+// 处理单个查询流
+func (server *QUICServer) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	reqMsg, err := readDoQMsg(stream)
+	if err != nil {
+		log.Warn().Err(err).Caller().Str("remote", conn.RemoteAddr().String()).Msg("读取DoQ请求失败")
+		stream.CancelRead(doqProtocolError)
+		stream.CancelWrite(doqProtocolError)
+		return
+	}
+	// RFC 9250要求消息ID必须为0
+	if reqMsg.Id != 0 || len(reqMsg.Question) == 0 {
+		_ = conn.CloseWithError(quic.ApplicationErrorCode(doqProtocolError), "")
+		return
+	}
+	server.Handler.ServeDNS(&quicResponseWriter{conn: conn, stream: stream}, reqMsg)
+}
+
+// 读取带2字节长度前缀的DNS消息
+func readDoQMsg(reader io.Reader) (msg *dns.Msg, err error) {
+	var length uint16
+	if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return
+	}
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(reader, buf); err != nil {
+		return
+	}
+	msg = new(dns.Msg)
+	err = msg.Unpack(buf)
+	return
+}
+
+// 写入带2字节长度前缀的DNS消息
+func writeDoQMsg(writer io.Writer, data []byte) (err error) {
+	if len(data) > dns.MaxMsgSize {
+		return errors.New("DNS消息过长")
+	}
+	buf := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	_, err = writer.Write(append(buf, data...))
+	return
+}
+
+// QUIC连接的地址，网络类型为quic，用于与UDP区分
+type quicAddr struct {
+	net.Addr
+}
+
+func (quicAddr) Network() string {
+	return "quic"
+}
+
+// 实现dns.ResponseWriter，将响应写入QUIC流
+type quicResponseWriter struct {
+	conn   *quic.Conn
+	stream *quic.Stream
+}
+
+func (writer *quicResponseWriter) LocalAddr() net.Addr {
+	return quicAddr{writer.conn.LocalAddr()}
+}
+
+func (writer *quicResponseWriter) RemoteAddr() net.Addr {
+	return quicAddr{writer.conn.RemoteAddr()}
+}
+
+func (writer *quicResponseWriter) WriteMsg(msg *dns.Msg) error {
+	// RFC 9250要求消息ID必须为0
+	msg.Id = 0
+	data, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	return writeDoQMsg(writer.stream, data)
+}
+
+func (writer *quicResponseWriter) Write(data []byte) (int, error) {
+	if err := writeDoQMsg(writer.stream, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// 关闭流的发送方向
+func (writer *quicResponseWriter) Close() error {
+	return writer.stream.Close()
+}
+
+func (writer *quicResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (writer *quicResponseWriter) TsigTimersOnly(bool) {}
+
+func (writer *quicResponseWriter) Hijack() {}
@@ -0,0 +1,308 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+// 监听服务
+type listener struct {
+	name  string                          // 服务名称
+	addr  string                          // 监听地址
+	key   string                          // 监听地址及证书等参数，变化时需要重启服务
+	serve func() error                    // 启动服务，阻塞至服务关闭
+	stop  func(ctx context.Context) error // 关闭服务
+}
+
+// 正在运行的监听服务
+var listeners struct {
+	sync.Mutex
+	running map[string]*listener
+}
+
+// 是否有依赖HTTP的功能已启用
+func httpEnabled(conf *global.Configuration) bool {
+	return conf.Service.HTTP.DNSQueryPath != "" ||
+		conf.Service.HTTP.JSONQueryPath != "" ||
+		conf.Service.HTTP.RegisterPath != "" ||
+		conf.Service.HTTP.UpstreamPath != "" ||
+		conf.Service.HTTP.MetricsPath != "" ||
+		conf.Service.HTTP.ReloadPath != "" ||
+		conf.Service.HTTP.HealthPath != "" ||
+		conf.Service.HTTP.ListPath != ""
+}
+
+// 证书参数，证书文件的路径或内容变化时需要重启服务
+func certKey(certFile, keyFile string) string {
+	return certFile + "|" + global.FileVersion(certFile) + "|" + keyFile + "|" + global.FileVersion(keyFile)
+}
+
+// 根据配置构建所有需要启用的监听服务，证书加载失败时返回错误
+func buildListeners(conf *global.Configuration) (result []*listener, err error) {
+	var (
+		cert        tls.Certificate
+		httpHandler = new(HTTPHandler)
+	)
+
+	if conf.Service.UDP.Port < 1 {
+		log.Warn().Msg("已禁用 DNS over UDP，因 service.udp.port 参数未配置")
+	} else {
+		server := &dns.Server{
+			Addr:    conf.Service.IP + ":" + strconv.FormatUint(uint64(conf.Service.UDP.Port), 10),
+			Net:     "udp",
+			Handler: GeneralHandler{Protocol: "udp"},
+		}
+		result = append(result, &listener{
+			name:  "DNS over UDP",
+			addr:  server.Addr,
+			key:   server.Addr,
+			serve: server.ListenAndServe,
+			stop:  server.ShutdownContext,
+		})
+	}
+
+	if conf.Service.TCP.Port < 1 {
+		log.Warn().Msg("已禁用 DNS over TCP，因 service.tcp.port 参数未配置")
+	} else {
+		server := &dns.Server{
+			Addr:    conf.Service.IP + ":" + strconv.FormatUint(uint64(conf.Service.TCP.Port), 10),
+			Net:     "tcp",
+			Handler: GeneralHandler{Protocol: "tcp"},
+		}
+		result = append(result, &listener{
+			name:  "DNS over TCP",
+			addr:  server.Addr,
+			key:   server.Addr,
+			serve: server.ListenAndServe,
+			stop:  server.ShutdownContext,
+		})
+	}
+
+	if conf.Service.TLS.Port > 0 || conf.Service.QUIC.Port > 0 {
+		cert, err = tls.LoadX509KeyPair(conf.Service.TLS.CertFile, conf.Service.TLS.KeyFile)
+		if err != nil {
+			log.Err(err).Caller().Str("cert", conf.Service.TLS.CertFile).Str("key", conf.Service.TLS.KeyFile).Msg("加载TLS的证书或密钥文件失败")
+			return nil, err
+		}
+	}
+
+	if conf.Service.TLS.Port < 1 {
+		log.Warn().Msg("已禁用 DNS over TLS，因 service.tls.port 参数未配置")
+	} else {
+		server := &dns.Server{
+			Addr:      conf.Service.IP + ":" + strconv.FormatUint(uint64(conf.Service.TLS.Port), 10),
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13},
+			Handler:   GeneralHandler{Protocol: "tls"},
+		}
+		result = append(result, &listener{
+			name:  "DNS over TLS",
+			addr:  server.Addr,
+			key:   server.Addr + "|" + certKey(conf.Service.TLS.CertFile, conf.Service.TLS.KeyFile),
+			serve: server.ListenAndServe,
+			stop:  server.ShutdownContext,
+		})
+	}
+
+	if conf.Service.QUIC.Port < 1 {
+		log.Warn().Msg("已禁用 DNS over QUIC，因 service.quic.port 参数未配置")
+	} else {
+		server := &QUICServer{
+			Addr:      conf.Service.IP + ":" + strconv.FormatUint(uint64(conf.Service.QUIC.Port), 10),
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13},
+			Handler:   GeneralHandler{Protocol: "quic"},
+		}
+		result = append(result, &listener{
+			name:  "DNS over QUIC",
+			addr:  server.Addr,
+			key:   server.Addr + "|" + certKey(conf.Service.TLS.CertFile, conf.Service.TLS.KeyFile),
+			serve: server.ListenAndServe,
+			stop:  server.Shutdown,
+		})
+	}
+
+	switch {
+	case conf.Service.HTTP.Port < 1:
+		log.Warn().Msg("已禁用 HTTP，因 service.http.port 参数未配置")
+	case !httpEnabled(conf):
+		log.Warn().Msg("已禁用 HTTP，因依赖 HTTP 的功能全部未启用")
+	default:
+		server := &http.Server{
+			ReadHeaderTimeout: 10 * time.Second,
+			Addr:              conf.Service.IP + ":" + strconv.FormatUint(uint64(conf.Service.HTTP.Port), 10),
+			Handler:           httpHandler,
+		}
+		result = append(result, &listener{
+			name: "HTTP",
+			addr: server.Addr,
+			key:  server.Addr,
+			serve: func() error {
+				if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+					return err
+				}
+				return nil
+			},
+			stop: server.Shutdown,
+		})
+	}
+
+	switch {
+	case conf.Service.HTTP.SSLPort < 1:
+		log.Warn().Msg("已禁用 HTTPS，因 service.http.sslPort 参数未配置")
+	case !httpEnabled(conf):
+		log.Warn().Msg("已禁用 HTTPS，因依赖 HTTPS 的功能全部未启用")
+	default:
+		if _, err = tls.LoadX509KeyPair(conf.Service.HTTP.CertFile, conf.Service.HTTP.KeyFile); err != nil {
+			log.Err(err).Caller().Str("cert", conf.Service.HTTP.CertFile).Str("key", conf.Service.HTTP.KeyFile).Msg("加载HTTPS的证书或密钥文件失败")
+			return nil, err
+		}
+		result = append(result, newHTTPSListener(conf, httpHandler))
+	}
+
+	return result, nil
+}
+
+// 构建HTTPS监听服务，启用HTTP/3时同时监听相同端口的UDP
+func newHTTPSListener(conf *global.Configuration, handler http.Handler) *listener {
+	var (
+		certFile     = conf.Service.HTTP.CertFile
+		keyFile      = conf.Service.HTTP.KeyFile
+		http3Service *http3.Server
+	)
+	httpsService := &http.Server{
+		ReadHeaderTimeout: 10 * time.Second,
+		Addr:              conf.Service.IP + ":" + strconv.FormatUint(uint64(conf.Service.HTTP.SSLPort), 10),
+		Handler:           handler,
+	}
+	key := httpsService.Addr + "|" + certKey(certFile, keyFile)
+	if conf.Service.HTTP.HTTP3 {
+		http3Service = &http3.Server{
+			Addr:    httpsService.Addr,
+			Handler: handler,
+		}
+		httpsService.Handler = altSvcHandler{handler: handler, server: http3Service}
+		key += "|h3"
+	}
+
+	return &listener{
+		name: "HTTPS",
+		addr: httpsService.Addr,
+		key:  key,
+		serve: func() error {
+			if http3Service != nil {
+				go func() {
+					log.Info().Str("Addr", http3Service.Addr).Msg("启用 HTTP/3")
+					if err := http3Service.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+						log.Err(err).Caller().Msg("启用 HTTP/3 失败")
+					}
+				}()
+			}
+			if err := httpsService.ListenAndServeTLS(certFile, keyFile); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+		stop: func(ctx context.Context) error {
+			err := httpsService.Shutdown(ctx)
+			if http3Service != nil {
+				if h3Err := http3Service.Shutdown(ctx); err == nil {
+					err = h3Err
+				}
+			}
+			return err
+		},
+	}
+}
+
+// 启用新的监听服务，并关闭已停用或参数已变化的监听服务
+// 启动时监听失败会退出程序，重载时只记录日志
+func applyListeners(desired []*listener, startup bool) {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	if listeners.running == nil {
+		listeners.running = make(map[string]*listener)
+	}
+	wanted := make(map[string]*listener, len(desired))
+	for _, item := range desired {
+		wanted[item.name] = item
+	}
+
+	var stopping []*listener
+	for name, item := range listeners.running {
+		if newItem, exist := wanted[name]; exist && newItem.key == item.key {
+			continue
+		}
+		stopping = append(stopping, item)
+		delete(listeners.running, name)
+	}
+	if len(stopping) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(global.Config().Service.QuitWaitTimeout)*time.Second)
+		stopListeners(ctx, stopping)
+		cancel()
+	}
+
+	for _, item := range desired {
+		if _, exist := listeners.running[item.name]; exist {
+			continue
+		}
+		listeners.running[item.name] = item
+		go runListener(item, startup)
+	}
+}
+
+// 运行监听服务
+func runListener(item *listener, startup bool) {
+	log.Info().Str("Addr", item.addr).Msg("启用 " + item.name)
+	err := item.serve()
+	if err == nil {
+		return
+	}
+	if startup {
+		log.Fatal().Err(err).Caller().Msg("启用 " + item.name + " 失败")
+		return
+	}
+	log.Err(err).Caller().Msg("启用 " + item.name + " 失败")
+
+	// 移出运行列表，以便下次重载时重试
+	listeners.Lock()
+	if listeners.running[item.name] == item {
+		delete(listeners.running, item.name)
+	}
+	listeners.Unlock()
+}
+
+// 关闭监听服务
+func stopListeners(ctx context.Context, items []*listener) {
+	for _, item := range items {
+		if err := item.stop(ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			log.Err(err).Caller().Msg(item.name + "服务关闭时出现异常")
+			continue
+		}
+		log.Info().Str("Addr", item.addr).Msg("已关闭 " + item.name)
+	}
+}
+
+// 关闭所有正在运行的监听服务
+func stopAllListeners(ctx context.Context) {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	items := make([]*listener, 0, len(listeners.running))
+	for name, item := range listeners.running {
+		items = append(items, item)
+		delete(listeners.running, name)
+	}
+	stopListeners(ctx, items)
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"local/global"
+
+	"github.com/quic-go/quic-go"
+)
+
+// 获取上游服务使用的代理地址，返回空字符串表示直连
+func upstreamProxy(addr string) string {
+	if proxy, exist := global.Config().Service.Upstream.Proxies[addr]; exist {
+		if proxy == "direct" {
+			return ""
+		}
+		return proxy
+	}
+	return global.Config().Service.Upstream.Proxy
+}
+
+// 建立到上游服务的连接，netType支持tcp和udp，proxy为空时直连
+func dialUpstream(ctx context.Context, netType string, addr string, proxy string) (net.Conn, error) {
+	if proxy == "" {
+		return (&net.Dialer{}).DialContext(ctx, netType, addr)
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		client := &socks5Client{
+			addr:     proxyURL.Host,
+			username: proxyURL.User.Username(),
+		}
+		client.password, _ = proxyURL.User.Password()
+		if netType == "udp" {
+			return client.DialUDP(ctx, addr)
+		}
+		return client.Dial(ctx, addr)
+	case "http", "https":
+		if netType == "udp" {
+			return nil, errors.New("HTTP代理不支持转发UDP查询")
+		}
+		return dialHTTPProxy(ctx, proxyURL, addr)
+	default:
+		return nil, errors.New("不支持的代理协议 " + proxyURL.Scheme)
+	}
+}
+
+// 建立到上游的QUIC连接，只有SOCKS5代理支持转发QUIC
+// 返回的closer用于关闭连接及其占用的资源
+func dialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, quicConfig *quic.Config, proxy string) (conn *quic.Conn, closer func(), err error) {
+	if proxy == "" {
+		conn, err = quic.DialAddr(ctx, addr, tlsConfig, quicConfig)
+		if err != nil {
+			return
+		}
+		closer = func() {
+			_ = conn.CloseWithError(doqNoError, "")
+		}
+		return
+	}
+
+	relayConn, err := dialUpstream(ctx, "udp", addr, proxy)
+	if err != nil {
+		return
+	}
+	packetConn, ok := relayConn.(net.PacketConn)
+	if !ok {
+		_ = relayConn.Close()
+		return nil, nil, errors.New("代理不支持转发QUIC查询")
+	}
+	transport := &quic.Transport{Conn: packetConn}
+	conn, err = transport.Dial(ctx, relayConn.RemoteAddr(), tlsConfig, quicConfig)
+	if err != nil {
+		_ = transport.Close()
+		_ = relayConn.Close()
+		return
+	}
+	closer = func() {
+		_ = conn.CloseWithError(doqNoError, "")
+		_ = transport.Close()
+		_ = relayConn.Close()
+	}
+	return
+}
+
+// 通过HTTP代理的CONNECT方法建立隧道
+func dialHTTPProxy(ctx context.Context, proxyURL *url.URL, addr string) (conn net.Conn, err error) {
+	var resp *http.Response
+
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+
+	conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username()+":"+password)))
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.New("HTTP代理拒绝连接：" + resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"local/global"
+)
+
+// 启动进程内的HTTP代理，认证通过时建立隧道并回显收到的数据
+func startHTTPProxy(t *testing.T, username string, password string) (addr string, targets chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	targets = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				targets <- req.Host
+				auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+				if req.Header.Get("Proxy-Authorization") != auth {
+					_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				_, _ = io.Copy(conn, reader)
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+// 测试通过HTTP代理的CONNECT方法建立隧道及认证失败
+func TestDialHTTPProxy(t *testing.T) {
+	addr, targets := startHTTPProxy(t, "user", "secret")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, err := dialUpstream(ctx, "tcp", "10.0.0.1:53", "http://user:secret@"+addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-targets; target != "10.0.0.1:53" {
+		t.Fatal("代理收到的目标地址错误", target)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatal("通过隧道收发数据错误", string(buf), err)
+	}
+
+	if conn, err = dialUpstream(ctx, "tcp", "10.0.0.1:53", "http://user:wrong@"+addr); err == nil {
+		_ = conn.Close()
+		t.Fatal("认证失败时建立了隧道")
+	}
+	if _, err = dialUpstream(ctx, "udp", "10.0.0.1:53", "http://"+addr); err == nil {
+		t.Fatal("HTTP代理转发UDP查询未返回错误")
+	}
+	if _, err = dialUpstream(ctx, "tcp", "10.0.0.1:53", "ftp://"+addr); err == nil {
+		t.Fatal("不支持的代理协议未返回错误")
+	}
+}
+
+// 测试按上游服务地址选择代理
+func TestUpstreamProxy(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Service.Upstream.Proxy = "socks5://127.0.0.1:1080"
+	conf.Service.Upstream.Proxies = map[string]string{
+		"udp://10.0.0.1:53": "http://127.0.0.1:8080",
+		"udp://10.0.0.2:53": "direct",
+	}
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	for addr, want := range map[string]string{
+		"udp://10.0.0.1:53": "http://127.0.0.1:8080",
+		"udp://10.0.0.2:53": "",
+		"udp://10.0.0.3:53": "socks5://127.0.0.1:1080",
+	} {
+		if proxy := upstreamProxy(addr); proxy != want {
+			t.Fatal("选择的代理错误", addr, proxy)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"time"
+
+	"local/metrics"
+	"local/querylog"
+
+	"github.com/miekg/dns"
+)
+
+// 记录一次下游查询的监控指标和查询日志，没有响应消息时按SERVFAIL统计
+// upstream为nil表示由内部存储器解析
+func recordQuery(protocol string, client string, reqMsg *dns.Msg, respMsg *dns.Msg, upstream *Upstream, begin time.Time) {
+	if len(reqMsg.Question) == 0 {
+		return
+	}
+	elapsed := time.Since(begin)
+	rcode := dns.RcodeServerFailure
+	if respMsg != nil {
+		rcode = respMsg.Rcode
+	}
+	metrics.ObserveQuery(protocol, reqMsg.Question[0].Qtype, rcode, elapsed)
+
+	if !querylog.Enabled() {
+		return
+	}
+	entry := &querylog.Entry{
+		Time:     begin,
+		Client:   client,
+		Protocol: protocol,
+		Name:     reqMsg.Question[0].Name,
+		Type:     dns.Type(reqMsg.Question[0].Qtype).String(),
+		Class:    dns.Class(reqMsg.Question[0].Qclass).String(),
+		Rcode:    dns.RcodeToString[rcode],
+		Source:   metrics.SourceInternal,
+		Latency:  float64(elapsed.Microseconds()) / 1000,
+		ReqMsg:   reqMsg,
+		RespMsg:  respMsg,
+	}
+	if respMsg != nil {
+		entry.Answers = len(respMsg.Answer)
+	}
+	if upstream != nil {
+		entry.Upstream = upstream.Addr
+		entry.Source = metrics.SourceUpstream
+		if upstream.Cached {
+			entry.Source = metrics.SourceCache
+		}
+	}
+	querylog.Record(entry)
+}
@@ -1,27 +1,253 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"local/global"
+	"local/metrics"
 	"local/storage"
 
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 )
 
-// 查询存储器
-func queryStorage(reqMsg *dns.Msg) (respMsg *dns.Msg, err error) {
-	var rr []dns.RR
+// 查询存储器，整个查询(包括追踪CNAME链)的超时时间为存储器配置的timeout
+func queryStorage(ctx context.Context, reqMsg *dns.Msg) (respMsg *dns.Msg, err error) {
+	var (
+		rr    []dns.RR
+		exist bool
+	)
+	ctx, cancel := storageContext(ctx)
+	defer cancel()
+
+	question := reqMsg.Question[0]
 	respMsg = new(dns.Msg)
 	respMsg.SetReply(reqMsg)
+	metrics.ObserveResolve(metrics.SourceInternal)
+
+	z := findZone(question.Name)
+	respMsg.Authoritative = z != nil
+	apex := z != nil && strings.EqualFold(question.Name, z.apex)
+
 	// 从存储器获取记录
-	rr, err = storage.Storage.Get(reqMsg.Question[0])
+	rr, exist, err = lookupStorage(ctx, question, z)
 	if err != nil {
 		log.Err(err).Caller().Msg("查询内部存储器")
 		return
 	}
-	if rr == nil {
-		respMsg.Rcode = dns.RcodeNameError
+
+	// 存储器中没有区域顶点的SOA和NS记录时使用自动生成的记录
+	if len(rr) == 0 && apex && question.Qclass == dns.ClassINET {
+		switch question.Qtype {
+		case dns.TypeSOA:
+			rr = []dns.RR{z.SOA()}
+		case dns.TypeNS:
+			rr = z.NS()
+		}
+	}
+
+	// 没有该类型的记录时查找域名的CNAME记录，并追踪CNAME指向的目标
+	if len(rr) == 0 && exist && question.Qtype != dns.TypeCNAME {
+		cname := question
+		cname.Qtype = dns.TypeCNAME
+		rr, _, err = lookupStorage(ctx, cname, z)
+		if err != nil {
+			log.Err(err).Caller().Msg("查询内部存储器")
+			return
+		}
+		if len(rr) > 0 {
+			if apex && z.flatten {
+				err = flattenCNAME(ctx, reqMsg, respMsg, rr[0])
+			} else {
+				err = chaseCNAME(ctx, reqMsg, respMsg, rr[0])
+			}
+			return
+		}
+	}
+
+	if len(rr) == 0 {
+		// 域名存在但没有该类型的记录时返回NODATA(NOERROR且没有应答)，否则返回NXDOMAIN
+		if !exist && !apex {
+			respMsg.Rcode = dns.RcodeNameError
+		}
+		// 否定应答在权威节点中附带SOA记录，以便客户端缓存(RFC 2308)
+		if z != nil {
+			respMsg.Ns = []dns.RR{z.negativeSOA(ctx)}
+		}
 		return
 	}
 	respMsg.Answer = rr
 	return
 }
+
+// 为存储器的操作设置超时时间，未配置时只受parent控制
+func storageContext(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := global.Config().Storage.Timeout
+	if timeout == 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(timeout)*time.Second)
+}
+
+// 从存储器查找记录，exist表示域名是否存在(包括由通配符匹配的域名)
+// 域名不存在时，按RFC 4592使用最近祖先(closest encloser)下的通配符记录，并将记录的所有者替换为查询的域名
+func lookupStorage(ctx context.Context, question dns.Question, z *zone) (rr []dns.RR, exist bool, err error) {
+	rr, err = storage.Storage().Get(ctx, question)
+	if err != nil || len(rr) > 0 {
+		return rr, len(rr) > 0, err
+	}
+	exist, err = storage.Storage().Exists(ctx, question.Name, question.Qclass)
+	if err != nil || exist || z == nil {
+		return nil, exist, err
+	}
+
+	// 从父域名开始向上查找最近的存在的祖先，最多到区域的顶点
+	encloser := question.Name
+	for {
+		off, end := dns.NextLabel(encloser, 0)
+		if end || !dns.IsSubDomain(z.apex, encloser[off:]) {
+			return nil, false, nil
+		}
+		encloser = encloser[off:]
+		if strings.EqualFold(encloser, z.apex) {
+			break
+		}
+		if exist, err = storage.Storage().Exists(ctx, encloser, question.Qclass); err != nil {
+			return nil, false, err
+		}
+		if exist {
+			break
+		}
+	}
+
+	wildcard := question
+	wildcard.Name = "*." + encloser
+	rr, err = storage.Storage().Get(ctx, wildcard)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rr) == 0 {
+		// 通配符存在但没有该类型的记录时返回NODATA
+		exist, err = storage.Storage().Exists(ctx, wildcard.Name, question.Qclass)
+		return nil, exist, err
+	}
+	for k := range rr {
+		rr[k] = dns.Copy(rr[k])
+		rr[k].Header().Name = question.Name
+	}
+	return rr, true, nil
+}
+
+// CNAME链的最大长度，超过时停止追踪
+const maxCNAMEChain = 8
+
+// 将CNAME记录加入应答，并沿CNAME链查找目标域名的记录
+// 目标是内部域名时从存储器查找，否则转发给上游服务，响应码和授权节以链中最后一个域名为准(RFC 6604)
+func chaseCNAME(ctx context.Context, reqMsg *dns.Msg, respMsg *dns.Msg, cname dns.RR) error {
+	question := reqMsg.Question[0]
+	visited := map[string]struct{}{strings.ToLower(question.Name): {}}
+	for {
+		respMsg.Answer = append(respMsg.Answer, cname)
+		record, ok := cname.(*dns.CNAME)
+		if !ok {
+			return errors.New("无效的CNAME记录 " + cname.String())
+		}
+		target := dns.Fqdn(record.Target)
+		if _, exist := visited[strings.ToLower(target)]; exist || len(visited) > maxCNAMEChain {
+			log.Warn().Str("name", question.Name).Str("target", target).Msg("CNAME链存在循环或过长，停止追踪")
+			return nil
+		}
+		visited[strings.ToLower(target)] = struct{}{}
+
+		if !global.IsInternal(target) {
+			return chaseUpstream(reqMsg, respMsg, target)
+		}
+
+		z := findZone(target)
+		next := dns.Question{Name: target, Qtype: question.Qtype, Qclass: question.Qclass}
+		rr, exist, err := lookupStorage(ctx, next, z)
+		if err != nil {
+			return err
+		}
+		if len(rr) > 0 {
+			respMsg.Answer = append(respMsg.Answer, rr...)
+			return nil
+		}
+		if !exist && (z == nil || !strings.EqualFold(target, z.apex)) {
+			respMsg.Rcode = dns.RcodeNameError
+		}
+		if exist {
+			next.Qtype = dns.TypeCNAME
+			if rr, _, err = lookupStorage(ctx, next, z); err != nil {
+				return err
+			}
+			if len(rr) > 0 {
+				cname = rr[0]
+				continue
+			}
+		}
+		if z != nil {
+			respMsg.Ns = []dns.RR{z.negativeSOA(ctx)}
+		}
+		return nil
+	}
+}
+
+// 向上游服务查询CNAME指向的外部域名，未配置该域名的上游服务时只返回CNAME记录
+func chaseUpstream(reqMsg *dns.Msg, respMsg *dns.Msg, target string) error {
+	if len(upstreamAddrs(target)) == 0 {
+		return nil
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(target, reqMsg.Question[0].Qtype)
+	msg.Question[0].Qclass = reqMsg.Question[0].Qclass
+	if opt := reqMsg.IsEdns0(); opt != nil {
+		msg.SetEdns0(ednsUDPSize, opt.Do())
+	}
+	upstream := Upstream{ReqMsg: msg}
+	upstreamMsg, err := upstream.Query()
+	if err != nil {
+		return err
+	}
+	respMsg.Answer = append(respMsg.Answer, upstreamMsg.Answer...)
+	respMsg.Ns = upstreamMsg.Ns
+	respMsg.Rcode = upstreamMsg.Rcode
+	return nil
+}
+
+// 将区域顶点的CNAME记录展开(ALIAS)，以顶点域名作为所有者返回目标的记录，不返回CNAME记录
+// 记录的TTL取CNAME链中的最小值
+func flattenCNAME(ctx context.Context, reqMsg *dns.Msg, respMsg *dns.Msg, cname dns.RR) error {
+	question := reqMsg.Question[0]
+	chased := new(dns.Msg)
+	chased.SetReply(reqMsg)
+	if err := chaseCNAME(ctx, reqMsg, chased, cname); err != nil {
+		return err
+	}
+
+	ttl := cname.Header().Ttl
+	var rr []dns.RR
+	for _, item := range chased.Answer {
+		ttl = min(ttl, item.Header().Ttl)
+		if item.Header().Rrtype == question.Qtype {
+			rr = append(rr, dns.Copy(item))
+		}
+	}
+	for k := range rr {
+		rr[k].Header().Name = question.Name
+		rr[k].Header().Ttl = ttl
+	}
+
+	// 顶点域名总是存在，目标没有记录时返回NODATA
+	if len(rr) == 0 {
+		if z := findZone(question.Name); z != nil {
+			respMsg.Ns = []dns.RR{z.negativeSOA(ctx)}
+		}
+		return nil
+	}
+	respMsg.Answer = rr
+	return nil
+}
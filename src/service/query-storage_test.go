@@ -0,0 +1,265 @@
+package service
+
+import (
+	"testing"
+
+	"local/global"
+	"local/storage"
+
+	"github.com/miekg/dns"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// 按toml配置构建内存存储器及区域，并写入记录
+func setupInternal(t *testing.T, config string, records ...string) {
+	conf := new(global.Configuration)
+	if err := toml.Unmarshal([]byte(config), conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.Storage.Type = "memory"
+	global.SetConfig(conf)
+	t.Cleanup(func() {
+		global.SetConfig(nil)
+	})
+	if err := storage.MakeStorage(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(storage.Close)
+	setupZones()
+
+	for _, str := range records {
+		rr, err := dns.NewRR(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = storage.Storage().Set(t.Context(), rr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 查询内部域名
+func queryInternal(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion(name, qtype)
+	respMsg, err := queryStorage(t.Context(), reqMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return respMsg
+}
+
+// 测试区分域名不存在(NXDOMAIN)与域名存在但没有该类型的记录(NODATA)
+func TestNegativeAnswer(t *testing.T) {
+	setupInternal(t, `
+[service]
+internalSuffix = ["app.test."]
+`,
+		"www.app.test. 300 IN A 10.0.0.1",
+		"a.ent.app.test. 300 IN A 10.0.0.2",
+	)
+
+	for _, item := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{name: "www.app.test.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess},
+		{name: "WWW.app.test.", qtype: dns.TypeTXT, rcode: dns.RcodeSuccess},
+		{name: "ent.app.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess}, // 空非终端节点(RFC 8020)
+		{name: "app.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess},     // 区域顶点总是存在
+		{name: "none.app.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "x.www.app.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+	} {
+		respMsg := queryInternal(t, item.name, item.qtype)
+		if respMsg.Rcode != item.rcode || len(respMsg.Answer) != 0 {
+			t.Fatal("否定应答的响应码错误", item.name, respMsg.Rcode)
+		}
+		if len(respMsg.Ns) != 1 || respMsg.Ns[0].Header().Rrtype != dns.TypeSOA || !respMsg.Authoritative {
+			t.Fatal("否定应答未附带SOA记录", item.name, respMsg.Ns)
+		}
+	}
+}
+
+// 测试存储器中有区域顶点的SOA记录时，否定应答使用该记录，TTL取SOA的TTL与MINIMUM中较小的值
+func TestNegativeAnswerStoredSOA(t *testing.T) {
+	setupInternal(t, `
+[service]
+internalSuffix = ["app.test.", "other.test."]
+`,
+		"app.test. 3600 IN SOA ns.app.test. admin.app.test. 42 3600 600 604800 120",
+		"www.app.test. 300 IN A 10.0.0.1",
+	)
+
+	for _, name := range []string{"none.app.test.", "www.app.test."} {
+		respMsg := queryInternal(t, name, dns.TypeAAAA)
+		if len(respMsg.Ns) != 1 {
+			t.Fatal("否定应答未附带SOA记录", name)
+		}
+		soa := respMsg.Ns[0].(*dns.SOA)
+		if soa.Serial != 42 || soa.Ns != "ns.app.test." || soa.Hdr.Ttl != 120 {
+			t.Fatal("否定应答未使用存储器中的SOA记录", soa)
+		}
+	}
+	if respMsg := queryInternal(t, "app.test.", dns.TypeSOA); respMsg.Answer[0].Header().Ttl != 3600 {
+		t.Fatal("修改了存储器中的SOA记录", respMsg.Answer)
+	}
+
+	// 存储器中没有SOA记录的区域使用自动生成的记录
+	respMsg := queryInternal(t, "none.other.test.", dns.TypeA)
+	if len(respMsg.Ns) != 1 || respMsg.Ns[0].(*dns.SOA).Mbox != "hostmaster.other.test." {
+		t.Fatal("否定应答的SOA记录错误", respMsg.Ns)
+	}
+}
+
+// 测试通配符记录按最近祖先(closest encloser)匹配，并将所有者替换为查询的域名(RFC 4592)
+func TestWildcard(t *testing.T) {
+	setupInternal(t, `
+[service]
+internalSuffix = ["app.test."]
+`,
+		"*.pr.app.test. 300 IN A 10.0.0.2",
+		"b.pr.app.test. 300 IN TXT \"explicit\"",
+	)
+
+	for _, item := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer int
+	}{
+		{name: "a.pr.app.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: 1},
+		{name: "x.a.pr.app.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, answer: 1}, // 多级标签也由通配符匹配
+		{name: "a.pr.app.test.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess},           // 通配符没有该类型的记录
+		{name: "b.pr.app.test.", qtype: dns.TypeA, rcode: dns.RcodeSuccess},              // 已存在的域名不使用通配符
+		{name: "x.b.pr.app.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError},          // 最近祖先下没有通配符
+		{name: "a.other.app.test.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+	} {
+		respMsg := queryInternal(t, item.name, item.qtype)
+		if respMsg.Rcode != item.rcode || len(respMsg.Answer) != item.answer {
+			t.Fatal("通配符的应答错误", item.name, respMsg)
+		}
+		if item.answer > 0 && respMsg.Answer[0].Header().Name != item.name {
+			t.Fatal("通配符记录的所有者未替换为查询的域名", respMsg.Answer)
+		}
+		if item.answer == 0 && len(respMsg.Ns) != 1 {
+			t.Fatal("否定应答未附带SOA记录", item.name, respMsg.Ns)
+		}
+	}
+
+	// 直接查询通配符域名时返回原记录
+	if respMsg := queryInternal(t, "*.pr.app.test.", dns.TypeA); len(respMsg.Answer) != 1 || respMsg.Answer[0].Header().Name != "*.pr.app.test." {
+		t.Fatal("查询通配符域名的应答错误", respMsg.Answer)
+	}
+}
+
+// 测试CNAME链的追踪、循环检测及目标不存在时的响应码(RFC 6604)
+func TestCNAMEChase(t *testing.T) {
+	setupInternal(t, `
+[service]
+internalSuffix = ["app.test.", "other.test."]
+`,
+		"app.test. 300 IN A 10.0.0.1",
+		"www.app.test. 60 IN CNAME app.test.",
+		"cross.app.test. 60 IN CNAME www.other.test.",
+		"www.other.test. 60 IN CNAME app.test.",
+		"loop1.app.test. 300 IN CNAME loop2.app.test.",
+		"loop2.app.test. 300 IN CNAME loop1.app.test.",
+		"dangling.app.test. 300 IN CNAME missing.app.test.",
+		"nodata.app.test. 300 IN CNAME app.test.",
+	)
+
+	respMsg := queryInternal(t, "www.app.test.", dns.TypeA)
+	if len(respMsg.Answer) != 2 || respMsg.Answer[0].Header().Rrtype != dns.TypeCNAME || respMsg.Answer[1].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatal("CNAME追踪的应答错误", respMsg.Answer)
+	}
+	if respMsg = queryInternal(t, "www.app.test.", dns.TypeCNAME); len(respMsg.Answer) != 1 {
+		t.Fatal("查询CNAME记录时不应追踪", respMsg.Answer)
+	}
+	if respMsg = queryInternal(t, "cross.app.test.", dns.TypeA); len(respMsg.Answer) != 3 {
+		t.Fatal("跨区域的CNAME链的应答错误", respMsg.Answer)
+	}
+
+	if respMsg = queryInternal(t, "loop1.app.test.", dns.TypeA); respMsg.Rcode != dns.RcodeSuccess || len(respMsg.Answer) != 2 {
+		t.Fatal("循环的CNAME链的应答错误", respMsg.Answer)
+	}
+	if respMsg = queryInternal(t, "dangling.app.test.", dns.TypeA); respMsg.Rcode != dns.RcodeNameError || len(respMsg.Answer) != 1 || len(respMsg.Ns) != 1 {
+		t.Fatal("CNAME目标不存在时应返回NXDOMAIN", respMsg)
+	}
+	if respMsg = queryInternal(t, "nodata.app.test.", dns.TypeAAAA); respMsg.Rcode != dns.RcodeSuccess || len(respMsg.Answer) != 1 || len(respMsg.Ns) != 1 {
+		t.Fatal("CNAME目标没有该类型的记录时应返回NODATA", respMsg)
+	}
+}
+
+// 测试CNAME指向外部域名时转发给上游服务查询，响应码和授权节以上游的响应为准
+func TestCNAMEUpstream(t *testing.T) {
+	addr := startUDPServer(t, func(resp dns.ResponseWriter, reqMsg *dns.Msg) {
+		respMsg := new(dns.Msg)
+		respMsg.SetReply(reqMsg)
+		if reqMsg.Question[0].Name == "ext.example." {
+			rr, _ := dns.NewRR("ext.example. 60 IN A 192.0.2.1")
+			respMsg.Answer = append(respMsg.Answer, rr)
+		} else {
+			respMsg.Rcode = dns.RcodeNameError
+			rr, _ := dns.NewRR("example. 60 IN SOA ns.example. hostmaster.example. 1 3600 600 604800 60")
+			respMsg.Ns = append(respMsg.Ns, rr)
+		}
+		_ = resp.WriteMsg(respMsg)
+	})
+	setupInternal(t, `
+[service]
+internalSuffix = ["app.test."]
+[service.upstream]
+addrs = ["`+addr+`"]
+[[service.forward]]
+suffix = "none.test."
+`,
+		"ext.app.test. 300 IN CNAME ext.example.",
+		"gone.app.test. 300 IN CNAME gone.example.",
+		"unrouted.app.test. 300 IN CNAME www.none.test.",
+	)
+
+	respMsg := queryInternal(t, "ext.app.test.", dns.TypeA)
+	if len(respMsg.Answer) != 2 || respMsg.Answer[1].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatal("外部目标的应答错误", respMsg.Answer)
+	}
+	respMsg = queryInternal(t, "gone.app.test.", dns.TypeA)
+	if respMsg.Rcode != dns.RcodeNameError || len(respMsg.Answer) != 1 || len(respMsg.Ns) != 1 || respMsg.Ns[0].Header().Name != "example." {
+		t.Fatal("外部目标不存在时的应答错误", respMsg)
+	}
+	// 没有目标域名的上游服务时只返回CNAME记录
+	if respMsg = queryInternal(t, "unrouted.app.test.", dns.TypeA); respMsg.Rcode != dns.RcodeSuccess || len(respMsg.Answer) != 1 {
+		t.Fatal("没有上游服务时的应答错误", respMsg)
+	}
+}
+
+// 测试区域顶点的CNAME展开(ALIAS)，TTL取CNAME链中的最小值
+func TestCNAMEFlatten(t *testing.T) {
+	setupInternal(t, `
+[service]
+internalSuffix = ["app.test.", "flat.test."]
+[[service.zones]]
+suffix = "flat.test."
+flatten = true
+`,
+		"app.test. 300 IN A 10.0.0.1",
+		"www.app.test. 60 IN CNAME app.test.",
+		"flat.test. 120 IN CNAME www.app.test.",
+	)
+
+	respMsg := queryInternal(t, "flat.test.", dns.TypeA)
+	if len(respMsg.Answer) != 1 || respMsg.Answer[0].Header().Name != "flat.test." || respMsg.Answer[0].Header().Ttl != 60 {
+		t.Fatal("顶点CNAME展开的应答错误", respMsg.Answer)
+	}
+	if respMsg = queryInternal(t, "flat.test.", dns.TypeAAAA); respMsg.Rcode != dns.RcodeSuccess || len(respMsg.Answer) != 0 || len(respMsg.Ns) != 1 {
+		t.Fatal("展开后目标没有该类型的记录时应返回NODATA", respMsg)
+	}
+	if respMsg = queryInternal(t, "flat.test.", dns.TypeSOA); len(respMsg.Answer) != 1 {
+		t.Fatal("区域顶点未返回SOA记录", respMsg.Answer)
+	}
+	// 非顶点的CNAME不展开
+	if respMsg = queryInternal(t, "www.app.test.", dns.TypeA); len(respMsg.Answer) != 2 {
+		t.Fatal("非顶点的CNAME被展开", respMsg.Answer)
+	}
+}
@@ -7,14 +7,17 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"local/global"
+	"local/metrics"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/rs/zerolog/log"
 )
 
@@ -38,135 +41,321 @@ type JSONResult struct {
 	Extra     []RR   `json:"Extra,omitempty"`
 }
 
+// 上游服务没有返回响应消息
+var errNoResponse = errors.New("上游服务没有返回响应消息")
+
 type Upstream struct {
 	MethodByDoT string
 	ReqMsg      *dns.Msg
+	Addr        string // 实际响应查询的上游服务地址
+	Cached      bool   // 是否命中了上游响应缓存
 }
 
-// 遍历上游进行查询
+// 查询上游服务，启用缓存时优先从缓存中获取
 func (upstream *Upstream) Query() (respMsg *dns.Msg, err error) {
-	var abort bool
+	cache := upstreamCache.Load()
+	if cache != nil {
+		if respMsg = cache.Get(upstream.ReqMsg); respMsg != nil {
+			upstream.Cached = true
+			metrics.ObserveResolve(metrics.SourceCache)
+			return
+		}
+	}
+	metrics.ObserveResolve(metrics.SourceUpstream)
+
+	// 合并相同的进行中的查询
+	return coalesce(upstream.ReqMsg, func() (respMsg *dns.Msg, err error) {
+		respMsg, err = upstream.forward()
+		if err != nil {
+			return
+		}
+		if cache != nil {
+			cache.Set(upstream.ReqMsg, respMsg)
+		}
+		return
+	})
+}
+
+// 遍历上游进行查询
+func (upstream *Upstream) forward() (respMsg *dns.Msg, err error) {
+	addrs := upstreamAddrs(upstream.ReqMsg.Question[0].Name)
+	if len(addrs) == 0 {
+		err = errors.New("没有可用的上游服务 " + upstream.ReqMsg.Question[0].Name)
+		return
+	}
+
+	addrs = orderAddrs(healthyAddrs(addrs))
+	if global.Config().Service.Upstream.Strategy == StrategyParallel && len(addrs) > 1 {
+		return upstream.race(addrs)
+	}
 
 	// 遍历查询上游服务
-	for k := range global.Config.Service.Upstream.Addrs {
-		if abort {
-			break
+	for k := range addrs {
+		respMsg, err = upstream.exchange(addrs[k])
+		if err == nil {
+			return
 		}
-		switch {
-		case strings.HasPrefix(global.Config.Service.Upstream.Addrs[k], "udp://"):
-			upstreamAddr := strings.TrimPrefix(global.Config.Service.Upstream.Addrs[k], "udp://")
-			respMsg, err = upstream.QueryDNS("udp", upstreamAddr)
-			if err != nil {
-				log.Err(err).Caller().Str("addr", global.Config.Service.Upstream.Addrs[k]).Msg("向上游UDP服务查询失败")
-				break
-			}
-			abort = true
-		case strings.HasPrefix(global.Config.Service.Upstream.Addrs[k], "tcp://"):
-			upstreamAddr := strings.TrimPrefix(global.Config.Service.Upstream.Addrs[k], "tcp://")
-			respMsg, err = upstream.QueryDNS("tcp", upstreamAddr)
-			if err != nil {
-				log.Err(err).Caller().Str("addr", global.Config.Service.Upstream.Addrs[k]).Msg("向上游TCP服务查询失败")
-				break
-			}
-			abort = true
-		case strings.HasPrefix(global.Config.Service.Upstream.Addrs[k], "tls://"):
-			upstreamAddr := strings.TrimPrefix(global.Config.Service.Upstream.Addrs[k], "tls://")
-			respMsg, err = upstream.QueryDNS("tcp-tls", upstreamAddr)
-			if err != nil {
-				log.Err(err).Caller().Str("addr", global.Config.Service.Upstream.Addrs[k]).Msg("向上游DoT服务查询失败")
-				break
-			}
-			abort = true
-		case strings.HasPrefix(global.Config.Service.Upstream.Addrs[k], "https://"):
-			if upstream.MethodByDoT == http.MethodGet {
-				respMsg, err = upstream.QueryByGET(global.Config.Service.Upstream.Addrs[k], global.Config.Service.Upstream.HTTPProxy)
-			} else {
-				respMsg, err = upstream.QueryByPOST(global.Config.Service.Upstream.Addrs[k], global.Config.Service.Upstream.HTTPProxy)
-			}
-			if err != nil {
-				log.Err(err).Caller().Str("addr", global.Config.Service.Upstream.Addrs[k]).Msg("向上游DoH服务查询失败")
-				break
+	}
+	return
+}
+
+// 获取域名对应的上游服务地址，优先使用后缀匹配最长的转发规则，没有匹配的规则时使用默认的上游服务
+func upstreamAddrs(name string) []string {
+	var (
+		matched = -1
+		length  int
+		conf    = global.Config()
+	)
+	for k := range conf.Service.Forward {
+		suffix := conf.Service.Forward[k].Suffix
+		if len(suffix) <= length {
+			continue
+		}
+		if dns.IsSubDomain(strings.TrimPrefix(suffix, "."), name) {
+			matched = k
+			length = len(suffix)
+		}
+	}
+	if matched > -1 {
+		return conf.Service.Forward[matched].Addrs
+	}
+	return conf.Service.Upstream.Addrs
+}
+
+// 获取所有已配置的上游服务地址(已去重)
+func allUpstreamAddrs() (addrs []string) {
+	conf := global.Config()
+	exist := make(map[string]struct{})
+	appendAddrs := func(list []string) {
+		for k := range list {
+			if _, ok := exist[list[k]]; ok {
+				continue
 			}
-			abort = true
-		default:
-			err = errors.New("不支持的上游服务协议 " + global.Config.Service.Upstream.Addrs[k])
+			exist[list[k]] = struct{}{}
+			addrs = append(addrs, list[k])
 		}
 	}
+	appendAddrs(conf.Service.Upstream.Addrs)
+	for k := range conf.Service.Forward {
+		appendAddrs(conf.Service.Forward[k].Addrs)
+	}
+	return
+}
+
+// 向指定的上游服务查询
+func (upstream *Upstream) queryAddr(addr string) (respMsg *dns.Msg, err error) {
+	switch {
+	case strings.HasPrefix(addr, "udp://"):
+		respMsg, err = upstream.QueryDNS("udp", strings.TrimPrefix(addr, "udp://"), upstreamProxy(addr))
+		if err != nil {
+			log.Err(err).Caller().Str("addr", addr).Msg("向上游UDP服务查询失败")
+		}
+	case strings.HasPrefix(addr, "tcp://"):
+		respMsg, err = upstream.QueryDNS("tcp", strings.TrimPrefix(addr, "tcp://"), upstreamProxy(addr))
+		if err != nil {
+			log.Err(err).Caller().Str("addr", addr).Msg("向上游TCP服务查询失败")
+		}
+	case strings.HasPrefix(addr, "tls://"):
+		respMsg, err = upstream.QueryDNS("tcp-tls", strings.TrimPrefix(addr, "tls://"), upstreamProxy(addr))
+		if err != nil {
+			log.Err(err).Caller().Str("addr", addr).Msg("向上游DoT服务查询失败")
+		}
+	case strings.HasPrefix(addr, "quic://"):
+		respMsg, err = upstream.QueryQUIC(strings.TrimPrefix(addr, "quic://"), upstreamProxy(addr))
+		if err != nil {
+			log.Err(err).Caller().Str("addr", addr).Msg("向上游DoQ服务查询失败")
+		}
+	case strings.HasPrefix(addr, "https://"), strings.HasPrefix(addr, "h3://"):
+		if upstream.MethodByDoT == http.MethodGet {
+			respMsg, err = upstream.QueryByGET(addr, upstreamProxy(addr))
+		} else {
+			respMsg, err = upstream.QueryByPOST(addr, upstreamProxy(addr))
+		}
+		if err != nil {
+			log.Err(err).Caller().Str("addr", addr).Msg("向上游DoH服务查询失败")
+		}
+	default:
+		err = errors.New("不支持的上游服务协议 " + addr)
+	}
+	return
+}
+
+// 查询上游的DNS over UDP/TCP/TLS服务
+func (upstream *Upstream) QueryDNS(netType string, addr string, proxy string) (respMsg *dns.Msg, err error) {
+	var tlsConfig *tls.Config
+	if netType == "tcp-tls" {
+		tlsConfig = upstreamTLSConfig()
+	}
+
+	// 向上游发起请求，TCP/DoT优先使用连接池
+	if netType != "udp" && global.Config().Service.Upstream.PoolSize > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		respMsg, err = getConnPool(netType, addr, proxy).Exchange(ctx, upstream.ReqMsg)
+	} else {
+		respMsg, err = upstream.exchangeConn(netType, addr, tlsConfig, proxy)
+	}
+	if err != nil {
+		log.Err(err).Caller().Str("net", netType).Str("addr", addr).Msg("请求上游DNS服务失败")
+		return
+	}
+	return
+}
+
+// DNS over TLS
+func (upstream *Upstream) QueryTLS(addr string, tlsConfig *tls.Config) (respMsg *dns.Msg, err error) {
+	if tlsConfig == nil {
+		tlsConfig = upstreamTLSConfig()
+	}
+
+	// 向上游发起请求
+	respMsg, err = upstream.exchangeConn("tcp-tls", addr, tlsConfig, upstreamProxy("tls://"+addr))
+	if err != nil {
+		log.Err(err).Caller().Str("addr", addr).Msg("请求上游DoT服务失败")
+		return
+	}
 	return
 }
 
-// 查询上游的DNS over UDP/TCP服务
-func (upstream *Upstream) QueryDNS(netType string, addr string) (respMsg *dns.Msg, err error) {
+// 建立到上游的连接(可经由代理)并发起查询
+func (upstream *Upstream) exchangeConn(netType string, addr string, tlsConfig *tls.Config, proxy string) (respMsg *dns.Msg, err error) {
 	var (
+		conn   net.Conn
 		dnsReq = dns.Client{
 			Timeout: 5 * time.Second,
 			Net:     netType,
 		}
 	)
 
-	if netType == "tcp-tls" {
-		dnsReq.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS13}
-	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// 向上游发起请求
-	respMsg, _, err = dnsReq.ExchangeContext(ctx, upstream.ReqMsg, addr)
+	conn, err = dialDNSConn(ctx, netType, addr, tlsConfig, proxy)
 	if err != nil {
-		log.Err(err).Caller().Str("net", netType).Str("addr", addr).Msg("请求上游DNS服务失败")
 		return
 	}
+	defer func() {
+		if closeErr := conn.Close(); closeErr != nil {
+			log.Warn().Err(closeErr).Caller().Str("addr", addr).Msg("关闭上游连接失败")
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return
+		}
+	}
+
+	respMsg, _, err = dnsReq.ExchangeWithConn(upstream.ReqMsg, &dns.Conn{Conn: conn})
 	return
 }
 
-// DNS over TLS
-func (upstream *Upstream) QueryTLS(addr string, tlsConfig *tls.Config) (respMsg *dns.Msg, err error) {
-	dnsReq := dns.Client{
-		Timeout: 5 * time.Second,
-		Net:     "tcp-tls",
+// 建立到上游的连接(可经由代理)，netType为tcp-tls时完成TLS握手
+func dialDNSConn(ctx context.Context, netType string, addr string, tlsConfig *tls.Config, proxy string) (conn net.Conn, err error) {
+	dialNet := "tcp"
+	if netType == "udp" {
+		dialNet = "udp"
+	}
+	conn, err = dialUpstream(ctx, dialNet, addr, proxy)
+	if err != nil {
+		return
 	}
-
 	if tlsConfig == nil {
-		dnsReq.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS13}
-	} else {
-		dnsReq.TLSConfig = tlsConfig
+		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// DNS over QUIC，复用到上游的连接，每个查询使用一个新的流，
+// 连接在查询过程中断开时重新建立连接并重试一次
+func (upstream *Upstream) QueryQUIC(addr string, proxy string) (respMsg *dns.Msg, err error) {
+	var (
+		conn   *quic.Conn
+		reqBuf []byte
+		reqMsg = upstream.ReqMsg.Copy()
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// 向上游发起请求
-	respMsg, _, err = dnsReq.ExchangeContext(ctx, upstream.ReqMsg, addr)
+	// RFC 9250要求消息ID必须为0
+	reqMsg.Id = 0
+	reqBuf, err = reqMsg.Pack()
 	if err != nil {
-		log.Err(err).Caller().Str("addr", addr).Msg("请求上游DoT服务失败")
+		log.Err(err).Caller().Msg("构建请求消息失败")
+		return
+	}
+
+	pooled := getQUICConn(addr, proxy)
+	for retry := 0; retry < 2; retry++ {
+		conn, respMsg, err = upstream.exchangeQUIC(ctx, pooled, reqBuf)
+		if err == nil || conn == nil || conn.Context().Err() == nil {
+			break
+		}
+		pooled.drop(conn)
+	}
+	if err != nil {
+		log.Err(err).Caller().Str("addr", addr).Msg("请求上游DoQ服务失败")
 		return
 	}
+	respMsg.Id = upstream.ReqMsg.Id
+	return
+}
+
+// 在一个新的流上发送查询并读取响应，同时返回使用的连接
+func (upstream *Upstream) exchangeQUIC(ctx context.Context, pooled *quicConn, reqBuf []byte) (conn *quic.Conn, respMsg *dns.Msg, err error) {
+	var stream *quic.Stream
+	conn, stream, err = pooled.openStream(ctx)
+	if err != nil {
+		return
+	}
+	// 读取完响应或出错后不再接收该流的数据
+	defer stream.CancelRead(quic.StreamErrorCode(doqNoError))
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = stream.SetDeadline(deadline); err != nil {
+			return
+		}
+	}
+
+	if err = writeDoQMsg(stream, reqBuf); err != nil {
+		return
+	}
+	// 发送完查询后必须关闭流的发送方向
+	if err = stream.Close(); err != nil {
+		return
+	}
+	respMsg, err = readDoQMsg(stream)
 	return
 }
 
 // DNS over HTTPS GET /dns-query
 func (upstream *Upstream) QueryByGET(addr string, proxy string) (respMsg *dns.Msg, err error) {
 	var (
-		httpClient http.Client
+		httpClient *http.Client
 		httpReq    *http.Request
 		httpResp   *http.Response
 		dnsParam   string
 		reqMsgBuf  []byte
 		respMsgBuf []byte
-		proxyURL   *url.URL
+		reqURL     string
 	)
 	respMsg = new(dns.Msg)
 
-	// 设置代理
-	if proxy != "" {
-		proxyURL, err = url.Parse(proxy)
-		if err != nil {
-			log.Err(err).Caller().Msg("无效的HTTP代理地址")
-			return
-		}
-		httpClient.Transport = &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		}
+	// 获取共享的HTTP客户端
+	httpClient, reqURL, err = dohClient(addr, proxy)
+	if err != nil {
+		log.Err(err).Caller().Msg("无效的代理地址")
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -180,7 +369,7 @@ func (upstream *Upstream) QueryByGET(addr string, proxy string) (respMsg *dns.Ms
 	}
 	dnsParam = base64.RawURLEncoding.EncodeToString(reqMsgBuf)
 
-	httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, addr, nil)
+	httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
 		log.Err(err).Caller().Str("url", addr).Msg("请求DoT服务失败")
 		return
@@ -215,25 +404,20 @@ func (upstream *Upstream) QueryByGET(addr string, proxy string) (respMsg *dns.Ms
 // DNS over HTTPS POST /dns-query
 func (upstream *Upstream) QueryByPOST(addr string, proxy string) (respMsg *dns.Msg, err error) {
 	var (
-		httpClient http.Client
+		httpClient *http.Client
 		httpReq    *http.Request
 		httpResp   *http.Response
 		reqBody    []byte
 		respBody   []byte
-		proxyURL   *url.URL
+		reqURL     string
 	)
 	respMsg = new(dns.Msg)
 
-	// 设置代理
-	if proxy != "" {
-		proxyURL, err = url.Parse(proxy)
-		if err != nil {
-			log.Err(err).Caller().Msg("无效的HTTP代理地址")
-			return
-		}
-		httpClient.Transport = &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		}
+	// 获取共享的HTTP客户端
+	httpClient, reqURL, err = dohClient(addr, proxy)
+	if err != nil {
+		log.Err(err).Caller().Msg("无效的代理地址")
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -246,7 +430,7 @@ func (upstream *Upstream) QueryByPOST(addr string, proxy string) (respMsg *dns.M
 		return
 	}
 
-	httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewBuffer(reqBody))
+	httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewBuffer(reqBody))
 	if err != nil {
 		log.Err(err).Caller().Str("url", addr).Msg("请求DoT服务失败")
 		return
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/quic-go/quic-go"
+)
+
+// 测试按域名后缀选择上游服务，多条规则匹配时使用后缀最长的规则，没有匹配时使用默认的上游服务
+func TestUpstreamAddrs(t *testing.T) {
+	conf := new(global.Configuration)
+	if err := toml.Unmarshal([]byte(`
+[service.upstream]
+addrs = ["udp://10.0.0.1:53"]
+
+[[service.forward]]
+suffix = "example."
+addrs = ["udp://10.0.1.1:53"]
+
+[[service.forward]]
+suffix = "corp.example."
+addrs = ["udp://10.0.2.1:53"]
+
+[[service.forward]]
+suffix = ".consul."
+addrs = ["udp://10.0.3.1:53"]
+`), conf); err != nil {
+		t.Fatal(err)
+	}
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	for _, item := range []struct {
+		name string
+		want string
+	}{
+		{"www.example.", "udp://10.0.1.1:53"},
+		{"example.", "udp://10.0.1.1:53"},
+		{"db.corp.example.", "udp://10.0.2.1:53"},
+		{"corp.example.", "udp://10.0.2.1:53"},
+		{"DB.Corp.EXAMPLE.", "udp://10.0.2.1:53"},
+		{"xcorp.example.", "udp://10.0.1.1:53"},
+		{"web.service.consul.", "udp://10.0.3.1:53"},
+		{"www.example.com.", "udp://10.0.0.1:53"},
+		{"notexample.", "udp://10.0.0.1:53"},
+		{".", "udp://10.0.0.1:53"},
+	} {
+		if addrs := upstreamAddrs(item.name); !slices.Equal(addrs, []string{item.want}) {
+			t.Error("选择的上游服务错误", item.name, addrs)
+		}
+	}
+}
+
+// 生成127.0.0.1的自签名证书，并作为上游服务的根证书
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamRootCAs = x509.NewCertPool()
+	upstreamRootCAs.AddCert(cert)
+	t.Cleanup(func() {
+		upstreamRootCAs = nil
+	})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// 本地的DoQ服务，按RFC 9250核对每个流上的查询并以查询的名称构造响应
+type fakeDoQ struct {
+	listener *quic.Listener
+	conns    atomic.Int32
+	streams  atomic.Int32
+
+	mutex    sync.Mutex
+	accepted []*quic.Conn
+}
+
+func startDoQServer(t *testing.T) *fakeDoQ {
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t)},
+		NextProtos:   []string{doqALPN},
+	}, &quic.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeDoQ{listener: listener}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			server.conns.Add(1)
+			server.mutex.Lock()
+			server.accepted = append(server.accepted, conn)
+			server.mutex.Unlock()
+			go server.serveConn(t, conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeDoQ) serveConn(t *testing.T, conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		server.streams.Add(1)
+		go func() {
+			defer stream.Close()
+			// 读取到流结束，客户端发送完查询后必须关闭流的发送方向
+			data, err := io.ReadAll(stream)
+			if err != nil {
+				t.Error("读取DoQ查询失败", err)
+				return
+			}
+			if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+				t.Error("DoQ查询的长度前缀错误", data)
+				return
+			}
+			reqMsg := new(dns.Msg)
+			if err = reqMsg.Unpack(data[2:]); err != nil {
+				t.Error(err)
+				return
+			}
+			if reqMsg.Id != 0 {
+				t.Error("DoQ查询的消息ID不为0", reqMsg.Id)
+			}
+			respBuf, _ := answerMsg(reqMsg).Pack()
+			_ = writeDoQMsg(stream, respBuf)
+		}()
+	}
+}
+
+func (server *fakeDoQ) addr() string {
+	return server.listener.Addr().String()
+}
+
+// 关闭所有已建立的连接
+func (server *fakeDoQ) closeConns() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, conn := range server.accepted {
+		_ = conn.CloseWithError(doqNoError, "")
+	}
+}
+
+// 测试DoQ查询的报文格式，同一上游的查询复用同一连接并各自使用一个流，连接被关闭后重新建立连接
+func TestQueryQUIC(t *testing.T) {
+	global.SetConfig(new(global.Configuration))
+	defer global.SetConfig(nil)
+	server := startDoQServer(t)
+	t.Cleanup(resetConnPools)
+
+	names := []string{"a.doq.test.", "b.doq.test.", "c.doq.test.", "d.doq.test."}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Go(func() {
+			upstream := &Upstream{ReqMsg: poolQuery(name)}
+			respMsg, err := upstream.QueryQUIC(server.addr(), "")
+			checkPoolResp(t, name, respMsg, err)
+		})
+	}
+	wg.Wait()
+	if server.conns.Load() != 1 || server.streams.Load() != int32(len(names)) {
+		t.Fatal("查询未复用同一连接", server.conns.Load(), server.streams.Load())
+	}
+
+	server.closeConns()
+	upstream := &Upstream{ReqMsg: poolQuery("e.doq.test.")}
+	respMsg, err := upstream.QueryQUIC(server.addr(), "")
+	checkPoolResp(t, "e.doq.test.", respMsg, err)
+	if server.conns.Load() != 2 {
+		t.Fatal("连接关闭后未重新建立连接", server.conns.Load())
+	}
+}
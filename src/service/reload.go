@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"local/global"
+	"local/querylog"
+	"local/storage"
+
+	"github.com/rs/zerolog/log"
+)
+
+// 同一时间只允许一个重载操作
+var reloadMutex sync.Mutex
+
+// 重新加载配置文件，校验通过后替换上游服务、内部域名、认证、存储器及日志等配置，
+// 只重启监听地址或证书发生变化的服务，配置无效时继续使用原有的配置
+func Reload() (err error) {
+	var (
+		conf    *global.Configuration
+		oldConf *global.Configuration
+		desired []*listener
+	)
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	oldConf = global.Config()
+
+	log.Info().Msg("开始重载配置")
+
+	conf, err = global.ParseConfig()
+	if err != nil {
+		return
+	}
+	if !conf.HasUpstream() && len(conf.Service.InternalSuffix) == 0 {
+		err = errors.New("DNS转发和内部域名解析服务不能都未启用")
+		log.Err(err).Caller().Msg("重载配置失败")
+		return
+	}
+	desired, err = buildListeners(conf)
+	if err != nil {
+		log.Err(err).Caller().Msg("重载配置失败")
+		return
+	}
+
+	global.SetConfig(conf)
+	if err = setupResolver(); err != nil {
+		global.SetConfig(oldConf)
+		log.Err(err).Caller().Msg("重载配置失败，继续使用原有的配置")
+		return
+	}
+	if err = global.SetupLogger(); err != nil {
+		log.Err(err).Caller().Msg("重载日志配置失败")
+		err = nil
+	}
+	if err = querylog.Setup(); err != nil {
+		log.Err(err).Caller().Msg("重载查询日志配置失败")
+		err = nil
+	}
+	// 存储器不可用时仍然应用新的配置，以便存储器恢复后无需再次重载
+	if len(conf.Service.InternalSuffix) > 0 {
+		if pingErr := pingStorage(); pingErr != nil {
+			log.Warn().Err(pingErr).Caller().Msg("存储器不可用，内部域名的查询将会失败")
+		}
+	}
+	resetConnPools()
+	applyListeners(desired, false)
+
+	log.Info().Msg("重载配置完成")
+	return
+}
+
+// 检查存储器是否可用
+func pingStorage() error {
+	ctx, cancel := storageContext(context.Background())
+	defer cancel()
+	return storage.Ping(ctx)
+}
+
+// 按当前配置设置上游服务、缓存及存储器
+func setupResolver() (err error) {
+	conf := global.Config()
+
+	if len(conf.Service.InternalSuffix) < 1 {
+		log.Warn().Msg("已禁用内部域名解析，因 service.internalSuffix 参数为空")
+	} else {
+		// 构建存储器
+		if err = storage.MakeStorage(); err != nil {
+			log.Err(err).Caller().Msg("构建存储器失败")
+			return
+		}
+		setupZones()
+	}
+
+	if !conf.HasUpstream() {
+		log.Warn().Msg("已禁用 DNS 转发，因 service.upstream.addrs 和 service.forward 参数都为空")
+		upstreamCache.Store(nil)
+		stopHealthCheck()
+		return
+	}
+
+	log.Info().Str("strategy", conf.Service.Upstream.Strategy).Msg("启用 DNS 转发")
+	restartHealthCheck(conf.Service.Upstream.Health.Interval)
+	if conf.Service.Upstream.Health.Interval > 0 {
+		log.Info().Uint("interval", conf.Service.Upstream.Health.Interval).Int("failures", conf.Service.Upstream.Health.Failures).Msg("启用上游服务健康探测")
+	}
+	for k := range conf.Service.Forward {
+		log.Info().Str("suffix", conf.Service.Forward[k].Suffix).Strs("addrs", conf.Service.Forward[k].Addrs).Msg("启用转发规则")
+	}
+	// 上游服务可能已变化，重建缓存
+	if conf.Service.Cache.Size > 0 {
+		upstreamCache.Store(newResponseCache(conf.Service.Cache.Size, conf.Service.Cache.MaxTTL))
+		log.Info().Int("size", conf.Service.Cache.Size).Msg("启用上游响应缓存")
+	} else {
+		upstreamCache.Store(nil)
+		log.Warn().Msg("已禁用上游响应缓存，因 service.cache.size 参数未配置")
+	}
+	return
+}
@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5协议常量(RFC 1928/1929)
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+	socks5CmdConnect   = 0x01
+	socks5CmdAssociate = 0x03
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+)
+
+// SOCKS5代理客户端
+type socks5Client struct {
+	addr     string
+	username string
+	password string
+}
+
+// 通过代理建立TCP连接
+func (client *socks5Client) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return client.connect(ctx, socks5CmdConnect, addr)
+}
+
+// 通过代理的UDP ASSOCIATE命令建立UDP中继
+func (client *socks5Client) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	var (
+		err       error
+		ctrlConn  net.Conn
+		udpConn   net.Conn
+		relayAddr string
+		header    []byte
+	)
+
+	// UDP中继的目标地址头
+	header, err = socks5EncodeAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctrlConn, err = (&net.Dialer{}).DialContext(ctx, "tcp", client.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = ctrlConn.SetDeadline(deadline)
+	}
+	if err = client.handshake(ctrlConn); err != nil {
+		_ = ctrlConn.Close()
+		return nil, err
+	}
+	// 客户端地址未知，按RFC 1928填写全零地址
+	relayAddr, err = client.request(ctrlConn, socks5CmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		_ = ctrlConn.Close()
+		return nil, err
+	}
+	_ = ctrlConn.SetDeadline(time.Time{})
+
+	// 代理返回未指定的地址时，使用代理服务器的地址
+	relayHost, relayPort, err := net.SplitHostPort(relayAddr)
+	if err != nil {
+		_ = ctrlConn.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		relayHost, _, _ = net.SplitHostPort(client.addr)
+	}
+	udpConn, err = (&net.Dialer{}).DialContext(ctx, "udp", net.JoinHostPort(relayHost, relayPort))
+	if err != nil {
+		_ = ctrlConn.Close()
+		return nil, err
+	}
+
+	return &socks5UDPConn{
+		Conn:     udpConn,
+		ctrlConn: ctrlConn,
+		header:   append([]byte{0, 0, 0}, header...),
+	}, nil
+}
+
+// 建立连接并发送命令
+func (client *socks5Client) connect(ctx context.Context, cmd byte, addr string) (conn net.Conn, err error) {
+	conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", client.addr)
+	if err != nil {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err = client.handshake(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if _, err = client.request(conn, cmd, addr); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return
+}
+
+// 协商认证方式并认证
+func (client *socks5Client) handshake(conn net.Conn) (err error) {
+	var resp [2]byte
+
+	method := byte(socks5AuthNone)
+	if client.username != "" {
+		method = socks5AuthPassword
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return
+	}
+	if resp[0] != socks5Version {
+		return errors.New("SOCKS5代理的协议版本无效")
+	}
+	if resp[1] == socks5AuthNoAccept || resp[1] != method {
+		return errors.New("SOCKS5代理不支持的认证方式")
+	}
+	if method != socks5AuthPassword {
+		return
+	}
+
+	// 用户名密码认证(RFC 1929)
+	buf := make([]byte, 0, 3+len(client.username)+len(client.password))
+	buf = append(buf, 0x01, byte(len(client.username)))
+	buf = append(buf, client.username...)
+	buf = append(buf, byte(len(client.password)))
+	buf = append(buf, client.password...)
+	if _, err = conn.Write(buf); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return
+	}
+	if resp[1] != 0x00 {
+		return errors.New("SOCKS5代理认证失败")
+	}
+	return
+}
+
+// 发送命令并读取代理绑定的地址
+func (client *socks5Client) request(conn net.Conn, cmd byte, addr string) (bound string, err error) {
+	var (
+		header [4]byte
+		dst    []byte
+	)
+	dst, err = socks5EncodeAddr(addr)
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(append([]byte{socks5Version, cmd, 0x00}, dst...)); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	if header[1] != 0x00 {
+		return "", errors.New("SOCKS5代理拒绝请求，错误码：" + strconv.Itoa(int(header[1])))
+	}
+	return socks5ReadAddr(conn, header[3])
+}
+
+// 将地址编码为SOCKS5的ATYP/ADDR/PORT格式
+func socks5EncodeAddr(addr string) (buf []byte, err error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{socks5AtypIPv4}, ip4...)
+		} else {
+			buf = append([]byte{socks5AtypIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("SOCKS5代理的目标域名过长")
+		}
+		buf = append([]byte{socks5AtypDomain, byte(len(host))}, host...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	return
+}
+
+// 读取SOCKS5格式的地址
+func socks5ReadAddr(reader io.Reader, atyp byte) (addr string, err error) {
+	var host string
+	switch atyp {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		size := net.IPv4len
+		if atyp == socks5AtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err = io.ReadFull(reader, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case socks5AtypDomain:
+		var size [1]byte
+		if _, err = io.ReadFull(reader, size[:]); err != nil {
+			return
+		}
+		domain := make([]byte, size[0])
+		if _, err = io.ReadFull(reader, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		return "", errors.New("SOCKS5代理返回的地址类型无效")
+	}
+	var port [2]byte
+	if _, err = io.ReadFull(reader, port[:]); err != nil {
+		return
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// 通过SOCKS5代理中继的UDP连接，同时实现了net.PacketConn以便按数据报收发DNS消息
+type socks5UDPConn struct {
+	net.Conn
+	ctrlConn net.Conn // 控制连接，关闭后代理会终止中继
+	header   []byte   // 发往目标地址的数据报头
+}
+
+func (conn *socks5UDPConn) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(conn.header)+len(p))
+	buf = append(buf, conn.header...)
+	buf = append(buf, p...)
+	if _, err := conn.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (conn *socks5UDPConn) Read(p []byte) (n int, err error) {
+	buf := make([]byte, len(p)+262)
+	n, err = conn.Conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	// RSV(2) FRAG(1) ATYP(1) ADDR PORT(2) DATA
+	if n < 5 || buf[2] != 0 {
+		return 0, errors.New("SOCKS5代理返回的UDP数据报无效")
+	}
+	offset := 4
+	switch buf[3] {
+	case socks5AtypIPv4:
+		offset += net.IPv4len
+	case socks5AtypIPv6:
+		offset += net.IPv6len
+	case socks5AtypDomain:
+		offset += 1 + int(buf[4])
+	default:
+		return 0, errors.New("SOCKS5代理返回的地址类型无效")
+	}
+	offset += 2
+	if offset > n {
+		return 0, errors.New("SOCKS5代理返回的UDP数据报无效")
+	}
+	return copy(p, buf[offset:n]), nil
+}
+
+func (conn *socks5UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := conn.Read(p)
+	return n, conn.RemoteAddr(), err
+}
+
+func (conn *socks5UDPConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return conn.Write(p)
+}
+
+func (conn *socks5UDPConn) Close() error {
+	err := conn.Conn.Close()
+	if ctrlErr := conn.ctrlConn.Close(); err == nil {
+		err = ctrlErr
+	}
+	return err
+}
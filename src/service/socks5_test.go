@@ -0,0 +1,287 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 进程内的SOCKS5代理，CONNECT后回显收到的数据，UDP ASSOCIATE后由relay函数处理数据报
+type fakeSocks5 struct {
+	listener  net.Listener
+	username  string
+	password  string
+	replyAtyp byte                                                      // 响应中绑定地址的类型
+	targets   chan string                                               // 客户端请求的目标地址
+	relay     func(conn net.PacketConn, client net.Addr, packet []byte) // 处理UDP中继收到的数据报
+}
+
+func newFakeSocks5(t *testing.T) *fakeSocks5 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &fakeSocks5{listener: listener, replyAtyp: socks5AtypIPv4, targets: make(chan string, 10)}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.serve(conn)
+		}
+	}()
+	return proxy
+}
+
+func (proxy *fakeSocks5) addr() string {
+	return proxy.listener.Addr().String()
+}
+
+func (proxy *fakeSocks5) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// 协商认证方式
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5AuthNone)
+	if proxy.username != "" {
+		method = socks5AuthPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return
+	}
+	_, _ = conn.Write([]byte{socks5Version, method})
+	if method == socks5AuthPassword {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		username := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, username); err != nil {
+			return
+		}
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return
+		}
+		password := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return
+		}
+		if string(username) != proxy.username || string(password) != proxy.password {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+	}
+
+	// 读取命令及目标地址
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	target, err := socks5ReadAddr(conn, header[3])
+	if err != nil {
+		return
+	}
+	proxy.targets <- target
+
+	switch header[1] {
+	case socks5CmdConnect:
+		_, _ = conn.Write(append([]byte{socks5Version, 0x00, 0x00}, proxy.boundAddr(12345)...))
+		_, _ = io.Copy(conn, conn)
+	case socks5CmdAssociate:
+		relayConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relayConn.Close()
+		// 返回未指定的地址，客户端应使用代理服务器的地址
+		port := relayConn.LocalAddr().(*net.UDPAddr).Port
+		bound := append([]byte{socks5AtypIPv4, 0, 0, 0, 0}, byte(port>>8), byte(port))
+		_, _ = conn.Write(append([]byte{socks5Version, 0x00, 0x00}, bound...))
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, client, err := relayConn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				proxy.relay(relayConn, client, buf[:n])
+			}
+		}()
+		// 控制连接关闭时终止中继
+		_, _ = io.Copy(io.Discard, conn)
+	default:
+		_, _ = conn.Write([]byte{socks5Version, 0x07, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// 按replyAtyp编码绑定地址
+func (proxy *fakeSocks5) boundAddr(port int) []byte {
+	var buf []byte
+	switch proxy.replyAtyp {
+	case socks5AtypIPv6:
+		buf = append([]byte{socks5AtypIPv6}, net.ParseIP("::1").To16()...)
+	case socks5AtypDomain:
+		buf = append([]byte{socks5AtypDomain, byte(len("proxy.test"))}, "proxy.test"...)
+	default:
+		buf = []byte{socks5AtypIPv4, 127, 0, 0, 1}
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// 测试用户名密码认证失败及认证方式不被接受
+func TestSocks5AuthFailure(t *testing.T) {
+	proxy := newFakeSocks5(t)
+	proxy.username = "user"
+	proxy.password = "secret"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, client := range []*socks5Client{
+		{addr: proxy.addr(), username: "user", password: "wrong"},
+		{addr: proxy.addr()},
+	} {
+		if conn, err := client.Dial(ctx, "10.0.0.1:53"); err == nil {
+			_ = conn.Close()
+			t.Fatal("认证失败时建立了连接", client.username)
+		}
+	}
+
+	client := &socks5Client{addr: proxy.addr(), username: "user", password: "secret"}
+	conn, err := client.Dial(ctx, "10.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+// 测试CONNECT命令对各种地址类型的编码及解析
+func TestSocks5Connect(t *testing.T) {
+	proxy := newFakeSocks5(t)
+	client := &socks5Client{addr: proxy.addr()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, item := range []struct {
+		target    string
+		replyAtyp byte
+	}{
+		{target: "10.0.0.1:53", replyAtyp: socks5AtypIPv4},
+		{target: "[2001:db8::1]:853", replyAtyp: socks5AtypIPv6},
+		{target: "dns.example:853", replyAtyp: socks5AtypDomain},
+	} {
+		proxy.replyAtyp = item.replyAtyp
+		conn, err := client.Dial(ctx, item.target)
+		if err != nil {
+			t.Fatal(item.target, err)
+		}
+		if target := <-proxy.targets; target != item.target {
+			t.Fatal("代理收到的目标地址错误", target, item.target)
+		}
+		if _, err = conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatal("通过代理收发数据错误", string(buf), err)
+		}
+		_ = conn.Close()
+	}
+
+	if _, err := socks5EncodeAddr(strings.Repeat("a", 256) + ":53"); err == nil {
+		t.Fatal("过长的域名未返回错误")
+	}
+}
+
+// 测试UDP中继的数据报头解析、分片拒绝及忽略其它来源的数据报
+func TestSocks5UDP(t *testing.T) {
+	proxy := newFakeSocks5(t)
+	client := &socks5Client{addr: proxy.addr()}
+
+	// 中继按数据内容决定响应的数据报头
+	proxy.relay = func(conn net.PacketConn, client net.Addr, packet []byte) {
+		target, err := socks5ReadAddr(bytes.NewReader(packet[4:]), packet[3])
+		if err != nil || target != "10.0.0.1:53" {
+			return
+		}
+		data := packet[len(packet)-4:]
+		var header []byte
+		switch string(data) {
+		case "ipv6":
+			header = append([]byte{0, 0, 0, socks5AtypIPv6}, net.ParseIP("2001:db8::1").To16()...)
+		case "name":
+			header = append([]byte{0, 0, 0, socks5AtypDomain, 4}, "test"...)
+		case "frag":
+			header = []byte{0, 0, 1, socks5AtypIPv4, 10, 0, 0, 1}
+		default:
+			header = []byte{0, 0, 0, socks5AtypIPv4, 10, 0, 0, 1}
+		}
+		header = append(header, 0, 53)
+		_, _ = conn.WriteTo(append(header, data...), client)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := client.DialUDP(ctx, "10.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if target := <-proxy.targets; target != "0.0.0.0:0" {
+		t.Fatal("UDP ASSOCIATE的地址错误", target)
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	buf := make([]byte, 512)
+	for _, data := range []string{"ipv4", "ipv6", "name"} {
+		if _, err = conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != data {
+			t.Fatal("解析中继的数据报错误", data, string(buf[:n]), err)
+		}
+	}
+
+	if _, err = conn.Write([]byte("frag")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(buf); err == nil {
+		t.Fatal("分片的数据报未返回错误")
+	}
+
+	// 不是来自中继的数据报被忽略
+	stray, err := net.Dial("udp", conn.(*socks5UDPConn).Conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stray.Close()
+	if _, err = stray.Write([]byte{0, 0, 0, socks5AtypIPv4, 10, 0, 0, 1, 0, 53, 'e', 'v', 'i', 'l'}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err = conn.Write([]byte("ipv4")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "ipv4" {
+		t.Fatal("收到了其它来源的数据报", string(buf[:n]), err)
+	}
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// 上游服务的健康状态
+type UpstreamHealth struct {
+	Addr      string `json:"addr"`
+	Healthy   bool   `json:"healthy"`
+	Failures  int    `json:"failures"`
+	Latency   int64  `json:"latency"` // 平均响应耗时(毫秒)
+	LastCheck string `json:"lastCheck,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// 是否启用熔断
+func breakerEnabled() bool {
+	return global.Config().Service.Upstream.Health.Interval > 0
+}
+
+// 记录一次失败，连续失败次数达到阈值时熔断
+func (state *upstreamState) fail(err error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.failures++
+	state.lastError = err.Error()
+	if breakerEnabled() && !state.down && state.failures >= global.Config().Service.Upstream.Health.Failures {
+		state.down = true
+		log.Warn().Str("addr", state.addr).Int("failures", state.failures).Str("error", state.lastError).Msg("上游服务已熔断")
+	}
+}
+
+// 记录一次成功，清零连续失败次数
+func (state *upstreamState) succeed() {
+	state.mutex.Lock()
+	state.failures = 0
+	state.mutex.Unlock()
+}
+
+// 健康探测成功，恢复已熔断的上游服务
+func (state *upstreamState) recover() (recovered bool) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.failures = 0
+	recovered = state.down
+	state.down = false
+	return
+}
+
+// 是否处于可用状态
+func (state *upstreamState) Healthy() bool {
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	return !state.down
+}
+
+// 过滤掉已熔断的上游服务，如果全部都已熔断则返回原列表
+func healthyAddrs(addrs []string) []string {
+	if !breakerEnabled() {
+		return addrs
+	}
+	result := make([]string, 0, len(addrs))
+	for k := range addrs {
+		if getUpstreamState(addrs[k]).Healthy() {
+			result = append(result, addrs[k])
+		}
+	}
+	if len(result) == 0 {
+		return addrs
+	}
+	return result
+}
+
+// 获取所有上游服务的健康状态
+func upstreamHealth() []UpstreamHealth {
+	addrs := allUpstreamAddrs()
+	result := make([]UpstreamHealth, 0, len(addrs))
+	for k := range addrs {
+		state := getUpstreamState(addrs[k])
+		state.mutex.RLock()
+		health := UpstreamHealth{
+			Addr:      addrs[k],
+			Healthy:   !state.down,
+			Failures:  state.failures,
+			Latency:   state.Latency().Milliseconds(),
+			LastError: state.lastError,
+		}
+		if !state.lastCheck.IsZero() {
+			health.LastCheck = state.lastCheck.Format(time.RFC3339)
+		}
+		state.mutex.RUnlock()
+		result = append(result, health)
+	}
+	return result
+}
+
+// 健康探测协程的取消函数，每次设置上游服务时停止原有的协程并按新的配置重新启动
+var (
+	healthMutex  sync.Mutex
+	healthCancel context.CancelFunc
+)
+
+// 停止原有的健康探测协程，探测间隔大于0时按该间隔启动新的协程
+func restartHealthCheck(interval uint) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if healthCancel != nil {
+		healthCancel()
+		healthCancel = nil
+	}
+	if interval == 0 {
+		return
+	}
+	var ctx context.Context
+	ctx, healthCancel = context.WithCancel(context.Background())
+	go healthCheck(ctx, time.Duration(interval)*time.Second)
+}
+
+// 停止健康探测协程
+func stopHealthCheck() {
+	restartHealthCheck(0)
+}
+
+// 定时对所有上游服务进行健康探测，直到ctx被取消
+func healthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			addrs := allUpstreamAddrs()
+			for k := range addrs {
+				go probeUpstream(addrs[k])
+			}
+		}
+	}
+}
+
+// 向上游服务发送探测查询
+func probeUpstream(addr string) {
+	var err error
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion(global.Config().Service.Upstream.Health.ProbeName, dns.TypeNS)
+	upstream := Upstream{
+		ReqMsg: reqMsg,
+	}
+	begin := time.Now()
+	respMsg, err := upstream.queryAddr(addr)
+	if err == nil && (respMsg.Rcode == dns.RcodeServerFailure || respMsg.Rcode == dns.RcodeRefused) {
+		err = errors.New("上游服务响应 " + dns.RcodeToString[respMsg.Rcode])
+	}
+
+	state := getUpstreamState(addr)
+	state.mutex.Lock()
+	state.lastCheck = time.Now()
+	state.mutex.Unlock()
+
+	if err != nil {
+		state.observe(time.Since(begin), err)
+		return
+	}
+	state.observe(time.Since(begin), nil)
+	if state.recover() {
+		log.Info().Str("addr", addr).Msg("上游服务已恢复")
+	}
+}
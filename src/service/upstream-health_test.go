@@ -0,0 +1,154 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+)
+
+// 启动本地的UDP DNS服务，返回udp://格式的地址
+func startUDPServer(t *testing.T, handler dns.HandlerFunc) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() {
+		close(started)
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	return "udp://" + conn.LocalAddr().String()
+}
+
+// 测试连续失败达到阈值时熔断，并在健康探测成功后恢复
+func TestUpstreamBreaker(t *testing.T) {
+	resetUpstreamStates()
+	var rcode atomic.Int32
+	rcode.Store(dns.RcodeServerFailure)
+	addr := startUDPServer(t, func(resp dns.ResponseWriter, reqMsg *dns.Msg) {
+		respMsg := new(dns.Msg)
+		respMsg.SetRcode(reqMsg, int(rcode.Load()))
+		_ = resp.WriteMsg(respMsg)
+	})
+	other := "udp://breaker-other:53"
+
+	conf := new(global.Configuration)
+	conf.Service.Upstream.Addrs = []string{addr, other}
+	conf.Service.Upstream.Health.Interval = 10
+	conf.Service.Upstream.Health.Failures = 3
+	conf.Service.Upstream.Health.ProbeName = "."
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	state := getUpstreamState(addr)
+	for k := range 3 {
+		if !state.Healthy() {
+			t.Fatal("未达到失败阈值时被熔断", k)
+		}
+		state.observe(0, errors.New("timeout"))
+	}
+	if state.Healthy() {
+		t.Fatal("连续失败达到阈值时未熔断")
+	}
+	if result := healthyAddrs(conf.Service.Upstream.Addrs); !slices.Equal(result, []string{other}) {
+		t.Fatal("未过滤已熔断的上游服务", result)
+	}
+
+	// 上游服务响应SERVFAIL时探测失败，保持熔断
+	probeUpstream(addr)
+	if state.Healthy() {
+		t.Fatal("探测失败时恢复了上游服务")
+	}
+
+	// 上游服务响应REFUSED时同样视为探测失败
+	rcode.Store(dns.RcodeRefused)
+	probeUpstream(addr)
+	if state.Healthy() {
+		t.Fatal("上游服务拒绝查询时恢复了上游服务")
+	}
+
+	rcode.Store(dns.RcodeSuccess)
+	probeUpstream(addr)
+	if !state.Healthy() {
+		t.Fatal("探测成功后未恢复上游服务")
+	}
+	health := upstreamHealth()
+	if len(health) != 2 || health[0].Failures != 0 || health[0].LastCheck == "" {
+		t.Fatal("健康状态错误", health)
+	}
+}
+
+// 测试未启用熔断时不会熔断，全部熔断时使用原列表
+func TestUpstreamBreakerDisabled(t *testing.T) {
+	resetUpstreamStates()
+	conf := new(global.Configuration)
+	conf.Service.Upstream.Health.Failures = 1
+	global.SetConfig(conf)
+
+	state := getUpstreamState("udp://breaker-disabled:53")
+	state.observe(0, errors.New("timeout"))
+	if !state.Healthy() {
+		t.Fatal("未启用熔断时熔断了上游服务")
+	}
+
+	conf = new(global.Configuration)
+	conf.Service.Upstream.Health.Interval = 10
+	conf.Service.Upstream.Health.Failures = 1
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+	state.observe(0, errors.New("timeout"))
+	addrs := []string{"udp://breaker-disabled:53"}
+	if result := healthyAddrs(addrs); !slices.Equal(result, addrs) {
+		t.Fatal("全部熔断时未使用原列表", result)
+	}
+}
+
+// 测试重新设置探测间隔时重启健康探测协程，间隔为0时停止探测
+func TestHealthCheckRestart(t *testing.T) {
+	resetUpstreamStates()
+	var probes atomic.Int32
+	addr := startUDPServer(t, func(resp dns.ResponseWriter, reqMsg *dns.Msg) {
+		probes.Add(1)
+		respMsg := new(dns.Msg)
+		respMsg.SetReply(reqMsg)
+		_ = resp.WriteMsg(respMsg)
+	})
+
+	conf := new(global.Configuration)
+	conf.Service.Upstream.Addrs = []string{addr}
+	conf.Service.Upstream.Health.Interval = 1
+	conf.Service.Upstream.Health.Failures = 3
+	conf.Service.Upstream.Health.ProbeName = "."
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+	defer stopHealthCheck()
+
+	// 多次重启只保留一个探测协程
+	restartHealthCheck(1)
+	restartHealthCheck(1)
+	time.Sleep(1500 * time.Millisecond)
+	if count := probes.Load(); count != 1 {
+		t.Fatal("探测次数错误", count)
+	}
+
+	restartHealthCheck(0)
+	count := probes.Load()
+	time.Sleep(1500 * time.Millisecond)
+	if probes.Load() != count {
+		t.Fatal("探测间隔为0时未停止探测")
+	}
+}
@@ -0,0 +1,427 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/rs/zerolog/log"
+)
+
+// 连接已关闭
+var errConnClosed = errors.New("上游连接已关闭")
+
+var (
+	connPools   sync.Map // 协议|地址|代理 -> *connPool
+	quicConns   sync.Map // 地址|代理 -> *quicConn
+	dohClients  sync.Map // 协议|代理 -> *http.Client
+	dohClientMu sync.Mutex
+)
+
+// 验证上游服务证书的根证书，为nil时使用系统的根证书
+var upstreamRootCAs *x509.CertPool
+
+// 连接上游DoT/DoQ/DoH服务的TLS配置
+func upstreamTLSConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS13, RootCAs: upstreamRootCAs}
+}
+
+// 获取上游TCP/DoT服务的连接池
+func getConnPool(netType string, addr string, proxy string) *connPool {
+	key := netType + "|" + addr + "|" + proxy
+	if pool, ok := connPools.Load(key); ok {
+		return pool.(*connPool)
+	}
+	pool, _ := connPools.LoadOrStore(key, &connPool{
+		netType: netType,
+		addr:    addr,
+		proxy:   proxy,
+	})
+	return pool.(*connPool)
+}
+
+// 丢弃所有连接池、QUIC连接和DoH客户端，之后的查询按新的配置建立连接，
+// 已有的连接在空闲超时后自动关闭
+func resetConnPools() {
+	connPools.Range(func(key, _ any) bool {
+		connPools.Delete(key)
+		return true
+	})
+	quicConns.Range(func(key, _ any) bool {
+		quicConns.Delete(key)
+		return true
+	})
+	dohClientMu.Lock()
+	defer dohClientMu.Unlock()
+	dohClients.Range(func(key, value any) bool {
+		dohClients.Delete(key)
+		value.(*http.Client).CloseIdleConnections()
+		return true
+	})
+}
+
+// 上游TCP/DoT服务的连接池，每个连接都支持管道化查询(RFC 7766)
+type connPool struct {
+	netType string
+	addr    string
+	proxy   string
+
+	mutex     sync.Mutex
+	dialMutex sync.Mutex
+	conns     []*pipelineConn
+}
+
+// 通过连接池查询，连接在查询过程中断开时会换一个连接重试一次
+func (pool *connPool) Exchange(ctx context.Context, reqMsg *dns.Msg) (respMsg *dns.Msg, err error) {
+	var conn *pipelineConn
+	for retry := 0; retry < 2; retry++ {
+		conn, err = pool.get(ctx)
+		if err != nil {
+			return
+		}
+		respMsg, err = conn.exchange(ctx, reqMsg)
+		if !errors.Is(err, errConnClosed) {
+			return
+		}
+	}
+	return
+}
+
+// 获取一个可用的连接，优先使用排队查询最少的连接，
+// 所有连接都在使用中且未达到连接池上限时建立新的连接
+func (pool *connPool) get(ctx context.Context) (*pipelineConn, error) {
+	if conn, full := pool.pick(); conn != nil && (full || conn.inflight() == 0) {
+		return conn, nil
+	}
+
+	// 同一时间只建立一个新连接，等待期间可能已有其它协程建立了新连接
+	pool.dialMutex.Lock()
+	defer pool.dialMutex.Unlock()
+	conn, full := pool.pick()
+	if conn != nil && (full || conn.inflight() == 0) {
+		return conn, nil
+	}
+
+	var tlsConfig *tls.Config
+	if pool.netType == "tcp-tls" {
+		tlsConfig = upstreamTLSConfig()
+	}
+	netConn, err := dialDNSConn(ctx, pool.netType, pool.addr, tlsConfig, pool.proxy)
+	if err != nil {
+		// 建立新连接失败时退回使用已有的连接
+		if conn != nil {
+			return conn, nil
+		}
+		return nil, err
+	}
+	conn = newPipelineConn(netConn)
+
+	pool.mutex.Lock()
+	pool.conns = append(pool.conns, conn)
+	pool.mutex.Unlock()
+	return conn, nil
+}
+
+// 清理已关闭的连接，返回排队查询最少的连接以及连接池是否已满
+func (pool *connPool) pick() (conn *pipelineConn, full bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	alive := pool.conns[:0]
+	for _, item := range pool.conns {
+		if !item.isClosed() {
+			alive = append(alive, item)
+		}
+	}
+	for k := len(alive); k < len(pool.conns); k++ {
+		pool.conns[k] = nil
+	}
+	pool.conns = alive
+
+	for _, item := range pool.conns {
+		if conn == nil || item.inflight() < conn.inflight() {
+			conn = item
+		}
+	}
+	full = len(pool.conns) >= global.Config().Service.Upstream.PoolSize
+	return
+}
+
+// 支持管道化查询的连接，响应按消息ID分发，允许乱序返回
+type pipelineConn struct {
+	conn *dns.Conn
+
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	pending    map[uint16]chan *dns.Msg
+	closed     bool
+}
+
+// 新建管道化连接并启动读取协程
+func newPipelineConn(conn net.Conn) *pipelineConn {
+	pc := &pipelineConn{
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	go pc.readLoop()
+	return pc
+}
+
+// 连接是否已关闭
+func (pc *pipelineConn) isClosed() bool {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.closed
+}
+
+// 等待响应的查询数量
+func (pc *pipelineConn) inflight() int {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return len(pc.pending)
+}
+
+// 发送查询并等待对应的响应
+func (pc *pipelineConn) exchange(ctx context.Context, reqMsg *dns.Msg) (*dns.Msg, error) {
+	var (
+		id     uint16
+		result = make(chan *dns.Msg, 1)
+		msg    = reqMsg.Copy()
+	)
+
+	// 分配一个在当前连接中唯一的消息ID
+	pc.mutex.Lock()
+	if pc.closed {
+		pc.mutex.Unlock()
+		return nil, errConnClosed
+	}
+	for {
+		id = uint16(rand.Intn(0x10000)) //nolint:gosec
+		if _, exist := pc.pending[id]; !exist {
+			break
+		}
+	}
+	pc.pending[id] = result
+	pc.mutex.Unlock()
+	msg.Id = id
+
+	pc.writeMutex.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = pc.conn.SetWriteDeadline(deadline)
+	}
+	err := pc.conn.WriteMsg(msg)
+	pc.writeMutex.Unlock()
+	if err != nil {
+		pc.close(err)
+		return nil, errConnClosed
+	}
+	// 延长读取的超时时间，避免等待响应期间连接被判定为空闲
+	_ = pc.conn.SetReadDeadline(time.Now().Add(poolIdleTimeout()))
+
+	select {
+	case respMsg, ok := <-result:
+		if !ok {
+			return nil, errConnClosed
+		}
+		respMsg.Id = reqMsg.Id
+		return respMsg, nil
+	case <-ctx.Done():
+		pc.mutex.Lock()
+		delete(pc.pending, id)
+		pc.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// 读取响应并按消息ID分发给等待的查询
+func (pc *pipelineConn) readLoop() {
+	_ = pc.conn.SetReadDeadline(time.Now().Add(poolIdleTimeout()))
+	for {
+		respMsg, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.close(err)
+			return
+		}
+		pc.mutex.Lock()
+		result, exist := pc.pending[respMsg.Id]
+		delete(pc.pending, respMsg.Id)
+		pc.mutex.Unlock()
+		if exist {
+			result <- respMsg
+		}
+	}
+}
+
+// 关闭连接，并通知所有等待中的查询
+func (pc *pipelineConn) close(err error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	if !errors.Is(err, net.ErrClosed) {
+		log.Debug().Err(err).Caller().Msg("上游连接已断开")
+	}
+	for id, result := range pc.pending {
+		close(result)
+		delete(pc.pending, id)
+	}
+	if closeErr := pc.conn.Close(); closeErr != nil {
+		log.Debug().Err(closeErr).Caller().Msg("关闭上游连接失败")
+	}
+}
+
+// 连接的空闲超时时间
+func poolIdleTimeout() time.Duration {
+	return time.Duration(global.Config().Service.Upstream.IdleTimeout) * time.Second
+}
+
+// 获取DoH查询使用的共享HTTP客户端，地址以h3://开头时使用HTTP/3，同时返回实际请求的URL
+func dohClient(addr string, proxy string) (client *http.Client, reqURL string, err error) {
+	h3 := strings.HasPrefix(addr, "h3://")
+	if h3 {
+		reqURL = "https://" + strings.TrimPrefix(addr, "h3://")
+	} else {
+		reqURL = addr
+	}
+
+	key := "h2|" + proxy
+	if h3 {
+		key = "h3|" + proxy
+	}
+	if value, ok := dohClients.Load(key); ok {
+		return value.(*http.Client), reqURL, nil
+	}
+
+	dohClientMu.Lock()
+	defer dohClientMu.Unlock()
+	if value, ok := dohClients.Load(key); ok {
+		return value.(*http.Client), reqURL, nil
+	}
+
+	client = new(http.Client)
+	if h3 {
+		client.Transport = newHTTP3Transport(proxy)
+	} else {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = global.Config().Service.Upstream.PoolSize
+		transport.IdleConnTimeout = poolIdleTimeout()
+		transport.ForceAttemptHTTP2 = true
+		if proxy != "" {
+			var proxyURL *url.URL
+			proxyURL, err = url.Parse(proxy)
+			if err != nil {
+				return nil, reqURL, err
+			}
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+		client.Transport = transport
+	}
+	dohClients.Store(key, client)
+	return client, reqURL, nil
+}
+
+// 新建HTTP/3传输层，只有SOCKS5代理支持转发HTTP/3
+func newHTTP3Transport(proxy string) *http3.Transport {
+	transport := &http3.Transport{
+		TLSClientConfig: upstreamTLSConfig(),
+		QUICConfig: &quic.Config{
+			MaxIdleTimeout: poolIdleTimeout(),
+		},
+	}
+	if proxy != "" {
+		transport.Dial = func(ctx context.Context, hostAddr string, tlsConfig *tls.Config, quicConfig *quic.Config) (*quic.Conn, error) {
+			conn, closer, err := dialQUIC(ctx, hostAddr, tlsConfig, quicConfig, proxy)
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				<-conn.Context().Done()
+				closer()
+			}()
+			return conn, nil
+		}
+	}
+	return transport
+}
+
+// 获取到上游DoQ服务的QUIC连接
+func getQUICConn(addr string, proxy string) *quicConn {
+	key := addr + "|" + proxy
+	if conn, ok := quicConns.Load(key); ok {
+		return conn.(*quicConn)
+	}
+	conn, _ := quicConns.LoadOrStore(key, &quicConn{addr: addr, proxy: proxy})
+	return conn.(*quicConn)
+}
+
+// 到上游DoQ服务的QUIC连接，每个上游复用同一个连接，每个查询使用一个新的流(RFC 9250)
+type quicConn struct {
+	addr  string
+	proxy string
+
+	mutex sync.Mutex
+	conn  *quic.Conn
+}
+
+// 打开一个新的流，连接不存在或已关闭时重新建立连接，同时返回流所在的连接
+func (c *quicConn) openStream(ctx context.Context) (*quic.Conn, *quic.Stream, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		c.drop(conn)
+		return nil, nil, err
+	}
+	return conn, stream, nil
+}
+
+// 获取已建立的连接，同一时间只建立一个新连接
+func (c *quicConn) get(ctx context.Context) (*quic.Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != nil && c.conn.Context().Err() == nil {
+		return c.conn, nil
+	}
+
+	tlsConfig := upstreamTLSConfig()
+	tlsConfig.NextProtos = []string{doqALPN}
+	tlsConfig.ServerName, _, _ = net.SplitHostPort(c.addr)
+	conn, closer, err := dialQUIC(ctx, c.addr, tlsConfig, &quic.Config{MaxIdleTimeout: poolIdleTimeout()}, c.proxy)
+	if err != nil {
+		return nil, err
+	}
+	// 连接空闲超时或被上游关闭后释放占用的资源
+	go func() {
+		<-conn.Context().Done()
+		closer()
+	}()
+	c.conn = conn
+	return conn, nil
+}
+
+// 丢弃出错的连接，之后的查询重新建立连接
+func (c *quicConn) drop(conn *quic.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == conn {
+		c.conn = nil
+		_ = conn.CloseWithError(doqNoError, "")
+	}
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+)
+
+// 本地的TCP DNS服务，每个连接由handle函数处理，index为连接的序号
+type fakeTCPDNS struct {
+	listener net.Listener
+	accepted atomic.Int32
+}
+
+func startTCPDNS(t *testing.T, handle func(index int, conn *dns.Conn)) *fakeTCPDNS {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeTCPDNS{listener: listener}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			index := int(server.accepted.Add(1)) - 1
+			go func() {
+				defer conn.Close()
+				handle(index, &dns.Conn{Conn: conn})
+			}()
+		}
+	}()
+	return server
+}
+
+func (server *fakeTCPDNS) addr() string {
+	return server.listener.Addr().String()
+}
+
+// 逐个响应收到的查询
+func serveTCPDNS(conn *dns.Conn) {
+	for {
+		reqMsg, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		_ = conn.WriteMsg(answerMsg(reqMsg))
+	}
+}
+
+// 以查询的名称构造A记录响应，用于核对响应是否对应查询
+func answerMsg(reqMsg *dns.Msg) *dns.Msg {
+	respMsg := new(dns.Msg)
+	respMsg.SetReply(reqMsg)
+	rr, _ := dns.NewRR(reqMsg.Question[0].Name + " 60 IN A 10.0.0.1")
+	respMsg.Answer = append(respMsg.Answer, rr)
+	return respMsg
+}
+
+// 构造消息ID固定的查询
+func poolQuery(name string) *dns.Msg {
+	reqMsg := new(dns.Msg)
+	reqMsg.SetQuestion(name, dns.TypeA)
+	reqMsg.Id = 1
+	return reqMsg
+}
+
+// 核对响应的消息ID已还原并且对应查询的名称，可在其它协程中调用
+func checkPoolResp(t *testing.T, name string, respMsg *dns.Msg, err error) {
+	t.Helper()
+	if err != nil {
+		t.Error(name, err)
+		return
+	}
+	if respMsg.Id != 1 || len(respMsg.Answer) != 1 || respMsg.Answer[0].Header().Name != name {
+		t.Error("响应与查询不对应", name, respMsg)
+	}
+}
+
+// 等待条件成立
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 连接池中的连接数量及等待响应的查询总数
+func poolStat(pool *connPool) (conns int, inflight int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, conn := range pool.conns {
+		inflight += conn.inflight()
+	}
+	return len(pool.conns), inflight
+}
+
+func setPoolConfig(poolSize int, idleTimeout uint) {
+	conf := new(global.Configuration)
+	conf.Service.Upstream.PoolSize = poolSize
+	conf.Service.Upstream.IdleTimeout = idleTimeout
+	global.SetConfig(conf)
+}
+
+// 测试同一连接上的管道化查询重新分配消息ID，并能处理乱序的响应
+func TestPipelineOutOfOrder(t *testing.T) {
+	setPoolConfig(1, 30)
+	defer global.SetConfig(nil)
+
+	names := []string{"a.pool.test.", "b.pool.test.", "c.pool.test."}
+	ids := make(chan map[uint16]struct{}, 1)
+	server := startTCPDNS(t, func(_ int, conn *dns.Conn) {
+		// 收齐所有查询后按相反的顺序响应
+		var reqMsgs []*dns.Msg
+		seen := make(map[uint16]struct{})
+		for range names {
+			reqMsg, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			reqMsgs = append(reqMsgs, reqMsg)
+			seen[reqMsg.Id] = struct{}{}
+		}
+		ids <- seen
+		for k := len(reqMsgs) - 1; k >= 0; k-- {
+			_ = conn.WriteMsg(answerMsg(reqMsgs[k]))
+		}
+	})
+	pool := &connPool{netType: "tcp", addr: server.addr()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Go(func() {
+			respMsg, err := pool.Exchange(ctx, poolQuery(name))
+			checkPoolResp(t, name, respMsg, err)
+		})
+	}
+	wg.Wait()
+	if seen := <-ids; len(seen) != len(names) {
+		t.Fatal("同一连接上的查询使用了重复的消息ID", seen)
+	}
+	if server.accepted.Load() != 1 {
+		t.Fatal("查询未复用同一连接", server.accepted.Load())
+	}
+}
+
+// 测试上游在查询过程中关闭连接时换一个连接重试
+func TestPoolRetryAfterClose(t *testing.T) {
+	setPoolConfig(1, 30)
+	defer global.SetConfig(nil)
+
+	server := startTCPDNS(t, func(index int, conn *dns.Conn) {
+		if index == 0 {
+			// 第一个连接读取查询后直接关闭
+			_, _ = conn.ReadMsg()
+			return
+		}
+		serveTCPDNS(conn)
+	})
+	pool := &connPool{netType: "tcp", addr: server.addr()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	respMsg, err := pool.Exchange(ctx, poolQuery("retry.pool.test."))
+	checkPoolResp(t, "retry.pool.test.", respMsg, err)
+	if server.accepted.Load() != 2 {
+		t.Fatal("连接关闭后未重新建立连接", server.accepted.Load())
+	}
+	if conns, _ := poolStat(pool); conns != 1 {
+		t.Fatal("连接池未清理已关闭的连接", conns)
+	}
+
+	// 上游持续关闭连接时返回错误
+	closing := startTCPDNS(t, func(_ int, conn *dns.Conn) {
+		_, _ = conn.ReadMsg()
+	})
+	pool = &connPool{netType: "tcp", addr: closing.addr()}
+	if _, err = pool.Exchange(ctx, poolQuery("retry.pool.test.")); !errors.Is(err, errConnClosed) {
+		t.Fatal("重试后仍失败时返回的错误错误", err)
+	}
+	if closing.accepted.Load() != 2 {
+		t.Fatal("重试次数错误", closing.accepted.Load())
+	}
+}
+
+// 测试等待响应时取消查询，之后到达的响应被丢弃，连接仍可继续使用
+func TestPipelineCancel(t *testing.T) {
+	setPoolConfig(1, 30)
+	defer global.SetConfig(nil)
+
+	server := startTCPDNS(t, func(_ int, conn *dns.Conn) {
+		// 收到第二个查询后才响应第一个查询
+		first, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		second, err := conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		_ = conn.WriteMsg(answerMsg(first))
+		_ = conn.WriteMsg(answerMsg(second))
+	})
+	pool := &connPool{netType: "tcp", addr: server.addr()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Exchange(ctx, poolQuery("cancel.pool.test.")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("取消查询时返回的错误错误", err)
+	}
+	if _, inflight := poolStat(pool); inflight != 0 {
+		t.Fatal("取消的查询未从等待列表中移除", inflight)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	respMsg, err := pool.Exchange(ctx, poolQuery("next.pool.test."))
+	checkPoolResp(t, "next.pool.test.", respMsg, err)
+	if server.accepted.Load() != 1 {
+		t.Fatal("取消查询后未复用连接", server.accepted.Load())
+	}
+}
+
+// 测试连接数量不超过连接池上限，达到上限后复用排队最少的连接
+func TestPoolSize(t *testing.T) {
+	setPoolConfig(2, 30)
+	defer global.SetConfig(nil)
+
+	release := make(chan struct{})
+	server := startTCPDNS(t, func(_ int, conn *dns.Conn) {
+		for {
+			reqMsg, err := conn.ReadMsg()
+			if err != nil {
+				return
+			}
+			<-release
+			_ = conn.WriteMsg(answerMsg(reqMsg))
+		}
+	})
+	pool := &connPool{netType: "tcp", addr: server.addr()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for k, name := range []string{"a.pool.test.", "b.pool.test.", "c.pool.test."} {
+		wg.Go(func() {
+			respMsg, err := pool.Exchange(ctx, poolQuery(name))
+			checkPoolResp(t, name, respMsg, err)
+		})
+		// 等待查询发出后再发起下一个查询，使连接的分配结果确定
+		waitFor(t, func() bool {
+			_, inflight := poolStat(pool)
+			return inflight == k+1
+		})
+		if conns, _ := poolStat(pool); conns != min(k+1, 2) {
+			t.Fatal("连接数量错误", k, conns)
+		}
+	}
+	close(release)
+	wg.Wait()
+	if server.accepted.Load() != 2 {
+		t.Fatal("连接数量超过连接池上限", server.accepted.Load())
+	}
+}
+
+// 测试空闲超时后连接被关闭并从连接池中移除
+func TestPoolIdleTimeout(t *testing.T) {
+	setPoolConfig(1, 1)
+	defer global.SetConfig(nil)
+
+	server := startTCPDNS(t, func(_ int, conn *dns.Conn) {
+		serveTCPDNS(conn)
+	})
+	pool := &connPool{netType: "tcp", addr: server.addr()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	respMsg, err := pool.Exchange(ctx, poolQuery("idle.pool.test."))
+	checkPoolResp(t, "idle.pool.test.", respMsg, err)
+
+	pool.mutex.Lock()
+	conn := pool.conns[0]
+	pool.mutex.Unlock()
+	waitFor(t, conn.isClosed)
+
+	respMsg, err = pool.Exchange(ctx, poolQuery("idle.pool.test."))
+	checkPoolResp(t, "idle.pool.test.", respMsg, err)
+	if server.accepted.Load() != 2 {
+		t.Fatal("空闲连接关闭后未重新建立连接", server.accepted.Load())
+	}
+	if conns, _ := poolStat(pool); conns != 1 {
+		t.Fatal("连接池未移除空闲超时的连接", conns)
+	}
+}
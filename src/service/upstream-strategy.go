@@ -0,0 +1,174 @@
+package service
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"local/global"
+	"local/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// 上游服务的负载均衡策略
+const (
+	StrategySequential = "sequential"
+	StrategyRoundRobin = "round_robin"
+	StrategyRandom     = "random"
+	StrategyFastest    = "fastest"
+	StrategyParallel   = "parallel"
+)
+
+// 查询失败时计入的响应耗时
+const failedLatency = 5 * time.Second
+
+// 上游服务的运行状态
+type upstreamState struct {
+	addr    string
+	latency int64 // 响应耗时的移动平均值(纳秒)，为0表示还未查询过
+
+	mutex     sync.RWMutex
+	down      bool      // 是否已熔断
+	failures  int       // 连续失败次数
+	lastCheck time.Time // 最后一次健康探测的时间
+	lastError string    // 最后一次查询失败的错误信息
+}
+
+var (
+	upstreamStates   sync.Map // 上游服务地址 -> *upstreamState
+	roundRobinCursor sync.Map // 上游服务地址列表 -> *uint32
+)
+
+// 获取上游服务的运行状态
+func getUpstreamState(addr string) *upstreamState {
+	if state, ok := upstreamStates.Load(addr); ok {
+		return state.(*upstreamState)
+	}
+	state, _ := upstreamStates.LoadOrStore(addr, &upstreamState{addr: addr})
+	return state.(*upstreamState)
+}
+
+// 记录一次查询的响应耗时，使用指数加权移动平均
+func (state *upstreamState) observe(elapsed time.Duration, err error) {
+	if err != nil {
+		elapsed = failedLatency
+		state.fail(err)
+	} else {
+		state.succeed()
+	}
+	for {
+		old := atomic.LoadInt64(&state.latency)
+		latency := int64(elapsed)
+		if old > 0 {
+			latency = old + (latency-old)/4
+		}
+		if atomic.CompareAndSwapInt64(&state.latency, old, latency) {
+			return
+		}
+	}
+}
+
+// 获取平均响应耗时
+func (state *upstreamState) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&state.latency))
+}
+
+// 按负载均衡策略对上游服务地址排序，返回新的切片
+func orderAddrs(addrs []string) []string {
+	result := make([]string, len(addrs))
+	copy(result, addrs)
+	if len(result) < 2 {
+		return result
+	}
+
+	switch global.Config().Service.Upstream.Strategy {
+	case StrategyRoundRobin, StrategyParallel:
+		key := strings.Join(addrs, ",")
+		cursor, ok := roundRobinCursor.Load(key)
+		if !ok {
+			cursor, _ = roundRobinCursor.LoadOrStore(key, new(uint32))
+		}
+		offset := int((atomic.AddUint32(cursor.(*uint32), 1) - 1) % uint32(len(addrs)))
+		copy(result, addrs[offset:])
+		copy(result[len(addrs)-offset:], addrs[:offset])
+	case StrategyRandom:
+		rand.Shuffle(len(result), func(i, j int) {
+			result[i], result[j] = result[j], result[i]
+		})
+	case StrategyFastest:
+		sort.SliceStable(result, func(i, j int) bool {
+			return getUpstreamState(result[i]).Latency() < getUpstreamState(result[j]).Latency()
+		})
+	}
+	return result
+}
+
+// 向上游服务查询并记录响应耗时
+func (upstream *Upstream) exchange(addr string) (respMsg *dns.Msg, err error) {
+	begin := time.Now()
+	respMsg, err = upstream.queryAddr(addr)
+	elapsed := time.Since(begin)
+	getUpstreamState(addr).observe(elapsed, err)
+	metrics.ObserveUpstream(addr, elapsed, err)
+	if err == nil {
+		upstream.Addr = addr
+	}
+	return
+}
+
+// 同时向多个上游服务查询，使用最先收到的有效响应
+func (upstream *Upstream) race(addrs []string) (respMsg *dns.Msg, err error) {
+	type result struct {
+		addr    string
+		respMsg *dns.Msg
+		err     error
+	}
+
+	count := global.Config().Service.Upstream.Parallel
+	if count > len(addrs) {
+		count = len(addrs)
+	}
+	results := make(chan result, count)
+	for k := 0; k < count; k++ {
+		sub := Upstream{
+			MethodByDoT: upstream.MethodByDoT,
+			ReqMsg:      upstream.ReqMsg.Copy(),
+		}
+		go func(addr string) {
+			r := result{addr: addr}
+			r.respMsg, r.err = sub.exchange(addr)
+			results <- r
+		}(addrs[k])
+	}
+
+	for k := 0; k < count; k++ {
+		r := <-results
+		if r.err != nil {
+			if respMsg == nil {
+				err = r.err
+			}
+			continue
+		}
+		respMsg, err = r.respMsg, nil
+		upstream.Addr = r.addr
+		if r.respMsg.Rcode != dns.RcodeServerFailure && r.respMsg.Rcode != dns.RcodeRefused {
+			return
+		}
+	}
+	if respMsg != nil {
+		return
+	}
+
+	// 全部失败时依次查询剩余的上游服务
+	for k := count; k < len(addrs); k++ {
+		respMsg, err = upstream.exchange(addrs[k])
+		if err == nil {
+			return
+		}
+	}
+	return
+}
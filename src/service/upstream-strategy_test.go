@@ -0,0 +1,99 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"local/global"
+)
+
+// 清空上游服务的状态及轮询位置，避免重复运行测试时受上一次的影响
+func resetUpstreamStates() {
+	upstreamStates.Clear()
+	roundRobinCursor.Clear()
+}
+
+// 测试各负载均衡策略对上游服务地址的排序
+func TestOrderAddrs(t *testing.T) {
+	resetUpstreamStates()
+	defer global.SetConfig(nil)
+
+	// fastest策略按平均响应耗时排序，地址只在本测试中使用，避免与其它测试共享状态
+	getUpstreamState("udp://fastest-a:53").observe(30*time.Millisecond, nil)
+	getUpstreamState("udp://fastest-b:53").observe(10*time.Millisecond, nil)
+	getUpstreamState("udp://fastest-c:53").observe(20*time.Millisecond, nil)
+
+	for _, item := range []struct {
+		strategy string
+		addrs    []string
+		want     [][]string // 连续调用时每次的结果
+	}{
+		{
+			strategy: StrategySequential,
+			addrs:    []string{"udp://seq-a:53", "udp://seq-b:53"},
+			want:     [][]string{{"udp://seq-a:53", "udp://seq-b:53"}, {"udp://seq-a:53", "udp://seq-b:53"}},
+		},
+		{
+			strategy: StrategyRoundRobin,
+			addrs:    []string{"udp://rr-a:53", "udp://rr-b:53", "udp://rr-c:53"},
+			want: [][]string{
+				{"udp://rr-a:53", "udp://rr-b:53", "udp://rr-c:53"},
+				{"udp://rr-b:53", "udp://rr-c:53", "udp://rr-a:53"},
+				{"udp://rr-c:53", "udp://rr-a:53", "udp://rr-b:53"},
+				{"udp://rr-a:53", "udp://rr-b:53", "udp://rr-c:53"},
+			},
+		},
+		{
+			strategy: StrategyParallel,
+			addrs:    []string{"udp://par-a:53", "udp://par-b:53"},
+			want:     [][]string{{"udp://par-a:53", "udp://par-b:53"}, {"udp://par-b:53", "udp://par-a:53"}},
+		},
+		{
+			strategy: StrategyFastest,
+			addrs:    []string{"udp://fastest-a:53", "udp://fastest-b:53", "udp://fastest-c:53"},
+			want:     [][]string{{"udp://fastest-b:53", "udp://fastest-c:53", "udp://fastest-a:53"}},
+		},
+		{
+			strategy: StrategyRoundRobin,
+			addrs:    []string{"udp://single:53"},
+			want:     [][]string{{"udp://single:53"}, {"udp://single:53"}},
+		},
+	} {
+		conf := new(global.Configuration)
+		conf.Service.Upstream.Strategy = item.strategy
+		global.SetConfig(conf)
+		for k, want := range item.want {
+			if result := orderAddrs(item.addrs); !slices.Equal(result, want) {
+				t.Fatal("排序结果错误", item.strategy, k, result)
+			}
+		}
+	}
+}
+
+// 测试random策略只打乱顺序，不修改传入的切片
+func TestOrderAddrsRandom(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Service.Upstream.Strategy = StrategyRandom
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	addrs := []string{"udp://random-a:53", "udp://random-b:53", "udp://random-c:53", "udp://random-d:53"}
+	original := slices.Clone(addrs)
+	orders := make(map[string]struct{})
+	for range 100 {
+		result := orderAddrs(addrs)
+		if !slices.Equal(addrs, original) {
+			t.Fatal("修改了传入的切片")
+		}
+		sorted := slices.Clone(result)
+		slices.Sort(sorted)
+		if !slices.Equal(sorted, original) {
+			t.Fatal("结果不是原地址的排列", result)
+		}
+		orders[result[0]] = struct{}{}
+	}
+	if len(orders) < 2 {
+		t.Fatal("random策略未打乱顺序")
+	}
+}
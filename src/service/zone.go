@@ -0,0 +1,257 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"local/global"
+	"local/storage"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// 区域SOA记录的默认参数
+const (
+	zoneDefaultTTL     = 3600
+	zoneDefaultRefresh = 3600
+	zoneDefaultRetry   = 600
+	zoneDefaultExpire  = 604800
+	zoneDefaultMinTTL  = 60
+)
+
+// 内部域名后缀对应的区域
+type zone struct {
+	apex    string   // 区域的顶点域名
+	ns      []string // 权威服务器域名
+	mbox    string   // 管理员邮箱
+	ttl     uint32   // SOA及NS记录的TTL
+	refresh uint32
+	retry   uint32
+	expire  uint32
+	minTTL  uint32
+	flatten bool    // 顶点域名的CNAME记录是否展开为目标的记录(ALIAS)
+	serial  *uint32 // 自动生成的SOA记录的序列号，存储器中没有顶点的SOA记录时使用，重载配置时保留
+}
+
+// 当前的区域列表，key为顶点域名
+var zones atomic.Pointer[map[string]*zone]
+
+// 每个区域修改记录时使用的锁，key为顶点域名，重载配置时保留
+var zoneLocks sync.Map
+
+// 区域修改记录时使用的锁，同一区域的修改依次执行，避免并发修改时丢失序列号的递增
+func zoneLock(apex string) *sync.Mutex {
+	lock, _ := zoneLocks.LoadOrStore(apex, new(sync.Mutex))
+	return lock.(*sync.Mutex)
+}
+
+// 按当前配置构建每个内部域名后缀的区域，已有区域的序列号保持不变
+func setupZones() {
+	conf := global.Config()
+	result := make(map[string]*zone, len(conf.Service.InternalSuffix))
+	old := zones.Load()
+
+	for k := range conf.Service.InternalSuffix {
+		apex := zoneApex(conf.Service.InternalSuffix[k])
+		z := &zone{
+			apex:    apex,
+			ns:      []string{"ns1." + apex},
+			mbox:    "hostmaster." + apex,
+			ttl:     zoneDefaultTTL,
+			refresh: zoneDefaultRefresh,
+			retry:   zoneDefaultRetry,
+			expire:  zoneDefaultExpire,
+			minTTL:  zoneDefaultMinTTL,
+		}
+		if apex == "." {
+			z.ns = []string{"ns1."}
+			z.mbox = "hostmaster."
+		}
+		for i := range conf.Service.Zones {
+			item := conf.Service.Zones[i]
+			if zoneApex(item.Suffix) != apex {
+				continue
+			}
+			if len(item.NS) > 0 {
+				z.ns = item.NS
+			}
+			if item.Mbox != "" {
+				z.mbox = item.Mbox
+			}
+			if item.TTL > 0 {
+				z.ttl = item.TTL
+			}
+			if item.Refresh > 0 {
+				z.refresh = item.Refresh
+			}
+			if item.Retry > 0 {
+				z.retry = item.Retry
+			}
+			if item.Expire > 0 {
+				z.expire = item.Expire
+			}
+			if item.MinTTL > 0 {
+				z.minTTL = item.MinTTL
+			}
+			z.flatten = item.Flatten
+		}
+		if old != nil {
+			if oldZone, exist := (*old)[apex]; exist {
+				z.serial = oldZone.serial
+			}
+		}
+		if z.serial == nil {
+			// 以启动时间作为初始序列号，修改记录后序列号随SOA记录保存在存储器中
+			serial := uint32(time.Now().Unix())
+			z.serial = &serial
+		}
+		result[apex] = z
+		log.Info().Str("zone", apex).Strs("ns", z.ns).Uint32("serial", atomic.LoadUint32(z.serial)).Msg("启用内部区域")
+	}
+	zones.Store(&result)
+}
+
+// 由内部域名后缀得到区域的顶点域名
+func zoneApex(suffix string) string {
+	apex := strings.TrimPrefix(strings.ToLower(suffix), ".")
+	return dns.Fqdn(apex)
+}
+
+// 查找域名所属的区域，有多个匹配时使用顶点域名最长的区域
+func findZone(name string) (result *zone) {
+	list := zones.Load()
+	if list == nil {
+		return nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for apex, z := range *list {
+		if !dns.IsSubDomain(apex, name) {
+			continue
+		}
+		if result == nil || len(apex) > len(result.apex) {
+			result = z
+		}
+	}
+	return
+}
+
+// 修改内部域名的记录，修改成功后递增所属区域的序列号
+// 序列号保存在存储器中顶点的SOA记录里，存储器中没有SOA记录时写入自动生成的记录，重启后序列号不会变小
+// 存储器自身已递增序列号(区域文件)或修改的就是SOA记录时不再递增
+func changeZone(ctx context.Context, name string, change func() error) error {
+	z := findZone(name)
+	if z == nil {
+		return change()
+	}
+	lock := zoneLock(z.apex)
+	lock.Lock()
+	defer lock.Unlock()
+
+	before, err := z.storedSOA(ctx)
+	if err != nil {
+		return err
+	}
+	if err = change(); err != nil {
+		return err
+	}
+	after, err := z.storedSOA(ctx)
+	if err != nil {
+		log.Err(err).Caller().Str("zone", z.apex).Msg("查询区域的SOA记录失败，未递增序列号")
+		return nil
+	}
+
+	var next *dns.SOA
+	switch {
+	case before == nil && after == nil:
+		next = z.SOA()
+		next.Serial = atomic.AddUint32(z.serial, 1)
+	case before != nil && after != nil && before.Serial == after.Serial:
+		next = dns.Copy(after).(*dns.SOA)
+		next.Serial++
+		if err = storage.Storage().Del(ctx, after); err != nil {
+			log.Err(err).Caller().Str("zone", z.apex).Msg("删除区域旧的SOA记录失败，未递增序列号")
+			return nil
+		}
+	default:
+		return nil
+	}
+	if err = storage.Storage().Set(ctx, next); err != nil {
+		log.Err(err).Caller().Str("zone", z.apex).Uint32("serial", next.Serial).Msg("保存区域的SOA记录失败")
+	}
+	return nil
+}
+
+// 存储器中区域顶点的SOA记录，没有时返回nil
+func (z *zone) storedSOA(ctx context.Context) (*dns.SOA, error) {
+	if storage.Storage() == nil {
+		return nil, nil
+	}
+	rr, err := storage.Storage().Get(ctx, dns.Question{Name: z.apex, Qtype: dns.TypeSOA, Qclass: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range rr {
+		if soa, ok := item.(*dns.SOA); ok {
+			return soa, nil
+		}
+	}
+	return nil, nil
+}
+
+// 区域的SOA记录
+func (z *zone) SOA() *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   z.apex,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    z.ttl,
+		},
+		Ns:      z.ns[0],
+		Mbox:    z.mbox,
+		Serial:  atomic.LoadUint32(z.serial),
+		Refresh: z.refresh,
+		Retry:   z.retry,
+		Expire:  z.expire,
+		Minttl:  z.minTTL,
+	}
+}
+
+// 否定应答的权威节点中使用的SOA记录，存储器中有区域顶点的SOA记录时使用该记录，否则使用自动生成的记录
+// TTL取SOA的TTL与MINIMUM中较小的值(RFC 2308)
+func (z *zone) negativeSOA(ctx context.Context) *dns.SOA {
+	soa, err := z.storedSOA(ctx)
+	if err != nil {
+		log.Warn().Err(err).Caller().Str("zone", z.apex).Msg("查询区域的SOA记录失败，使用自动生成的记录")
+	}
+	if soa == nil {
+		soa = z.SOA()
+	} else {
+		soa = dns.Copy(soa).(*dns.SOA)
+	}
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// 区域的NS记录
+func (z *zone) NS() []dns.RR {
+	result := make([]dns.RR, 0, len(z.ns))
+	for k := range z.ns {
+		result = append(result, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   z.apex,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    z.ttl,
+			},
+			Ns: z.ns[k],
+		})
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"local/global"
+	"local/storage"
+
+	"github.com/miekg/dns"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// 测试区域的查找、自动生成的SOA记录及序列号递增
+func TestZone(t *testing.T) {
+	conf := new(global.Configuration)
+	err := toml.Unmarshal([]byte(`
+[service]
+internalSuffix = ["internal.", "sub.internal."]
+[[service.zones]]
+suffix = "sub.internal."
+ns = ["dns.sub.internal."]
+minTTL = 30
+`), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+	setupZones()
+
+	z := findZone("a.SUB.internal.")
+	if z == nil || z.apex != "sub.internal." {
+		t.Fatal("未匹配到最长的区域")
+	}
+	if z.NS()[0].(*dns.NS).Ns != "dns.sub.internal." {
+		t.Fatal("未使用配置的NS记录")
+	}
+	if ttl := z.negativeSOA(t.Context()).Hdr.Ttl; ttl != 30 {
+		t.Fatal("否定应答的SOA记录TTL错误", ttl)
+	}
+	if findZone("example.com.") != nil {
+		t.Fatal("匹配到了非内部域名的区域")
+	}
+
+	if findZone("internal.").SOA().Mbox != "hostmaster.internal." {
+		t.Fatal("自动生成的SOA记录错误")
+	}
+}
+
+// 测试修改记录后递增序列号，序列号保存在存储器的SOA记录中，重启后继续递增
+func TestZoneSerial(t *testing.T) {
+	setupInternal(t, `
+[service]
+internalSuffix = ["sub.internal."]
+`)
+	z := findZone("sub.internal.")
+	serial := z.SOA().Serial
+
+	change := func(str string) {
+		rr, _ := dns.NewRR(str)
+		if err := changeZone(t.Context(), rr.Header().Name, func() error {
+			return storage.Storage().Set(t.Context(), rr)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func() uint32 {
+		rr, err := storage.Storage().Get(t.Context(), dns.Question{Name: "sub.internal.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET})
+		if err != nil || len(rr) != 1 {
+			t.Fatal("存储器中的SOA记录错误", rr, err)
+		}
+		return rr[0].(*dns.SOA).Serial
+	}
+
+	change("a.sub.internal. 60 IN A 10.0.0.1")
+	if stored() != serial+1 || z.SOA().Serial != serial+1 {
+		t.Fatal("首次修改后未保存递增的序列号", stored())
+	}
+	change("b.sub.internal. 60 IN A 10.0.0.2")
+	if stored() != serial+2 {
+		t.Fatal("未递增存储器中的序列号", stored())
+	}
+
+	// 重启后按存储器中的序列号继续递增
+	zones.Store(nil)
+	setupZones()
+	change("c.sub.internal. 60 IN A 10.0.0.3")
+	if stored() != serial+3 {
+		t.Fatal("重启后序列号错误", stored())
+	}
+
+	// 重载后保留自动生成的SOA记录的序列号
+	serial = findZone("sub.internal.").SOA().Serial
+	setupZones()
+	if findZone("sub.internal.").SOA().Serial != serial {
+		t.Fatal("重载后序列号改变")
+	}
+
+	// 修改SOA记录本身时使用写入的序列号
+	rr, _ := dns.NewRR("sub.internal. 60 IN SOA ns1.sub.internal. hostmaster.sub.internal. 1 3600 600 604800 60")
+	if err := changeZone(t.Context(), "sub.internal.", func() error {
+		soa, _ := storage.Storage().Get(t.Context(), dns.Question{Name: "sub.internal.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET})
+		if err := storage.Storage().Del(t.Context(), soa[0]); err != nil {
+			return err
+		}
+		return storage.Storage().Set(t.Context(), rr)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stored() != 1 {
+		t.Fatal("修改SOA记录时递增了序列号", stored())
+	}
+}
+
+// 测试同一区域并发修改记录时每次修改都递增序列号
+func TestZoneSerialConcurrent(t *testing.T) {
+	setupInternal(t, `
+[service]
+internalSuffix = ["sub.internal."]
+`)
+	first, _ := dns.NewRR("first.sub.internal. 60 IN A 10.0.0.1")
+	if err := changeZone(t.Context(), "first.sub.internal.", func() error {
+		return storage.Storage().Set(t.Context(), first)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	soa, err := findZone("sub.internal.").storedSOA(t.Context())
+	if err != nil || soa == nil {
+		t.Fatal("存储器中没有SOA记录", err)
+	}
+
+	const count = 20
+	var wg sync.WaitGroup
+	for k := range count {
+		wg.Go(func() {
+			rr, _ := dns.NewRR(fmt.Sprintf("host%d.sub.internal. 60 IN A 10.0.1.%d", k, k))
+			if err := changeZone(t.Context(), rr.Header().Name, func() error {
+				return storage.Storage().Set(t.Context(), rr)
+			}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	after, err := findZone("sub.internal.").storedSOA(t.Context())
+	if err != nil || after == nil || after.Serial != soa.Serial+count {
+		t.Fatal("并发修改时丢失了序列号的递增", soa.Serial, after, err)
+	}
+}
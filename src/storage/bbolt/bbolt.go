@@ -0,0 +1,367 @@
+package bbolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"local/global"
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// 清理过期记录的间隔
+const cleanInterval = time.Second
+
+var (
+	recordsBucket = []byte("records") // 记录的键 -> 记录
+	nodesBucket   = []byte("nodes")   // 域名:类别 -> 该域名及其子域名的记录数，用于判断空非终端节点
+	expiresBucket = []byte("expires") // 过期时间(8字节)+记录的键 -> 空，按过期时间排序
+)
+
+type BBolt struct {
+	config *Config
+	db     *bbolt.DB
+	done   chan struct{}
+	once   sync.Once
+}
+
+type Config struct {
+	Path    string `json:"path"`
+	Timeout uint16 `json:"timeout,omitempty"`
+}
+
+// 存储的记录，字段与Redis存储器的哈希字段一致
+type record struct {
+	Name    string `json:"r_name"`
+	Class   string `json:"r_class"`
+	Type    string `json:"r_type"`
+	TTL     uint32 `json:"r_ttl"`
+	Data    string `json:"r_data"`
+	Expires int64  `json:"r_expires,omitempty"`
+}
+
+func New(config *Config) (*BBolt, error) {
+	var (
+		err  error
+		inst BBolt
+	)
+	if config.Path == "" {
+		return nil, errors.New("path参数值不能为空")
+	}
+	inst.config = config
+	if inst.config.Timeout == 0 {
+		inst.config.Timeout = 5
+	}
+	// 数据库文件被其它进程锁定时，等待超时后返回错误
+	inst.db, err = bbolt.Open(config.Path, 0o600, &bbolt.Options{Timeout: time.Duration(inst.config.Timeout) * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = inst.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{recordsBucket, nodesBucket, expiresBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = inst.db.Close()
+		return nil, err
+	}
+	inst.done = make(chan struct{})
+	go inst.cleanLoop()
+	return &inst, nil
+}
+
+func NewWithJSON(jsonStr string) (*BBolt, error) {
+	var (
+		err    error
+		config Config
+	)
+	err = json.Unmarshal(global.StrToBytes(jsonStr), &config)
+	if err != nil {
+		return nil, err
+	}
+	return New(&config)
+}
+
+func (inst *BBolt) Set(_ context.Context, rr dns.RR) (err error) {
+	var (
+		key     string
+		keySign string
+		value   []byte
+	)
+
+	if !strings.HasSuffix(rr.Header().Name, ".") {
+		rr.Header().Name += "."
+	}
+
+	keySign, err = global.KeySign(rr)
+	if err != nil {
+		return
+	}
+	key = recordKey(rr.Header().Name, rr.Header().Class, rr.Header().Rrtype) + keySign
+
+	item := record{
+		Name:  rr.Header().Name,
+		Class: dns.ClassToString[rr.Header().Class],
+		Type:  dns.TypeToString[rr.Header().Rrtype],
+		TTL:   rr.Header().Ttl,
+		Data:  strings.TrimPrefix(rr.String(), rr.Header().String()),
+	}
+	if expireAt := rrutil.ExpireAt(rr); !expireAt.IsZero() {
+		item.Expires = expireAt.Unix()
+	}
+	value, err = json.Marshal(item)
+	if err != nil {
+		return
+	}
+
+	err = inst.db.Update(func(tx *bbolt.Tx) error {
+		records := tx.Bucket(recordsBucket)
+		if old := records.Get([]byte(key)); old != nil {
+			// 覆盖已有的记录时移除旧的过期时间
+			var oldItem record
+			if err := json.Unmarshal(old, &oldItem); err != nil {
+				return err
+			}
+			if oldItem.Expires > 0 {
+				if err := tx.Bucket(expiresBucket).Delete(expireKey(oldItem.Expires, key)); err != nil {
+					return err
+				}
+			}
+		} else if err := addNodes(tx, rr.Header().Name, rr.Header().Class, 1); err != nil {
+			return err
+		}
+		if item.Expires > 0 {
+			if err := tx.Bucket(expiresBucket).Put(expireKey(item.Expires, key), nil); err != nil {
+				return err
+			}
+		}
+		return records.Put([]byte(key), value)
+	})
+	if err != nil {
+		log.Err(err).Caller().Msg("bbolt写入记录")
+	}
+	return
+}
+
+func (inst *BBolt) Get(_ context.Context, question dns.Question) (result []dns.RR, err error) {
+	if !strings.HasSuffix(question.Name, ".") {
+		question.Name += "."
+	}
+	prefix := []byte(recordKey(question.Name, question.Qclass, question.Qtype))
+	now := time.Now().Unix()
+
+	err = inst.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(recordsBucket).Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var item record
+			if err := json.Unmarshal(value, &item); err != nil {
+				return err
+			}
+			if item.Expires > 0 && item.Expires <= now {
+				continue
+			}
+			rr, err := item.RR()
+			if err != nil {
+				return err
+			}
+			result = append(result, rr)
+		}
+		return nil
+	})
+	return
+}
+
+func (inst *BBolt) Del(_ context.Context, rr dns.RR) (err error) {
+	if !strings.HasSuffix(rr.Header().Name, ".") {
+		rr.Header().Name += "."
+	}
+	keySign, err := global.KeySign(rr)
+	if err != nil {
+		return
+	}
+	key := recordKey(rr.Header().Name, rr.Header().Class, rr.Header().Rrtype) + keySign
+	return inst.db.Update(func(tx *bbolt.Tx) error {
+		return deleteRecord(tx, []byte(key))
+	})
+}
+
+func (inst *BBolt) Exists(_ context.Context, name string, class uint16) (exist bool, err error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	err = inst.db.View(func(tx *bbolt.Tx) error {
+		exist = tx.Bucket(nodesBucket).Get([]byte(nodeKey(name, class))) != nil
+		return nil
+	})
+	return
+}
+
+// 键以小写的域名开头，按域名前缀过滤时只遍历该前缀的键
+func (inst *BBolt) List(_ context.Context, opts rrutil.ListOptions) (result []dns.RR, total int, err error) {
+	prefix := []byte(strings.ToLower(opts.Prefix))
+	now := time.Now().Unix()
+
+	err = inst.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(recordsBucket).Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var item record
+			if err := json.Unmarshal(value, &item); err != nil {
+				return err
+			}
+			if item.Expires > 0 && item.Expires <= now {
+				continue
+			}
+			rr, err := item.RR()
+			if err != nil {
+				return err
+			}
+			if opts.Match(rr) {
+				result = append(result, rr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	result, total = rrutil.PageRecords(result, &opts)
+	return
+}
+
+// 检查数据库是否可用，关闭后返回bbolt.ErrDatabaseNotOpen
+func (inst *BBolt) Ping(_ context.Context) error {
+	return inst.db.View(func(*bbolt.Tx) error {
+		return nil
+	})
+}
+
+// 停止清理过期记录并关闭数据库
+func (inst *BBolt) Close() (err error) {
+	inst.once.Do(func() {
+		close(inst.done)
+		err = inst.db.Close()
+	})
+	return
+}
+
+// 定期删除过期的记录
+func (inst *BBolt) cleanLoop() {
+	ticker := time.NewTicker(cleanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-inst.done:
+			return
+		case now := <-ticker.C:
+			if err := inst.clean(now.Unix()); err != nil {
+				log.Err(err).Caller().Msg("bbolt清理过期记录")
+			}
+		}
+	}
+}
+
+// 删除过期时间不晚于now的记录
+func (inst *BBolt) clean(now int64) error {
+	var keys [][]byte
+	err := inst.db.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(expiresBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && int64(binary.BigEndian.Uint64(key[:8])) <= now; key, _ = cursor.Next() {
+			keys = append(keys, bytes.Clone(key[8:]))
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return inst.db.Update(func(tx *bbolt.Tx) error {
+		for k := range keys {
+			if err := deleteRecord(tx, keys[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 删除记录及其过期时间，并更新节点计数
+func deleteRecord(tx *bbolt.Tx, key []byte) error {
+	records := tx.Bucket(recordsBucket)
+	value := records.Get(key)
+	if value == nil {
+		return nil
+	}
+	var item record
+	if err := json.Unmarshal(value, &item); err != nil {
+		return err
+	}
+	if item.Expires > 0 {
+		if err := tx.Bucket(expiresBucket).Delete(expireKey(item.Expires, string(key))); err != nil {
+			return err
+		}
+	}
+	if err := records.Delete(key); err != nil {
+		return err
+	}
+	return addNodes(tx, item.Name, dns.StringToClass[item.Class], -1)
+}
+
+// 为域名及其所有父域名的节点计数增加delta
+func addNodes(tx *bbolt.Tx, name string, class uint16, delta int64) error {
+	nodes := tx.Bucket(nodesBucket)
+	name = strings.ToLower(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		key := []byte(nodeKey(name[off:], class))
+		var count int64
+		if value := nodes.Get(key); len(value) == 8 {
+			count = int64(binary.BigEndian.Uint64(value))
+		}
+		count += delta
+		if count <= 0 {
+			if err := nodes.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(count))
+		if err := nodes.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 转换为DNS记录
+func (item *record) RR() (dns.RR, error) {
+	return dns.NewRR(item.Name + " " + strconv.FormatUint(uint64(item.TTL), 10) + " " + item.Class + " " + item.Type + " " + item.Data)
+}
+
+// 记录的键前缀，格式与Redis存储器相同：域名:类别-类型:，之后为记录的签名
+func recordKey(name string, class uint16, rrtype uint16) string {
+	return strings.ToLower(name) + ":" + dns.ClassToString[class] + "-" + dns.TypeToString[rrtype] + ":"
+}
+
+func nodeKey(name string, class uint16) string {
+	return strings.ToLower(name) + ":" + dns.ClassToString[class]
+}
+
+// 过期时间索引的键
+func expireKey(expires int64, key string) []byte {
+	buf := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(buf, uint64(expires))
+	return append(buf, key...)
+}
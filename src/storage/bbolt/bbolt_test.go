@@ -0,0 +1,73 @@
+package bbolt
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"local/global"
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+)
+
+func newRR(t *testing.T, str string) dns.RR {
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// 测试记录的持久化、空非终端节点及过期
+func TestBBolt(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Storage.UseExpire = true
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	path := filepath.Join(t.TempDir(), "records.db")
+	inst, err := New(&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = inst.Set(t.Context(), newRR(t, "a.b.test. 3600 IN A 10.0.0.1"))
+	_ = inst.Set(t.Context(), newRR(t, "a.b.test. 3600 IN A 10.0.0.1"))
+	_ = inst.Set(t.Context(), newRR(t, "short.test. 1 IN TXT \"bye\""))
+	if err = inst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = inst.Ping(t.Context()); err == nil {
+		t.Fatal("关闭后检查数据库未返回错误")
+	}
+
+	inst, err = New(&Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	if err = inst.Ping(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	rr, err := inst.Get(t.Context(), dns.Question{Name: "A.b.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil || len(rr) != 1 {
+		t.Fatal("重新打开后查询到的记录错误", rr, err)
+	}
+	if exist, _ := inst.Exists(t.Context(), "b.test.", dns.ClassINET); !exist {
+		t.Fatal("空非终端节点被判断为不存在")
+	}
+	if rr, total, err := inst.List(t.Context(), rrutil.ListOptions{Prefix: "A.b"}); err != nil || total != 1 || len(rr) != 1 {
+		t.Fatal("按前缀列出的记录错误", rr, total, err)
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+	if exist, _ := inst.Exists(t.Context(), "short.test.", dns.ClassINET); exist {
+		t.Fatal("过期的记录未被清理")
+	}
+
+	_ = inst.Del(t.Context(), newRR(t, "a.b.test. 3600 IN A 10.0.0.1"))
+	if exist, _ := inst.Exists(t.Context(), "test.", dns.ClassINET); exist {
+		t.Fatal("删除所有记录后域名仍然存在")
+	}
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+)
+
+// 支持变化通知的存储器，用于保持多个实例的记录缓存一致
+type Notifier interface {
+	// 订阅记录的变化，域名的记录变化时调用fn，name为空表示无法确定变化的域名
+	Subscribe(fn func(name string))
+}
+
+// 同一域名的缓存条目
+type cacheEntry struct {
+	name     string
+	records  map[[2]uint16][]dns.RR // 类别、类型 -> 记录
+	exists   map[uint16]bool        // 类别 -> 域名是否存在
+	expireAt time.Time
+}
+
+// 存储器的进程内记录缓存，按域名缓存查询结果并按LRU淘汰
+// 本实例写入的记录立即失效，其它实例写入的记录通过存储器的变化通知失效
+type cached struct {
+	inst Interface
+	size int
+	ttl  time.Duration
+
+	mutex      sync.Mutex
+	generation uint64 // 每次失效时递增，避免将失效前查询到的结果写入缓存
+	list       *list.List
+	items      map[string]*list.Element
+}
+
+// 新建记录缓存，size为最多缓存的域名数量，ttl为缓存的最长时间
+func newCached(inst Interface, size int, ttl time.Duration) *cached {
+	return &cached{
+		inst:  inst,
+		size:  size,
+		ttl:   ttl,
+		list:  list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *cached) Set(ctx context.Context, rr dns.RR) (err error) {
+	err = c.inst.Set(ctx, rr)
+	c.invalidate(rr.Header().Name)
+	return
+}
+
+func (c *cached) Get(ctx context.Context, question dns.Question) (result []dns.RR, err error) {
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	key := [2]uint16{question.Qclass, question.Qtype}
+
+	c.mutex.Lock()
+	if entry := c.entry(name, false); entry != nil {
+		if records, exist := entry.records[key]; exist {
+			c.mutex.Unlock()
+			return copyRecords(records), nil
+		}
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	result, err = c.inst.Get(ctx, question)
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	if generation == c.generation {
+		c.entry(name, true).records[key] = copyRecords(result)
+	}
+	c.mutex.Unlock()
+	return
+}
+
+func (c *cached) Del(ctx context.Context, rr dns.RR) (err error) {
+	err = c.inst.Del(ctx, rr)
+	c.invalidate(rr.Header().Name)
+	return
+}
+
+func (c *cached) Exists(ctx context.Context, name string, class uint16) (exist bool, err error) {
+	lowerName := strings.ToLower(dns.Fqdn(name))
+
+	c.mutex.Lock()
+	if entry := c.entry(lowerName, false); entry != nil {
+		if exist, cached := entry.exists[class]; cached {
+			c.mutex.Unlock()
+			return exist, nil
+		}
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	exist, err = c.inst.Exists(ctx, name, class)
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	if generation == c.generation {
+		c.entry(lowerName, true).exists[class] = exist
+	}
+	c.mutex.Unlock()
+	return
+}
+
+// 列出记录，不经过缓存
+func (c *cached) List(ctx context.Context, opts rrutil.ListOptions) ([]dns.RR, int, error) {
+	return c.inst.List(ctx, opts)
+}
+
+// 检查被包装的存储器是否可用，不经过缓存
+func (c *cached) Ping(ctx context.Context) error {
+	return c.inst.Ping(ctx)
+}
+
+// 关闭被包装的存储器
+func (c *cached) Close() error {
+	return c.inst.Close()
+}
+
+// 获取域名的缓存条目，create为true时不存在则新建，调用时必须持有锁
+func (c *cached) entry(name string, create bool) *cacheEntry {
+	if elem, exist := c.items[name]; exist {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expireAt) {
+			c.list.MoveToFront(elem)
+			return entry
+		}
+		c.list.Remove(elem)
+		delete(c.items, name)
+	}
+	if !create {
+		return nil
+	}
+
+	for c.list.Len() >= c.size {
+		oldest := c.list.Back()
+		c.list.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).name)
+	}
+	entry := &cacheEntry{
+		name:     name,
+		records:  make(map[[2]uint16][]dns.RR),
+		exists:   make(map[uint16]bool),
+		expireAt: time.Now().Add(c.ttl),
+	}
+	c.items[name] = c.list.PushFront(entry)
+	return entry
+}
+
+// 使域名及其所有父域名(影响空非终端节点的判断)的缓存失效，name为空时清空所有缓存
+func (c *cached) invalidate(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+
+	if name == "" {
+		c.list.Init()
+		c.items = make(map[string]*list.Element, c.size)
+		return
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if elem, exist := c.items[name[off:]]; exist {
+			c.list.Remove(elem)
+			delete(c.items, name[off:])
+		}
+	}
+}
+
+// 复制记录，避免调用方修改缓存中的记录
+func copyRecords(records []dns.RR) []dns.RR {
+	if records == nil {
+		return nil
+	}
+	result := make([]dns.RR, len(records))
+	for k := range records {
+		result[k] = dns.Copy(records[k])
+	}
+	return result
+}
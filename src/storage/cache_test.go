@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"local/storage/memory"
+
+	"github.com/miekg/dns"
+)
+
+// 记录查询次数的存储器
+type countingStorage struct {
+	Interface
+	gets   int
+	exists int
+}
+
+func (s *countingStorage) Get(ctx context.Context, question dns.Question) ([]dns.RR, error) {
+	s.gets++
+	return s.Interface.Get(ctx, question)
+}
+
+func (s *countingStorage) Exists(ctx context.Context, name string, class uint16) (bool, error) {
+	s.exists++
+	return s.Interface.Exists(ctx, name, class)
+}
+
+// 测试记录缓存的命中、写入后失效及变化通知
+func TestCached(t *testing.T) {
+	inst, err := memory.New(&memory.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &countingStorage{Interface: inst}
+	c := newCached(backend, 2, time.Minute)
+	defer c.Close()
+
+	question := dns.Question{Name: "www.app.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for range 2 {
+		if rr, _ := c.Get(t.Context(), question); len(rr) != 0 {
+			t.Fatal("查询到了不存在的记录")
+		}
+		if exist, _ := c.Exists(t.Context(), "app.test.", dns.ClassINET); exist {
+			t.Fatal("不存在的域名被判断为存在")
+		}
+	}
+	if backend.gets != 1 || backend.exists != 1 {
+		t.Fatal("未命中缓存", backend.gets, backend.exists)
+	}
+
+	// 写入子域名的记录后，父域名是否存在的缓存也失效
+	rr, _ := dns.NewRR("WWW.app.test. 300 IN A 10.0.0.1")
+	if err = c.Set(t.Context(), rr); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := c.Get(t.Context(), question); len(result) != 1 {
+		t.Fatal("写入后未查询到记录")
+	}
+	if exist, _ := c.Exists(t.Context(), "app.test.", dns.ClassINET); !exist {
+		t.Fatal("写入子域名的记录后父域名的缓存未失效")
+	}
+
+	// 修改返回的记录不影响缓存
+	result, _ := c.Get(t.Context(), question)
+	result[0].Header().Name = "changed."
+	if result, _ = c.Get(t.Context(), question); result[0].Header().Name != "WWW.app.test." {
+		t.Fatal("缓存中的记录被修改")
+	}
+
+	// 其它实例写入的记录通过变化通知失效
+	other, _ := dns.NewRR("www.app.test. 300 IN A 10.0.0.2")
+	_ = inst.Set(t.Context(), other)
+	if result, _ = c.Get(t.Context(), question); len(result) != 1 {
+		t.Fatal("收到通知前应使用缓存")
+	}
+	c.invalidate("")
+	if result, _ = c.Get(t.Context(), question); len(result) != 2 {
+		t.Fatal("收到通知后缓存未失效")
+	}
+}
@@ -1,45 +1,235 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
 	"local/global"
+	"local/storage/bbolt"
+	"local/storage/memory"
 	"local/storage/redis"
+	"local/storage/rrutil"
 	"local/storage/voltdb"
+	"local/storage/zonefile"
 
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 )
 
-// 存储器实例
-var Storage Interface
+// 未配置存储器超时时间时，被替换的存储器延迟关闭的时间
+const defaultRetireGrace = 5 * time.Second
+
+// 当前使用的存储器实例
+var current struct {
+	sync.RWMutex
+	typ       string
+	config    string
+	cacheSize int
+	cacheTTL  uint32
+	backend   Interface // 记录指标的存储器实例
+	instance  Interface // 启用记录缓存时为缓存，否则与backend相同
+}
 
-// 存储器接口
+// 存储器接口，查询的超时和取消由调用方通过ctx控制
 type Interface interface {
-	Set(rr dns.RR) (err error)
-	Get(question dns.Question) (result []dns.RR, err error)
-	Del(rr dns.RR) (err error)
+	Set(ctx context.Context, rr dns.RR) (err error)
+	Get(ctx context.Context, question dns.Question) (result []dns.RR, err error)
+	Del(ctx context.Context, rr dns.RR) (err error)
+	// 域名在指定类别下是否存在任意类型的记录，存在子域名记录的空非终端节点也视为存在(RFC 8020)
+	Exists(ctx context.Context, name string, class uint16) (exist bool, err error)
+	// 列出符合过滤条件的记录，按域名、类型及数据排序后分页，total为符合条件的记录总数
+	List(ctx context.Context, opts rrutil.ListOptions) (result []dns.RR, total int, err error)
+	// 检查存储器是否可用，用于启动时的检查及健康检查
+	Ping(ctx context.Context) (err error)
+	// 释放存储器占用的连接、文件等资源
+	Close() (err error)
 }
 
-// 构建存储器实例
+// 获取当前使用的存储器实例，未构建时返回nil
+func Storage() Interface {
+	current.RLock()
+	defer current.RUnlock()
+	return current.instance
+}
+
+// 按当前配置构建存储器实例，存储器的类型和参数都未变化时沿用已有的实例
+// 只有记录缓存的参数变化时重建缓存
 func MakeStorage() (err error) {
-	// 初始化存储器
-	switch global.Config.Storage.Type {
+	var inst Interface
+	conf := global.Config()
+
+	current.Lock()
+	defer current.Unlock()
+	if current.backend == nil || current.typ != conf.Storage.Type || current.config != conf.Storage.Config {
+		inst, err = newStorage(conf.Storage.Type, conf.Storage.Config)
+		if err != nil {
+			return
+		}
+		if current.backend != nil {
+			retire(current.backend, time.Duration(conf.Storage.Timeout)*time.Second)
+		}
+		backend := instrumented{inst: inst}
+		if notifier, ok := inst.(Notifier); ok {
+			notifier.Subscribe(func(name string) {
+				invalidateCache(backend, name)
+			})
+		}
+		current.typ = conf.Storage.Type
+		current.config = conf.Storage.Config
+		current.backend = backend
+		current.instance = nil
+	}
+
+	if current.instance == nil || current.cacheSize != conf.Storage.Cache.Size || current.cacheTTL != conf.Storage.Cache.TTL {
+		current.instance = current.backend
+		if conf.Storage.Cache.Size > 0 {
+			current.instance = newCached(current.backend, conf.Storage.Cache.Size, time.Duration(conf.Storage.Cache.TTL)*time.Second)
+			log.Info().Int("size", conf.Storage.Cache.Size).Uint32("ttl", conf.Storage.Cache.TTL).Msg("启用存储器的记录缓存")
+		}
+		current.cacheSize = conf.Storage.Cache.Size
+		current.cacheTTL = conf.Storage.Cache.TTL
+	}
+	return
+}
+
+// 延迟关闭被替换的存储器，替换前取得旧实例的查询受存储器的超时时间限制，
+// 等待超时时间过后再关闭，避免这些查询使用已关闭的存储器
+func retire(backend Interface, grace time.Duration) {
+	if grace <= 0 {
+		grace = defaultRetireGrace
+	}
+	time.AfterFunc(grace, func() {
+		if err := backend.Close(); err != nil {
+			log.Warn().Err(err).Caller().Msg("关闭旧的存储器失败")
+		}
+	})
+}
+
+// 收到存储器的变化通知时使记录缓存失效，忽略已被替换的存储器的通知
+func invalidateCache(backend Interface, name string) {
+	current.RLock()
+	c, ok := current.instance.(*cached)
+	same := current.backend == backend
+	current.RUnlock()
+	if ok && same {
+		c.invalidate(name)
+	}
+}
+
+// 检查当前使用的存储器实例是否可用
+func Ping(ctx context.Context) error {
+	inst := Storage()
+	if inst == nil {
+		return errors.New("存储器未构建")
+	}
+	return inst.Ping(ctx)
+}
+
+// 关闭当前使用的存储器实例，在程序退出时调用
+func Close() {
+	current.Lock()
+	defer current.Unlock()
+	if current.backend == nil {
+		return
+	}
+	if err := current.backend.Close(); err != nil {
+		log.Err(err).Caller().Msg("关闭存储器失败")
+	}
+	current.backend = nil
+	current.instance = nil
+}
+
+// 按当前配置转换存储器中旧的数据格式，目前只有 Redis 存储器需要转换
+func Migrate() (err error) {
+	conf := global.Config()
+	switch conf.Storage.Type {
+	case "redis":
+	case "voltdb":
+		return migrateVoltDB(conf.Storage.Config)
+	default:
+		err = errors.New("只有 Redis 和 VoltDB 存储器需要转换数据格式")
+		log.Err(err).Caller().Str("type", conf.Storage.Type).Send()
+		return
+	}
+	inst, err := redis.NewWithJSON(conf.Storage.Config)
+	if err != nil {
+		log.Err(err).Caller().Msg("构建 Redis 存储器失败")
+		return
+	}
+	defer func() {
+		_ = inst.Close()
+	}()
+	count, err := inst.Migrate()
+	if err != nil {
+		log.Err(err).Caller().Int("count", count).Msg("转换 Redis 存储器的键布局失败")
+		return
+	}
+	log.Info().Int("count", count).Msg("已转换 Redis 存储器的键布局")
+	return
+}
+
+// 为VoltDB存储器旧的表添加r_rname列及索引并填充
+func migrateVoltDB(jsonStr string) (err error) {
+	inst, err := voltdb.NewWithJSON(jsonStr)
+	if err != nil {
+		log.Err(err).Caller().Msg("构建 VoltDB 存储器失败")
+		return
+	}
+	defer func() {
+		_ = inst.Close()
+	}()
+	count, err := inst.Migrate()
+	if err != nil {
+		log.Err(err).Caller().Int("count", count).Msg("升级 VoltDB 存储器的表失败")
+		return
+	}
+	log.Info().Int("count", count).Msg("已升级 VoltDB 存储器的表")
+	return
+}
+
+// 新建存储器实例
+func newStorage(typ, config string) (inst Interface, err error) {
+	switch typ {
+	case "memory":
+		inst, err = memory.NewWithJSON(config)
+		if err != nil {
+			log.Err(err).Caller().Msg("构建内存存储器失败")
+			return nil, err
+		}
+		log.Info().Msg("使用内存存储器")
+	case "bbolt":
+		inst, err = bbolt.NewWithJSON(config)
+		if err != nil {
+			log.Err(err).Caller().Msg("构建 bbolt 存储器失败")
+			return nil, err
+		}
+		log.Info().Msg("使用 bbolt 存储器")
 	case "redis":
-		Storage, err = redis.NewWithJSON(global.Config.Storage.Config)
+		inst, err = redis.NewWithJSON(config)
 		if err != nil {
-			log.Fatal().Err(err).Caller().Msg("构建 Redis 存储器失败")
-			break
+			log.Err(err).Caller().Msg("构建 Redis 存储器失败")
+			return nil, err
 		}
 		log.Info().Msg("使用 Redis 存储器")
 	case "voltdb":
-		Storage, err = voltdb.NewWithJSON(global.Config.Storage.Config)
+		inst, err = voltdb.NewWithJSON(config)
 		if err != nil {
-			log.Fatal().Err(err).Caller().Msg("构建 VoltDB 存储器失败")
-			break
+			log.Err(err).Caller().Msg("构建 VoltDB 存储器失败")
+			return nil, err
 		}
 		log.Info().Msg("使用 VoltDB 存储器")
+	case "zonefile":
+		inst, err = zonefile.NewWithJSON(config)
+		if err != nil {
+			log.Err(err).Caller().Msg("构建区域文件存储器失败")
+			return nil, err
+		}
+		log.Info().Msg("使用区域文件存储器")
 	default:
-		log.Fatal().Caller().Str("type", global.Config.Storage.Type).Msg("不支持的存储器类型")
+		err = errors.New("不支持的存储器类型")
+		log.Err(err).Caller().Str("type", typ).Send()
 	}
-
 	return
 }
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"local/global"
+)
+
+// 测试重新构建存储器时，旧的存储器在超时时间过后才关闭
+func TestMakeStorageRetire(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Storage.Type = "memory"
+	conf.Storage.Timeout = 1
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+	if err := MakeStorage(); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	old := Storage()
+
+	conf = new(global.Configuration)
+	conf.Storage.Type = "memory"
+	conf.Storage.Config = `{}`
+	conf.Storage.Timeout = 1
+	global.SetConfig(conf)
+	if err := MakeStorage(); err != nil {
+		t.Fatal(err)
+	}
+	if Storage() == old {
+		t.Fatal("配置变化时未重新构建存储器")
+	}
+	if err := old.Ping(t.Context()); err != nil {
+		t.Fatal("替换后立即关闭了旧的存储器", err)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for old.Ping(t.Context()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("超时时间过后未关闭旧的存储器")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"local/metrics"
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+)
+
+// 记录存储器操作耗时和失败次数的包装器
+type instrumented struct {
+	inst Interface
+}
+
+func (s instrumented) Set(ctx context.Context, rr dns.RR) (err error) {
+	begin := time.Now()
+	err = s.inst.Set(ctx, rr)
+	metrics.ObserveStorage("set", time.Since(begin), err)
+	return
+}
+
+func (s instrumented) Get(ctx context.Context, question dns.Question) (result []dns.RR, err error) {
+	begin := time.Now()
+	result, err = s.inst.Get(ctx, question)
+	metrics.ObserveStorage("get", time.Since(begin), err)
+	return
+}
+
+func (s instrumented) Del(ctx context.Context, rr dns.RR) (err error) {
+	begin := time.Now()
+	err = s.inst.Del(ctx, rr)
+	metrics.ObserveStorage("del", time.Since(begin), err)
+	return
+}
+
+func (s instrumented) Exists(ctx context.Context, name string, class uint16) (exist bool, err error) {
+	begin := time.Now()
+	exist, err = s.inst.Exists(ctx, name, class)
+	metrics.ObserveStorage("exists", time.Since(begin), err)
+	return
+}
+
+func (s instrumented) List(ctx context.Context, opts rrutil.ListOptions) (result []dns.RR, total int, err error) {
+	begin := time.Now()
+	result, total, err = s.inst.List(ctx, opts)
+	metrics.ObserveStorage("list", time.Since(begin), err)
+	return
+}
+
+func (s instrumented) Ping(ctx context.Context) (err error) {
+	begin := time.Now()
+	err = s.inst.Ping(ctx)
+	metrics.ObserveStorage("ping", time.Since(begin), err)
+	return
+}
+
+// 关闭被包装的存储器
+func (s instrumented) Close() error {
+	return s.inst.Close()
+}
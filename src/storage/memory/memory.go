@@ -0,0 +1,348 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"local/global"
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// 清理过期记录的间隔
+const cleanInterval = time.Second
+
+type Memory struct {
+	config *Config
+
+	mutex   sync.RWMutex
+	records map[string]map[string]*record // 域名:类别-类型 -> 记录签名 -> 记录
+	nodes   map[string]int                // 域名:类别 -> 该域名及其子域名的记录数，用于判断空非终端节点
+	done    chan struct{}
+	closed  bool
+}
+
+type Config struct {
+	// 快照文件的路径，启动时从快照加载记录，关闭时将记录写入快照，留空则不使用快照
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// 存储的记录
+type record struct {
+	rr      dns.RR
+	expires time.Time // 过期时间，零值表示永不过期
+}
+
+// 快照中的记录
+type snapshotRecord struct {
+	RR      string `json:"rr"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+func New(config *Config) (*Memory, error) {
+	inst := Memory{
+		config:  config,
+		records: make(map[string]map[string]*record),
+		nodes:   make(map[string]int),
+		done:    make(chan struct{}),
+	}
+	if config.Snapshot != "" {
+		if err := inst.load(); err != nil {
+			return nil, err
+		}
+	}
+	go inst.cleanLoop()
+	return &inst, nil
+}
+
+func NewWithJSON(jsonStr string) (*Memory, error) {
+	var (
+		err    error
+		config Config
+	)
+	if strings.TrimSpace(jsonStr) != "" {
+		err = json.Unmarshal(global.StrToBytes(jsonStr), &config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return New(&config)
+}
+
+func (inst *Memory) Set(_ context.Context, rr dns.RR) (err error) {
+	expires := rrutil.ExpireAt(rr)
+	inst.mutex.Lock()
+	defer inst.mutex.Unlock()
+	return inst.set(rr, expires)
+}
+
+func (inst *Memory) set(rr dns.RR, expires time.Time) (err error) {
+	if !strings.HasSuffix(rr.Header().Name, ".") {
+		rr.Header().Name += "."
+	}
+	keySign, err := global.KeySign(rr)
+	if err != nil {
+		return
+	}
+
+	name := strings.ToLower(rr.Header().Name)
+	key := recordKey(name, rr.Header().Class, rr.Header().Rrtype)
+	items, exist := inst.records[key]
+	if !exist {
+		items = make(map[string]*record)
+		inst.records[key] = items
+	}
+	if _, exist = items[keySign]; !exist {
+		inst.addNodes(name, rr.Header().Class, 1)
+	}
+	items[keySign] = &record{rr: dns.Copy(rr), expires: expires}
+	return
+}
+
+func (inst *Memory) Get(_ context.Context, question dns.Question) (result []dns.RR, err error) {
+	if !strings.HasSuffix(question.Name, ".") {
+		question.Name += "."
+	}
+	now := time.Now()
+
+	inst.mutex.RLock()
+	defer inst.mutex.RUnlock()
+	for _, item := range inst.records[recordKey(strings.ToLower(question.Name), question.Qclass, question.Qtype)] {
+		if item.expired(now) {
+			continue
+		}
+		result = append(result, dns.Copy(item.rr))
+	}
+	return
+}
+
+func (inst *Memory) Del(_ context.Context, rr dns.RR) (err error) {
+	if !strings.HasSuffix(rr.Header().Name, ".") {
+		rr.Header().Name += "."
+	}
+	keySign, err := global.KeySign(rr)
+	if err != nil {
+		return
+	}
+
+	inst.mutex.Lock()
+	defer inst.mutex.Unlock()
+	inst.del(recordKey(strings.ToLower(rr.Header().Name), rr.Header().Class, rr.Header().Rrtype), keySign)
+	return
+}
+
+// 删除记录并更新节点计数
+func (inst *Memory) del(key string, keySign string) {
+	items := inst.records[key]
+	item, exist := items[keySign]
+	if !exist {
+		return
+	}
+	delete(items, keySign)
+	if len(items) == 0 {
+		delete(inst.records, key)
+	}
+	inst.addNodes(strings.ToLower(item.rr.Header().Name), item.rr.Header().Class, -1)
+}
+
+func (inst *Memory) Exists(_ context.Context, name string, class uint16) (bool, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	inst.mutex.RLock()
+	defer inst.mutex.RUnlock()
+	return inst.nodes[nodeKey(strings.ToLower(name), class)] > 0, nil
+}
+
+func (inst *Memory) List(_ context.Context, opts rrutil.ListOptions) (result []dns.RR, total int, err error) {
+	now := time.Now()
+
+	inst.mutex.RLock()
+	var records []dns.RR
+	for _, items := range inst.records {
+		for _, item := range items {
+			if !item.expired(now) && opts.Match(item.rr) {
+				records = append(records, item.rr)
+			}
+		}
+	}
+	inst.mutex.RUnlock()
+
+	// 存储的记录不会被修改，只复制当前页的记录
+	records, total = rrutil.PageRecords(records, &opts)
+	result = make([]dns.RR, len(records))
+	for k := range records {
+		result[k] = dns.Copy(records[k])
+	}
+	return
+}
+
+// 检查存储器是否可用
+func (inst *Memory) Ping(_ context.Context) error {
+	inst.mutex.RLock()
+	defer inst.mutex.RUnlock()
+	if inst.closed {
+		return errors.New("存储器已关闭")
+	}
+	return nil
+}
+
+// 停止清理过期记录，配置了快照文件时将记录写入快照
+func (inst *Memory) Close() error {
+	inst.mutex.Lock()
+	if inst.closed {
+		inst.mutex.Unlock()
+		return nil
+	}
+	inst.closed = true
+	close(inst.done)
+	inst.mutex.Unlock()
+
+	if inst.config.Snapshot == "" {
+		return nil
+	}
+	return inst.save()
+}
+
+// 为域名及其所有父域名的节点计数增加delta
+func (inst *Memory) addNodes(name string, class uint16, delta int) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		key := nodeKey(name[off:], class)
+		inst.nodes[key] += delta
+		if inst.nodes[key] <= 0 {
+			delete(inst.nodes, key)
+		}
+	}
+}
+
+// 定期删除过期的记录
+func (inst *Memory) cleanLoop() {
+	ticker := time.NewTicker(cleanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-inst.done:
+			return
+		case now := <-ticker.C:
+			inst.mutex.Lock()
+			for key, items := range inst.records {
+				for keySign, item := range items {
+					if item.expired(now) {
+						inst.del(key, keySign)
+					}
+				}
+			}
+			inst.mutex.Unlock()
+		}
+	}
+}
+
+// 从快照文件加载记录，文件不存在时忽略
+func (inst *Memory) load() error {
+	var (
+		records []snapshotRecord
+		now     = time.Now()
+	)
+	data, err := os.ReadFile(inst.config.Snapshot)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err = json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	inst.mutex.Lock()
+	defer inst.mutex.Unlock()
+	for k := range records {
+		var expires time.Time
+		if records[k].Expires > 0 {
+			expires = time.Unix(records[k].Expires, 0)
+			if !expires.After(now) {
+				continue
+			}
+		}
+		rr, err := dns.NewRR(records[k].RR)
+		if err != nil {
+			log.Warn().Err(err).Caller().Str("rr", records[k].RR).Msg("忽略快照中无效的记录")
+			continue
+		}
+		if rr == nil {
+			continue
+		}
+		if err = inst.set(rr, expires); err != nil {
+			return err
+		}
+	}
+	log.Info().Str("snapshot", inst.config.Snapshot).Int("count", len(records)).Msg("已从快照加载内存存储器的记录")
+	return nil
+}
+
+// 将未过期的记录写入快照文件，先写入临时文件再替换，避免写入中断时损坏快照
+func (inst *Memory) save() error {
+	var (
+		records []snapshotRecord
+		now     = time.Now()
+	)
+	inst.mutex.RLock()
+	for _, items := range inst.records {
+		for _, item := range items {
+			if item.expired(now) {
+				continue
+			}
+			value := snapshotRecord{RR: item.rr.String()}
+			if !item.expires.IsZero() {
+				value.Expires = item.expires.Unix()
+			}
+			records = append(records, value)
+		}
+	}
+	inst.mutex.RUnlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(inst.config.Snapshot), filepath.Base(inst.config.Snapshot)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = os.Rename(file.Name(), inst.config.Snapshot); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	log.Info().Str("snapshot", inst.config.Snapshot).Int("count", len(records)).Msg("已将内存存储器的记录写入快照")
+	return nil
+}
+
+// 记录是否已过期
+func (item *record) expired(now time.Time) bool {
+	return !item.expires.IsZero() && !item.expires.After(now)
+}
+
+func recordKey(name string, class uint16, rrtype uint16) string {
+	return name + ":" + dns.ClassToString[class] + "-" + dns.TypeToString[rrtype]
+}
+
+func nodeKey(name string, class uint16) string {
+	return name + ":" + dns.ClassToString[class]
+}
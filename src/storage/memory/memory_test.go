@@ -0,0 +1,134 @@
+package memory
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"local/global"
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+)
+
+func newRR(t *testing.T, str string) dns.RR {
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// 测试记录的写入、查询、删除及空非终端节点
+func TestMemory(t *testing.T) {
+	inst, err := New(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	if err = inst.Set(t.Context(), newRR(t, "a.b.Test. 300 IN A 10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = inst.Set(t.Context(), newRR(t, "a.b.test. 300 IN A 10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	// 重复写入相同的记录只保留一条
+	if err = inst.Set(t.Context(), newRR(t, "a.b.test. 600 IN A 10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	rr, _ := inst.Get(t.Context(), dns.Question{Name: "A.b.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if len(rr) != 2 {
+		t.Fatal("查询到的记录数量错误", len(rr))
+	}
+	if rr, _ = inst.Get(t.Context(), dns.Question{Name: "a.b.test.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}); len(rr) != 0 {
+		t.Fatal("查询到了其它类型的记录")
+	}
+
+	for name, want := range map[string]bool{"a.b.test.": true, "b.test.": true, "test.": true, "c.test.": false} {
+		if exist, _ := inst.Exists(t.Context(), name, dns.ClassINET); exist != want {
+			t.Fatal("域名是否存在的判断错误", name)
+		}
+	}
+	if exist, _ := inst.Exists(t.Context(), "b.test.", dns.ClassCHAOS); exist {
+		t.Fatal("其它类别的域名被判断为存在")
+	}
+
+	_ = inst.Del(t.Context(), newRR(t, "a.b.test. 300 IN A 10.0.0.1"))
+	_ = inst.Del(t.Context(), newRR(t, "a.b.test. 300 IN A 10.0.0.2"))
+	if exist, _ := inst.Exists(t.Context(), "b.test.", dns.ClassINET); exist {
+		t.Fatal("删除所有记录后空非终端节点仍然存在")
+	}
+}
+
+// 测试记录过期及快照的保存和加载
+func TestMemoryExpireAndSnapshot(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Storage.UseExpire = true
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	snapshot := filepath.Join(t.TempDir(), "records.json")
+	inst, err := New(&Config{Snapshot: snapshot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = inst.Set(t.Context(), newRR(t, "short.test. 1 IN A 10.0.0.1"))
+	_ = inst.Set(t.Context(), newRR(t, "long.test. 3600 IN TXT \"hello world\""))
+	_ = inst.Set(t.Context(), newRR(t, "test. 1 IN SOA ns1.test. hostmaster.test. 5 3600 600 604800 60"))
+
+	time.Sleep(1100 * time.Millisecond)
+	if rr, _ := inst.Get(t.Context(), dns.Question{Name: "short.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); len(rr) != 0 {
+		t.Fatal("查询到了过期的记录")
+	}
+	if rr, _ := inst.Get(t.Context(), dns.Question{Name: "test.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}); len(rr) != 1 {
+		t.Fatal("SOA记录过期后被删除")
+	}
+	if err = inst.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	inst, err = New(&Config{Snapshot: snapshot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+	rr, _ := inst.Get(t.Context(), dns.Question{Name: "long.test.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if len(rr) != 1 || rr[0].(*dns.TXT).Txt[0] != "hello world" {
+		t.Fatal("未从快照加载记录")
+	}
+	if exist, _ := inst.Exists(t.Context(), "short.test.", dns.ClassINET); exist {
+		t.Fatal("快照中包含过期的记录")
+	}
+}
+
+// 测试按域名后缀、前缀及类型过滤记录并分页
+func TestMemoryList(t *testing.T) {
+	inst, err := New(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	for _, str := range []string{
+		"b.app.test. 300 IN A 10.0.0.2",
+		"A.app.test. 300 IN A 10.0.0.1",
+		"a.app.test. 300 IN TXT \"hello\"",
+		"app.test. 300 IN A 10.0.0.3",
+		"other.test. 300 IN A 10.0.0.4",
+	} {
+		_ = inst.Set(t.Context(), newRR(t, str))
+	}
+
+	rr, total, err := inst.List(t.Context(), rrutil.ListOptions{Suffix: "app.test", Type: dns.TypeA, Offset: 1, Limit: 1})
+	if err != nil || total != 3 || len(rr) != 1 || rr[0].Header().Name != "A.app.test." {
+		t.Fatal("按后缀和类型分页的结果错误", rr, total, err)
+	}
+	if rr, total, _ = inst.List(t.Context(), rrutil.ListOptions{Prefix: "A."}); total != 2 || len(rr) != 2 || rr[0].Header().Rrtype != dns.TypeA {
+		t.Fatal("按前缀过滤的结果错误", rr, total)
+	}
+	if rr, total, _ = inst.List(t.Context(), rrutil.ListOptions{Offset: 10}); total != 5 || len(rr) != 0 {
+		t.Fatal("超出范围的分页结果错误", rr, total)
+	}
+}
@@ -2,29 +2,82 @@ package redis
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"local/global"
+	"local/storage/rrutil"
 
 	"github.com/miekg/dns"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
+// 键的布局，每次查询只需读取一个哈希：
+//
+//	<prefix>rr:<域名>:<类别>-<类型>  哈希，字段为记录签名，值为记录
+//	<prefix>types:<域名>:<类别>     集合，域名下存在记录的类型
+//	<prefix>index:<类别>            有序集合，成员为标签倒序的域名，用于判断域名及其子域名是否存在
+//	<prefix>expires                有序集合，分数为记录的过期时间，用于清理过期记录
+//	<prefix>changes                发布订阅频道，写入或删除记录时发布域名
+//
+// 写入使用管道而不是事务，以便兼容Redis集群；删除时清理类型集合和索引需要先判断剩余的记录，
+// 非集群模式使用Lua脚本原子地执行，集群模式下这些键不在同一个槽，使用管道并在移除后复查
 type Redis struct {
 	config *Config
-	cli    *redis.Client
+	cli    redis.UniversalClient
+	done   chan struct{}
+	once   sync.Once
 }
 
 type Config struct {
-	Addr     string `json:"addr"`
-	Database int    `json:"database,omitempty"`
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
-	Prefix   string `json:"prefix,omitempty"`
-	Timeout  uint16 `json:"timeout,omitempty"`
+	// 部署模式: single(默认)/sentinel/cluster，留空时配置了masterName则为sentinel，addrs有多个地址则为cluster
+	Mode       string   `json:"mode,omitempty"`
+	Addr       string   `json:"addr,omitempty"`       // single模式的地址
+	Addrs      []string `json:"addrs,omitempty"`      // sentinel模式的哨兵地址，cluster模式的节点地址
+	MasterName string   `json:"masterName,omitempty"` // sentinel模式的主节点名称
+	Database   int      `json:"database,omitempty"`   // cluster模式不支持
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	// 哨兵的认证信息，留空则不认证
+	SentinelUsername string `json:"sentinelUsername,omitempty"`
+	SentinelPassword string `json:"sentinelPassword,omitempty"`
+	Prefix           string `json:"prefix,omitempty"`
+	Timeout          uint16 `json:"timeout,omitempty"`         // 清理过期记录的超时秒数
+	CleanupInterval  uint16 `json:"cleanupInterval,omitempty"` // 清理过期记录的间隔秒数
+
+	// 连接池，为0时使用go-redis的默认值
+	PoolSize        int    `json:"poolSize,omitempty"`
+	MinIdleConns    int    `json:"minIdleConns,omitempty"`
+	MaxIdleConns    int    `json:"maxIdleConns,omitempty"`
+	ConnMaxIdleTime uint16 `json:"connMaxIdleTime,omitempty"` // 连接的最大空闲秒数
+
+	TLS *TLSConfig `json:"tls,omitempty"` // 留空则不使用TLS
+}
+
+type TLSConfig struct {
+	CAFile             string `json:"caFile,omitempty"`   // 验证服务端证书的CA证书文件，留空则使用系统的CA
+	CertFile           string `json:"certFile,omitempty"` // 客户端证书文件，服务端要求双向认证时使用
+	KeyFile            string `json:"keyFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// 存储的记录，字段与旧的键布局中哈希的字段一致
+type record struct {
+	Name    string `json:"r_name"`
+	Class   string `json:"r_class"`
+	Type    string `json:"r_type"`
+	TTL     uint32 `json:"r_ttl"`
+	Data    string `json:"r_data"`
+	Expires int64  `json:"r_expires,omitempty"`
 }
 
 func New(config *Config) (*Redis, error) {
@@ -33,12 +86,16 @@ func New(config *Config) (*Redis, error) {
 	if inst.config.Timeout == 0 {
 		inst.config.Timeout = 5
 	}
-	inst.cli = redis.NewClient(&redis.Options{
-		Addr:     config.Addr,
-		Username: config.Username,
-		Password: config.Password,
-		DB:       config.Database,
-	})
+	if inst.config.CleanupInterval == 0 {
+		inst.config.CleanupInterval = 5
+	}
+	cli, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	inst.cli = cli
+	inst.done = make(chan struct{})
+	go inst.cleanLoop()
 	return &inst, nil
 }
 
@@ -54,101 +111,228 @@ func NewWithJSON(jsonStr string) (*Redis, error) {
 	return New(&config)
 }
 
-func (inst *Redis) Set(rr dns.RR) (err error) {
+// 按部署模式新建客户端
+func newClient(config *Config) (redis.UniversalClient, error) {
 	var (
-		key     strings.Builder
-		keySign string
-		expires time.Duration
+		err       error
+		tlsConfig *tls.Config
 	)
+	if config.TLS != nil {
+		if tlsConfig, err = config.TLS.build(); err != nil {
+			return nil, err
+		}
+	}
 
-	if !strings.HasSuffix(rr.Header().Name, ".") {
-		rr.Header().Name += "."
+	mode := strings.ToLower(config.Mode)
+	if mode == "" {
+		switch {
+		case config.MasterName != "":
+			mode = "sentinel"
+		case len(config.Addrs) > 1:
+			mode = "cluster"
+		default:
+			mode = "single"
+		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inst.config.Timeout*2)*time.Second)
-	defer cancel()
+	connMaxIdleTime := time.Duration(config.ConnMaxIdleTime) * time.Second
+	switch mode {
+	case "single":
+		addr := config.Addr
+		if addr == "" && len(config.Addrs) > 0 {
+			addr = config.Addrs[0]
+		}
+		if addr == "" {
+			return nil, errors.New("addr参数值不能为空")
+		}
+		return redis.NewClient(&redis.Options{
+			Addr:            addr,
+			Username:        config.Username,
+			Password:        config.Password,
+			DB:              config.Database,
+			PoolSize:        config.PoolSize,
+			MinIdleConns:    config.MinIdleConns,
+			MaxIdleConns:    config.MaxIdleConns,
+			ConnMaxIdleTime: connMaxIdleTime,
+			TLSConfig:       tlsConfig,
+		}), nil
+	case "sentinel":
+		if config.MasterName == "" || len(config.Addrs) == 0 {
+			return nil, errors.New("sentinel模式的masterName和addrs参数值不能为空")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.MasterName,
+			SentinelAddrs:    config.Addrs,
+			SentinelUsername: config.SentinelUsername,
+			SentinelPassword: config.SentinelPassword,
+			Username:         config.Username,
+			Password:         config.Password,
+			DB:               config.Database,
+			PoolSize:         config.PoolSize,
+			MinIdleConns:     config.MinIdleConns,
+			MaxIdleConns:     config.MaxIdleConns,
+			ConnMaxIdleTime:  connMaxIdleTime,
+			TLSConfig:        tlsConfig,
+		}), nil
+	case "cluster":
+		if len(config.Addrs) == 0 {
+			return nil, errors.New("cluster模式的addrs参数值不能为空")
+		}
+		if config.Database != 0 {
+			return nil, errors.New("cluster模式不支持database参数")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           config.Addrs,
+			Username:        config.Username,
+			Password:        config.Password,
+			PoolSize:        config.PoolSize,
+			MinIdleConns:    config.MinIdleConns,
+			MaxIdleConns:    config.MaxIdleConns,
+			ConnMaxIdleTime: connMaxIdleTime,
+			TLSConfig:       tlsConfig,
+		}), nil
+	default:
+		return nil, errors.New("mode参数值只支持single/sentinel/cluster")
+	}
+}
 
-	keySign, err = global.KeySign(rr)
+// 构建TLS配置
+func (config *TLSConfig) build() (*tls.Config, error) {
+	result := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify, //nolint:gosec
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.CAFile != "" {
+		data, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("无效的CA证书文件 " + config.CAFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return result, nil
+}
+
+func (inst *Redis) Set(ctx context.Context, rr dns.RR) (err error) {
+	var expires int64
+
+	if expireAt := rrutil.ExpireAt(rr); !expireAt.IsZero() {
+		expires = expireAt.Unix()
+	}
+	err = inst.set(ctx, rr, expires)
 	if err != nil {
-		return
+		log.Err(err).Caller().Msg("Redis写入记录")
 	}
+	return
+}
 
-	key.WriteString(inst.config.Prefix)
-	key.WriteString(rr.Header().Name)
-	key.WriteString(":")
-	key.WriteString(dns.ClassToString[rr.Header().Class])
-	key.WriteString("-")
-	key.WriteString(dns.TypeToString[rr.Header().Rrtype])
-	key.WriteString(":")
-	key.WriteString(keySign)
+// 写入记录，expires为过期时间的Unix时间戳，0表示永不过期
+func (inst *Redis) set(ctx context.Context, rr dns.RR, expires int64) (err error) {
+	var (
+		keySign string
+		value   []byte
+	)
 
-	if global.Config.Storage.UseExpire {
-		expires = time.Duration(rr.Header().Ttl) * time.Second
+	if !strings.HasSuffix(rr.Header().Name, ".") {
+		rr.Header().Name += "."
 	}
+	name := strings.ToLower(rr.Header().Name)
+	class := dns.ClassToString[rr.Header().Class]
+	rrType := dns.TypeToString[rr.Header().Rrtype]
 
-	err = inst.cli.HSet(ctx, key.String(), "r_name", rr.Header().Name, "r_class", dns.ClassToString[rr.Header().Class], "r_type", dns.TypeToString[rr.Header().Rrtype], "r_ttl", rr.Header().Ttl, "r_data", strings.TrimPrefix(rr.String(), rr.Header().String())).Err()
+	keySign, err = global.KeySign(rr)
+	if err != nil {
+		return
+	}
+	value, err = json.Marshal(record{
+		Name:    rr.Header().Name,
+		Class:   class,
+		Type:    rrType,
+		TTL:     rr.Header().Ttl,
+		Data:    strings.TrimPrefix(rr.String(), rr.Header().String()),
+		Expires: expires,
+	})
 	if err != nil {
-		log.Err(err).Caller().Msg("Redis写入记录")
 		return
 	}
 
-	if expires > 0 {
-		err = inst.cli.Expire(ctx, key.String(), expires).Err()
-		if err != nil {
-			log.Err(err).Caller().Msg("Redis设置记录TTL")
-			return
+	member := expireMember(name, class, rrType, keySign)
+	steps := []func(pipe redis.Pipeliner){
+		func(pipe redis.Pipeliner) {
+			pipe.HSet(ctx, inst.rrKey(name, class, rrType), keySign, value)
+			if expires > 0 {
+				pipe.ZAdd(ctx, inst.expiresKey(), redis.Z{Score: float64(expires), Member: member})
+			} else {
+				pipe.ZRem(ctx, inst.expiresKey(), member)
+			}
+		},
+		func(pipe redis.Pipeliner) {
+			pipe.SAdd(ctx, inst.typesKey(name, class), rrType)
+		},
+		func(pipe redis.Pipeliner) {
+			pipe.ZAdd(ctx, inst.indexKey(class), redis.Z{Member: rrutil.ReverseName(name)})
+			pipe.Publish(ctx, inst.changesKey(), name)
+		},
+	}
+	// 集群模式下管道中不同节点的命令并发执行，按删除时复查的顺序依次写入哈希、类型集合和索引
+	if _, ok := inst.cli.(*redis.ClusterClient); ok {
+		for _, step := range steps {
+			if _, err = inst.cli.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				step(pipe)
+				return nil
+			}); err != nil {
+				return
+			}
 		}
+		return
 	}
+	_, err = inst.cli.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, step := range steps {
+			step(pipe)
+		}
+		return nil
+	})
 	return
 }
 
-func (inst *Redis) Get(question dns.Question) ([]dns.RR, error) {
+func (inst *Redis) Get(ctx context.Context, question dns.Question) ([]dns.RR, error) {
 	var (
 		err    error
-		value  map[string]string
+		values map[string]string
 		result []dns.RR
 		rr     dns.RR
-		key    strings.Builder
-		keys   []string
-		rStr   strings.Builder
+		now    = time.Now().Unix()
 	)
 
 	if !strings.HasSuffix(question.Name, ".") {
 		question.Name += "."
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inst.config.Timeout)*time.Second)
-	defer cancel()
-
-	key.WriteString(inst.config.Prefix)
-	key.WriteString(question.Name)
-	key.WriteString(":")
-	key.WriteString(dns.ClassToString[question.Qclass])
-	key.WriteString("-")
-	key.WriteString(dns.TypeToString[question.Qtype])
-	key.WriteString(":*")
-
-	keys, err = inst.cli.Keys(ctx, key.String()).Result()
+	values, err = inst.cli.HGetAll(ctx, inst.rrKey(strings.ToLower(question.Name), dns.ClassToString[question.Qclass], dns.TypeToString[question.Qtype])).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	for k := range keys {
-		rStr.Reset()
-		value, err = inst.cli.HGetAll(ctx, keys[k]).Result()
-		if err != nil {
+	for _, value := range values {
+		var item record
+		if err = json.Unmarshal(global.StrToBytes(value), &item); err != nil {
 			return nil, err
 		}
-		rStr.WriteString(value["r_name"])
-		rStr.WriteString(" ")
-		rStr.WriteString(value["r_ttl"])
-		rStr.WriteString(" ")
-		rStr.WriteString(value["r_class"])
-		rStr.WriteString(" ")
-		rStr.WriteString(value["r_type"])
-		rStr.WriteString(" ")
-		rStr.WriteString(value["r_data"])
-		rr, err = dns.NewRR(rStr.String())
+		// 过期但尚未被清理的记录
+		if item.Expires > 0 && item.Expires <= now {
+			continue
+		}
+		rr, err = item.RR()
 		if err != nil {
 			return nil, err
 		}
@@ -158,23 +342,418 @@ func (inst *Redis) Get(question dns.Question) ([]dns.RR, error) {
 	return result, nil
 }
 
-func (inst *Redis) Del(rr dns.RR) (err error) {
+func (inst *Redis) Del(ctx context.Context, rr dns.RR) (err error) {
 	if !strings.HasSuffix(rr.Header().Name, ".") {
 		rr.Header().Name += "."
 	}
 
-	var key strings.Builder
+	keySign, err := global.KeySign(rr)
+	if err != nil {
+		return
+	}
+	return inst.del(ctx, strings.ToLower(rr.Header().Name), dns.ClassToString[rr.Header().Class], dns.TypeToString[rr.Header().Rrtype], keySign)
+}
+
+// 删除记录并清理类型集合和索引，与写入记录并发执行时不会移除仍有记录的类型或域名
+//
+//	KEYS: 记录的哈希、类型集合、索引、过期时间集合
+//	ARGV: 记录签名、类型、倒序的域名、过期时间集合的成员、变化通知的频道、域名
+var delScript = redis.NewScript(`
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[4])
+redis.call('PUBLISH', ARGV[5], ARGV[6])
+if redis.call('HLEN', KEYS[1]) > 0 then
+	return 0
+end
+redis.call('SREM', KEYS[2], ARGV[2])
+if redis.call('SCARD', KEYS[2]) > 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[3], ARGV[3])
+return 1
+`)
+
+// 删除记录，域名下该类型没有记录时从类型集合中移除，域名下没有任何记录时从索引中移除
+func (inst *Redis) del(ctx context.Context, name, class, rrType, keySign string) error {
+	if _, ok := inst.cli.(*redis.ClusterClient); ok {
+		return inst.delPipelined(ctx, name, class, rrType, keySign)
+	}
+	return delScript.Run(ctx, inst.cli,
+		[]string{inst.rrKey(name, class, rrType), inst.typesKey(name, class), inst.indexKey(class), inst.expiresKey()},
+		keySign, rrType, rrutil.ReverseName(name), expireMember(name, class, rrType, keySign), inst.changesKey(), name,
+	).Err()
+}
+
+// 集群模式下删除记录，写入记录时依次写入哈希、类型集合和索引，
+// 因此移除类型或域名后复查哈希或类型集合，期间写入了记录时重新加回
+func (inst *Redis) delPipelined(ctx context.Context, name, class, rrType, keySign string) (err error) {
+	var (
+		rrKey    = inst.rrKey(name, class, rrType)
+		typesKey = inst.typesKey(name, class)
+		indexKey = inst.indexKey(class)
+		reversed = rrutil.ReverseName(name)
+		remain   *redis.IntCmd
+		count    int64
+	)
+	_, err = inst.cli.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, rrKey, keySign)
+		pipe.ZRem(ctx, inst.expiresKey(), expireMember(name, class, rrType, keySign))
+		remain = pipe.HLen(ctx, rrKey)
+		pipe.Publish(ctx, inst.changesKey(), name)
+		return nil
+	})
+	if err != nil || remain.Val() > 0 {
+		return
+	}
+
+	if err = inst.cli.SRem(ctx, typesKey, rrType).Err(); err != nil {
+		return
+	}
+	if count, err = inst.cli.HLen(ctx, rrKey).Result(); err != nil {
+		return
+	}
+	if count > 0 {
+		return inst.cli.SAdd(ctx, typesKey, rrType).Err()
+	}
+	if count, err = inst.cli.SCard(ctx, typesKey).Result(); err != nil || count > 0 {
+		return
+	}
+
+	if err = inst.cli.ZRem(ctx, indexKey, reversed).Err(); err != nil {
+		return
+	}
+	if count, err = inst.cli.SCard(ctx, typesKey).Result(); err != nil || count == 0 {
+		return
+	}
+	return inst.cli.ZAdd(ctx, indexKey, redis.Z{Member: reversed}).Err()
+}
+
+func (inst *Redis) Exists(ctx context.Context, name string, class uint16) (bool, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	// 倒序后子域名都以父域名为前缀，按字典序取第一个不小于该域名的成员即可判断域名或其子域名是否存在
+	reversed := rrutil.ReverseName(strings.ToLower(name))
+	members, err := inst.cli.ZRangeByLex(ctx, inst.indexKey(dns.ClassToString[class]), &redis.ZRangeBy{
+		Min:   "[" + reversed,
+		Max:   "+",
+		Count: 1,
+	}).Result()
+	if err != nil {
+		return false, err
+	}
+	return len(members) > 0 && strings.HasPrefix(members[0], reversed), nil
+}
+
+// 遍历记录的哈希，按域名前缀过滤时只遍历该前缀的键
+func (inst *Redis) List(ctx context.Context, opts rrutil.ListOptions) (result []dns.RR, total int, err error) {
+	pattern := escapePattern(inst.config.Prefix+"rr:"+strings.ToLower(opts.Prefix)) + "*"
+
+	// 集群模式下SCAN只遍历单个节点，需要遍历每个主节点
+	if cluster, ok := inst.cli.(*redis.ClusterClient); ok {
+		var mutex sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			records, err := inst.listNode(ctx, node, pattern, &opts)
+			mutex.Lock()
+			result = append(result, records...)
+			mutex.Unlock()
+			return err
+		})
+	} else {
+		result, err = inst.listNode(ctx, inst.cli, pattern, &opts)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	result, total = rrutil.PageRecords(result, &opts)
+	return
+}
+
+// 列出一个节点中符合条件的记录
+func (inst *Redis) listNode(ctx context.Context, node redis.Cmdable, pattern string, opts *rrutil.ListOptions) (result []dns.RR, err error) {
+	var (
+		keys   []string
+		cursor uint64
+		now    = time.Now().Unix()
+	)
+	for {
+		keys, cursor, err = node.Scan(ctx, cursor, pattern, 1000).Result()
+		if err != nil {
+			return
+		}
+		cmds := make([]*redis.MapStringStringCmd, len(keys))
+		_, err = node.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for k := range keys {
+				cmds[k] = pipe.HGetAll(ctx, keys[k])
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		for _, cmd := range cmds {
+			for _, value := range cmd.Val() {
+				var (
+					item record
+					rr   dns.RR
+				)
+				if err = json.Unmarshal(global.StrToBytes(value), &item); err != nil {
+					return
+				}
+				if item.Expires > 0 && item.Expires <= now {
+					continue
+				}
+				if rr, err = item.RR(); err != nil {
+					return
+				}
+				if opts.Match(rr) {
+					result = append(result, rr)
+				}
+			}
+		}
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// 检查与Redis的连接
+func (inst *Redis) Ping(ctx context.Context) error {
+	return inst.cli.Ping(ctx).Err()
+}
+
+// 停止清理过期记录并关闭连接
+func (inst *Redis) Close() (err error) {
+	inst.once.Do(func() {
+		close(inst.done)
+		err = inst.cli.Close()
+	})
+	return
+}
+
+// 订阅所有实例写入或删除记录时发布的通知，
+// 连接断开期间可能错过通知，因此每次(重新)订阅成功时通知清空全部缓存
+func (inst *Redis) Subscribe(fn func(name string)) {
+	pubsub := inst.cli.Subscribe(context.Background(), inst.changesKey())
+	go func() {
+		<-inst.done
+		_ = pubsub.Close()
+	}()
+	go func() {
+		for {
+			msg, err := pubsub.Receive(context.Background())
+			if err != nil {
+				select {
+				case <-inst.done:
+					return
+				default:
+				}
+				// 下次接收时会自动重新连接并订阅
+				log.Warn().Err(err).Caller().Msg("Redis接收记录变化的通知")
+				time.Sleep(time.Second)
+				continue
+			}
+			switch msg := msg.(type) {
+			case *redis.Subscription:
+				if msg.Kind == "subscribe" {
+					fn("")
+				}
+			case *redis.Message:
+				fn(msg.Payload)
+			}
+		}
+	}()
+}
+
+// 定期删除过期的记录，多个实例同时清理时不会冲突
+func (inst *Redis) cleanLoop() {
+	ticker := time.NewTicker(time.Duration(inst.config.CleanupInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-inst.done:
+			return
+		case <-ticker.C:
+			if err := inst.clean(); err != nil {
+				log.Err(err).Caller().Msg("Redis清理过期记录")
+			}
+		}
+	}
+}
+
+// 删除已过期的记录
+func (inst *Redis) clean() error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inst.config.Timeout)*time.Second)
 	defer cancel()
-	name := strings.TrimSuffix(rr.Header().Name, ".")
-	keySign, err := global.KeySign(rr)
-	key.WriteString(inst.config.Prefix)
-	key.WriteString(name)
-	key.WriteString(":")
-	key.WriteString(dns.ClassToString[rr.Header().Class])
-	key.WriteString("-")
-	key.WriteString(dns.TypeToString[rr.Header().Rrtype])
-	key.WriteString(":")
-	key.WriteString(keySign)
-	return inst.cli.Del(ctx, key.String()).Err()
+
+	members, err := inst.cli.ZRangeByScore(ctx, inst.expiresKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().Unix(), 10),
+		Count: 1000,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		parts := strings.Split(member, "|")
+		if len(parts) != 4 {
+			inst.cli.ZRem(ctx, inst.expiresKey(), member)
+			continue
+		}
+		if err = inst.del(ctx, parts[0], parts[1], parts[2], parts[3]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将旧的键布局(<prefix><域名>:<类别>-<类型>:<签名>)中的记录转换为新的键布局并删除旧的键，
+// 返回转换的记录数量。旧的键的剩余过期时间会被保留
+func (inst *Redis) Migrate() (count int, err error) {
+	ctx := context.Background()
+
+	// 集群模式下SCAN只遍历单个节点，需要遍历每个主节点
+	if cluster, ok := inst.cli.(*redis.ClusterClient); ok {
+		var mutex sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			n, err := inst.migrateNode(ctx, node)
+			mutex.Lock()
+			count += n
+			mutex.Unlock()
+			return err
+		})
+		return
+	}
+	return inst.migrateNode(ctx, inst.cli)
+}
+
+// 转换一个节点中的旧的键
+func (inst *Redis) migrateNode(ctx context.Context, node redis.Cmdable) (count int, err error) {
+	var (
+		keys   []string
+		cursor uint64
+	)
+	for {
+		keys, cursor, err = node.Scan(ctx, cursor, escapePattern(inst.config.Prefix)+"*", 1000).Result()
+		if err != nil {
+			return
+		}
+		for _, key := range keys {
+			var migrated bool
+			if migrated, err = inst.migrateKey(ctx, key); err != nil {
+				log.Err(err).Caller().Str("key", key).Msg("Redis转换旧的记录")
+				return
+			}
+			if migrated {
+				count++
+			}
+		}
+		if cursor == 0 {
+			return
+		}
+	}
+}
+
+// 转换一个旧的键，不是旧的键布局时忽略
+func (inst *Redis) migrateKey(ctx context.Context, key string) (bool, error) {
+	// 旧的键以域名开头，域名以.结尾；新的键以rr:、types:等不含.的名称开头
+	rest := strings.TrimPrefix(key, inst.config.Prefix)
+	pos := strings.IndexByte(rest, ':')
+	if pos < 1 || rest[pos-1] != '.' {
+		return false, nil
+	}
+	if keyType, err := inst.cli.Type(ctx, key).Result(); err != nil || keyType != "hash" {
+		return false, err
+	}
+
+	value, err := inst.cli.HGetAll(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	item := record{
+		Name:  value["r_name"],
+		Class: value["r_class"],
+		Type:  value["r_type"],
+		Data:  value["r_data"],
+	}
+	ttl, err := strconv.ParseUint(value["r_ttl"], 10, 32)
+	if err != nil {
+		return false, errors.New("无效的TTL " + value["r_ttl"])
+	}
+	item.TTL = uint32(ttl)
+	rr, err := item.RR()
+	if err != nil {
+		return false, err
+	}
+
+	var expires int64
+	remain, err := inst.cli.TTL(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	if remain > 0 {
+		expires = time.Now().Add(remain).Unix()
+	}
+	if err = inst.set(ctx, rr, expires); err != nil {
+		return false, err
+	}
+	return true, inst.cli.Del(ctx, key).Err()
+}
+
+// 转换为DNS记录
+func (item *record) RR() (dns.RR, error) {
+	var rStr strings.Builder
+	rStr.WriteString(item.Name)
+	rStr.WriteString(" ")
+	rStr.WriteString(strconv.FormatUint(uint64(item.TTL), 10))
+	rStr.WriteString(" ")
+	rStr.WriteString(item.Class)
+	rStr.WriteString(" ")
+	rStr.WriteString(item.Type)
+	rStr.WriteString(" ")
+	rStr.WriteString(item.Data)
+	return dns.NewRR(rStr.String())
+}
+
+func (inst *Redis) rrKey(name, class, rrType string) string {
+	return inst.config.Prefix + "rr:" + name + ":" + class + "-" + rrType
+}
+
+func (inst *Redis) typesKey(name, class string) string {
+	return inst.config.Prefix + "types:" + name + ":" + class
+}
+
+func (inst *Redis) indexKey(class string) string {
+	return inst.config.Prefix + "index:" + class
+}
+
+func (inst *Redis) expiresKey() string {
+	return inst.config.Prefix + "expires"
+}
+
+// 发布记录变化通知的频道
+func (inst *Redis) changesKey() string {
+	return inst.config.Prefix + "changes"
+}
+
+// 过期时间集合的成员
+func expireMember(name, class, rrType, keySign string) string {
+	return name + "|" + class + "|" + rrType + "|" + keySign
+}
+
+// 转义SCAN匹配模式中的特殊字符
+func escapePattern(str string) string {
+	if !strings.ContainsAny(str, `*?[]\`) {
+		return str
+	}
+	var buf strings.Builder
+	for k := 0; k < len(str); k++ {
+		switch str[k] {
+		case '*', '?', '[', ']', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(str[k])
+	}
+	return buf.String()
 }
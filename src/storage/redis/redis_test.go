@@ -0,0 +1,239 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"local/global"
+	"local/storage/rrutil"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+func newRR(t *testing.T, str string) dns.RR {
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// 测试新的键布局下记录的写入、查询、删除及空非终端节点
+func TestRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	inst, err := New(&Config{Addr: server.Addr(), Prefix: "dns:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	_ = inst.Set(t.Context(), newRR(t, "www.App.test. 300 IN A 10.0.0.1"))
+	_ = inst.Set(t.Context(), newRR(t, "www.app.test. 300 IN A 10.0.0.2"))
+	_ = inst.Set(t.Context(), newRR(t, "www.app.test. 300 IN AAAA ::1"))
+	_ = inst.Set(t.Context(), newRR(t, "*.pr.app.test. 300 IN A 10.0.0.3"))
+
+	rr, err := inst.Get(t.Context(), dns.Question{Name: "WWW.app.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil || len(rr) != 2 {
+		t.Fatal("查询到的记录错误", rr, err)
+	}
+	if rr, _ = inst.Get(t.Context(), dns.Question{Name: "*.pr.app.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); len(rr) != 1 {
+		t.Fatal("查询通配符记录错误", rr)
+	}
+
+	for name, want := range map[string]bool{"www.app.test.": true, "app.test.": true, "pr.app.test.": true, "ap.test.": false, "app.tes.": false, "w.app.test.": false} {
+		if exist, _ := inst.Exists(t.Context(), name, dns.ClassINET); exist != want {
+			t.Fatal("域名是否存在的判断错误", name)
+		}
+	}
+
+	rr, total, err := inst.List(t.Context(), rrutil.ListOptions{Prefix: "WWW.", Type: dns.TypeA})
+	if err != nil || total != 2 || len(rr) != 2 {
+		t.Fatal("按前缀和类型列出的记录错误", rr, total, err)
+	}
+	if rr, total, _ = inst.List(t.Context(), rrutil.ListOptions{Suffix: "pr.app.test."}); total != 1 || rr[0].Header().Name != "*.pr.app.test." {
+		t.Fatal("按后缀列出的记录错误", rr, total)
+	}
+
+	_ = inst.Del(t.Context(), newRR(t, "www.app.test. 300 IN A 10.0.0.1"))
+	_ = inst.Del(t.Context(), newRR(t, "www.app.test. 300 IN A 10.0.0.2"))
+	if exist, _ := inst.Exists(t.Context(), "www.app.test.", dns.ClassINET); !exist {
+		t.Fatal("域名还有其它类型的记录时被判断为不存在")
+	}
+	_ = inst.Del(t.Context(), newRR(t, "www.app.test. 300 IN AAAA ::1"))
+	if exist, _ := inst.Exists(t.Context(), "www.app.test.", dns.ClassINET); exist {
+		t.Fatal("删除所有记录后域名仍然存在")
+	}
+}
+
+// 测试过期记录的清理
+func TestRedisExpire(t *testing.T) {
+	server := miniredis.RunT(t)
+	inst, err := New(&Config{Addr: server.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	ctx := context.Background()
+	if err = inst.set(ctx, newRR(t, "old.test. 300 IN A 10.0.0.1"), time.Now().Add(-time.Second).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if rr, _ := inst.Get(t.Context(), dns.Question{Name: "old.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); len(rr) != 0 {
+		t.Fatal("查询到了过期的记录")
+	}
+	if err = inst.clean(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := inst.Exists(t.Context(), "old.test.", dns.ClassINET); exist {
+		t.Fatal("过期的记录未被清理")
+	}
+}
+
+// 测试旧的键布局的转换
+func TestRedisMigrate(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.HSet("dns:www.app.test.:IN-A:0123456789abcdef", "r_name", "www.app.test.", "r_class", "IN", "r_type", "A", "r_ttl", "300", "r_data", "10.0.0.1")
+	server.HSet("dns:txt.app.test.:IN-TXT:0123456789abcdef", "r_name", "txt.app.test.", "r_class", "IN", "r_type", "TXT", "r_ttl", "60", "r_data", `"hello world"`)
+	server.SetTTL("dns:txt.app.test.:IN-TXT:0123456789abcdef", time.Hour)
+	_ = server.Set("dns:other", "value")
+
+	inst, err := New(&Config{Addr: server.Addr(), Prefix: "dns:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	count, err := inst.Migrate()
+	if err != nil || count != 2 {
+		t.Fatal("转换的记录数量错误", count, err)
+	}
+	if server.Exists("dns:www.app.test.:IN-A:0123456789abcdef") {
+		t.Fatal("旧的键未被删除")
+	}
+	if !server.Exists("dns:other") {
+		t.Fatal("删除了不属于旧的键布局的键")
+	}
+	rr, _ := inst.Get(t.Context(), dns.Question{Name: "txt.app.test.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+	if len(rr) != 1 || rr[0].(*dns.TXT).Txt[0] != "hello world" {
+		t.Fatal("转换后查询到的记录错误", rr)
+	}
+	keySign, _ := global.KeySign(rr[0])
+	if score, _ := server.ZScore("dns:expires", "txt.app.test.|IN|TXT|"+keySign); score == 0 {
+		t.Fatal("未保留旧的键的过期时间")
+	}
+
+	// 再次转换时没有需要转换的键
+	if count, _ = inst.Migrate(); count != 0 {
+		t.Fatal("重复转换了记录", count)
+	}
+}
+
+// 测试部署模式的推断及参数校验
+func TestNewClient(t *testing.T) {
+	cli, err := newClient(&Config{Addrs: []string{"127.0.0.1:7000", "127.0.0.1:7001"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cli.(*redis.ClusterClient); !ok {
+		t.Fatal("多个地址时未使用集群模式")
+	}
+	_ = cli.Close()
+
+	for _, config := range []Config{
+		{},
+		{Mode: "sentinel", Addrs: []string{"127.0.0.1:26379"}},
+		{Mode: "cluster", Addrs: []string{"127.0.0.1:7000"}, Database: 1},
+		{Mode: "unknown", Addr: "127.0.0.1:6379"},
+	} {
+		if _, err = newClient(&config); err == nil {
+			t.Fatal("无效的配置未返回错误", config)
+		}
+	}
+}
+
+// 测试其它实例写入记录时的变化通知
+func TestRedisSubscribe(t *testing.T) {
+	server := miniredis.RunT(t)
+	reader, err := New(&Config{Addr: server.Addr(), Prefix: "dns:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	writer, err := New(&Config{Addr: server.Addr(), Prefix: "dns:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	names := make(chan string, 10)
+	reader.Subscribe(func(name string) {
+		names <- name
+	})
+	// 订阅成功时通知清空全部缓存
+	if name := <-names; name != "" {
+		t.Fatal("订阅成功时的通知错误", name)
+	}
+
+	_ = writer.Set(t.Context(), newRR(t, "WWW.app.test. 300 IN A 10.0.0.1"))
+	select {
+	case name := <-names:
+		if name != "www.app.test." {
+			t.Fatal("通知的域名错误", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("未收到写入记录的通知")
+	}
+}
+
+// 测试并发写入和删除同一域名同一类型的记录后，类型集合和索引与剩余的记录一致，
+// 分别使用Lua脚本及集群模式下复查的删除方式
+func TestRedisDelInterleaved(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		server := miniredis.RunT(t)
+		inst, err := New(&Config{Addr: server.Addr(), Prefix: "dns:"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		del := func(rr dns.RR) error {
+			if !pipelined {
+				return inst.Del(t.Context(), rr)
+			}
+			keySign, err := global.KeySign(rr)
+			if err != nil {
+				return err
+			}
+			return inst.delPipelined(t.Context(), "www.app.test.", "IN", dns.TypeToString[rr.Header().Rrtype], keySign)
+		}
+
+		// 一个协程反复写入并删除一条记录，另一个反复删除并写入同一类型的另一条记录，最终只剩后者
+		var wg sync.WaitGroup
+		for k, str := range []string{"www.app.test. 300 IN A 10.0.0.1", "www.app.test. 300 IN A 10.0.0.2"} {
+			rr := newRR(t, str)
+			wg.Go(func() {
+				for range 500 {
+					if k == 1 {
+						_ = del(rr)
+						_ = inst.Set(t.Context(), rr)
+					} else {
+						_ = inst.Set(t.Context(), rr)
+						_ = del(rr)
+					}
+				}
+			})
+		}
+		wg.Wait()
+
+		types, _ := inst.cli.SMembers(t.Context(), inst.typesKey("www.app.test.", "IN")).Result()
+		if len(types) != 1 || types[0] != "A" {
+			t.Fatal("类型集合与剩余的记录不一致", pipelined, types)
+		}
+		if exist, _ := inst.Exists(t.Context(), "www.app.test.", dns.ClassINET); !exist {
+			t.Fatal("域名还有记录时被从索引中移除", pipelined)
+		}
+		_ = inst.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package rrutil
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+)
+
+// 存储器为只读，不支持设置和删除记录
+var ErrReadOnly = errors.New("存储器为只读")
+
+// 写入记录时的过期时间，未开启过期时返回零值
+// SOA记录只在区域顶点，保存着区域的序列号，过期后序列号会变小，因此不过期
+func ExpireAt(rr dns.RR) time.Time {
+	if !global.Config().Storage.UseExpire || rr.Header().Rrtype == dns.TypeSOA {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second)
+}
+
+// 将域名的标签倒序，例如 www.app.test. 转换为 test.app.www.，
+// 倒序后子域名都以父域名为前缀，存储器以此建立查找子域名的索引
+func ReverseName(name string) string {
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// 列出存储器中记录的过滤条件及分页参数
+type ListOptions struct {
+	Suffix string // 域名后缀，匹配该域名及其子域名，留空则不过滤
+	Prefix string // 域名前缀，不区分大小写，留空则不过滤
+	Type   uint16 // 记录类型，为0则不过滤
+	Offset int    // 跳过的记录数
+	Limit  int    // 返回的最大记录数，为0则不限制
+}
+
+// 记录是否符合过滤条件
+func (opts *ListOptions) Match(rr dns.RR) bool {
+	if opts.Type != 0 && rr.Header().Rrtype != opts.Type {
+		return false
+	}
+	name := strings.ToLower(dns.Fqdn(rr.Header().Name))
+	if opts.Prefix != "" && !strings.HasPrefix(name, strings.ToLower(opts.Prefix)) {
+		return false
+	}
+	return opts.Suffix == "" || dns.IsSubDomain(dns.Fqdn(opts.Suffix), name)
+}
+
+// 将符合过滤条件的记录按域名(规范顺序)、类型及数据排序后分页，返回当前页的记录及符合条件的记录总数
+// 各存储器返回相同的顺序，以便调用方翻页
+func PageRecords(records []dns.RR, opts *ListOptions) ([]dns.RR, int) {
+	result := make([]dns.RR, 0, len(records))
+	for k := range records {
+		if opts.Match(records[k]) {
+			result = append(result, records[k])
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].Header(), result[j].Header()
+		if cmp := compareNames(a.Name, b.Name); cmp != 0 {
+			return cmp < 0
+		}
+		if a.Rrtype != b.Rrtype {
+			return a.Rrtype < b.Rrtype
+		}
+		return result[i].String() < result[j].String()
+	})
+
+	total := len(result)
+	if opts.Offset >= total {
+		return nil, total
+	}
+	result = result[max(opts.Offset, 0):]
+	if opts.Limit > 0 && opts.Limit < len(result) {
+		result = result[:opts.Limit]
+	}
+	return result, total
+}
+
+// 按DNSSEC的规范顺序(RFC 4034)比较域名，从最右边的标签开始逐个比较，父域名排在子域名之前
+func compareNames(a, b string) int {
+	labelsA := dns.SplitDomainName(strings.ToLower(a))
+	labelsB := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if cmp := strings.Compare(labelsA[i], labelsB[j]); cmp != 0 {
+			return cmp
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
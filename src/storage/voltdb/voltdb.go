@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"local/global"
+	"local/storage/rrutil"
 
 	_ "github.com/VoltDB/voltdb-client-go/voltdbclient"
 	"github.com/miekg/dns"
@@ -18,6 +20,8 @@ import (
 type VoltDB struct {
 	config *Config
 	cli    *sql.DB
+	done   chan struct{}
+	once   sync.Once
 }
 
 type Config struct {
@@ -25,8 +29,9 @@ type Config struct {
 	Table           string `json:"table"`
 	Username        string `json:"username"`
 	Password        string `json:"password"`
-	Timeout         uint16 `json:"timeout,omitempty"`
+	Timeout         uint16 `json:"timeout,omitempty"` // 检查记录变化的超时秒数
 	CleanupInterval int    `json:"cleanupInterval,omitempty"`
+	PollInterval    uint16 `json:"pollInterval,omitempty"` // 检查记录变化的间隔秒数
 }
 
 func New(config *Config) (*VoltDB, error) {
@@ -38,6 +43,10 @@ func New(config *Config) (*VoltDB, error) {
 	if inst.config.Timeout == 0 {
 		inst.config.Timeout = 5
 	}
+	if inst.config.PollInterval == 0 {
+		inst.config.PollInterval = 1
+	}
+	inst.done = make(chan struct{})
 	if config.Username != "" {
 		inst.cli, err = sql.Open("voltdb", "voltdb://"+config.Username+":"+config.Password+"@"+config.Addr)
 	} else {
@@ -63,7 +72,7 @@ func NewWithJSON(jsonStr string) (*VoltDB, error) {
 	return New(&config)
 }
 
-func (inst *VoltDB) Set(rr dns.RR) (err error) {
+func (inst *VoltDB) Set(ctx context.Context, rr dns.RR) (err error) {
 	var (
 		expired int64
 		exist   bool
@@ -74,11 +83,8 @@ func (inst *VoltDB) Set(rr dns.RR) (err error) {
 		rr.Header().Name += "."
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inst.config.Timeout)*time.Second)
-	defer cancel()
-
-	if global.Config.Storage.UseExpire {
-		expired = time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second).Unix()
+	if expireAt := rrutil.ExpireAt(rr); !expireAt.IsZero() {
+		expired = expireAt.Unix()
 	}
 
 	rrData = strings.TrimPrefix(rr.String(), rr.Header().String())
@@ -92,17 +98,18 @@ func (inst *VoltDB) Set(rr dns.RR) (err error) {
 	}
 
 	if exist {
-		_, err = inst.cli.ExecContext(ctx, "@AdHoc", "UPDATE "+inst.config.Table+" SET expired_at=?, r_ttl=? WHERE r_name=? AND r_class=? AND r_type=?", expired, rr.Header().Ttl, rr.Header().Name, rr.Header().Class, rr.Header().Rrtype)
+		_, err = inst.cli.ExecContext(ctx, "@AdHoc", "UPDATE "+inst.config.Table+" SET expired_at=?, r_ttl=?, r_rname=? WHERE r_name=? AND r_class=? AND r_type=?", expired, rr.Header().Ttl, rrutil.ReverseName(strings.ToLower(rr.Header().Name)), rr.Header().Name, rr.Header().Class, rr.Header().Rrtype)
 	} else {
-		_, err = inst.cli.ExecContext(ctx, "@AdHoc", "INSERT INTO "+inst.config.Table+" (r_data, r_name, r_class, r_type, r_ttl, expired_at) VALUES (?, ?, ?, ?, ?, ?)", rrData, rr.Header().Name, rr.Header().Class, rr.Header().Rrtype, rr.Header().Ttl, expired)
+		_, err = inst.cli.ExecContext(ctx, "@AdHoc", "INSERT INTO "+inst.config.Table+" (r_data, r_name, r_rname, r_class, r_type, r_ttl, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)", rrData, rr.Header().Name, rrutil.ReverseName(strings.ToLower(rr.Header().Name)), rr.Header().Class, rr.Header().Rrtype, rr.Header().Ttl, expired)
 	}
 
 	if err != nil {
 		log.Err(err).Caller().Msg("VoltDB存储器写入记录")
 		return
 	}
+	inst.bumpVersion(ctx)
 
-	if err = inst.cleanupExpired(); err != nil {
+	if err = inst.cleanupExpired(ctx); err != nil {
 		log.Err(err).Caller().Msg("VoltDB存储器自动清理已过期记录")
 		return
 	}
@@ -110,7 +117,7 @@ func (inst *VoltDB) Set(rr dns.RR) (err error) {
 	return
 }
 
-func (inst *VoltDB) Get(question dns.Question) ([]dns.RR, error) {
+func (inst *VoltDB) Get(ctx context.Context, question dns.Question) ([]dns.RR, error) {
 	var (
 		err    error
 		rName  string
@@ -127,16 +134,13 @@ func (inst *VoltDB) Get(question dns.Question) ([]dns.RR, error) {
 		question.Name += "."
 	}
 
-	if err = inst.cleanupExpired(); err != nil {
+	if err = inst.cleanupExpired(ctx); err != nil {
 		log.Err(err).Caller().Msg("VoltDB存储器自动清理已过期记录")
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inst.config.Timeout)*time.Second)
-	defer cancel()
-
-	if global.Config.Storage.UseExpire {
-		rows, err = inst.cli.QueryContext(ctx, "@AdHoc", "select r_name, r_class, r_type, r_ttl, r_data from "+inst.config.Table+" WHERE r_name=? AND r_class=? AND r_type=? AND expired_at=0 OR expired_at>?", question.Name, question.Qclass, question.Qtype, time.Now().Unix())
+	if global.Config().Storage.UseExpire {
+		rows, err = inst.cli.QueryContext(ctx, "@AdHoc", "select r_name, r_class, r_type, r_ttl, r_data from "+inst.config.Table+" WHERE r_name=? AND r_class=? AND r_type=? AND (expired_at=0 OR expired_at>?)", question.Name, question.Qclass, question.Qtype, time.Now().Unix())
 	} else {
 		rows, err = inst.cli.QueryContext(ctx, "@AdHoc", "select r_name, r_class, r_type, r_ttl, r_data from "+inst.config.Table+" WHERE r_name=? AND r_class=? AND r_type=?", question.Name, question.Qclass, question.Qtype)
 	}
@@ -180,28 +184,226 @@ func (inst *VoltDB) Get(question dns.Question) ([]dns.RR, error) {
 	return result, nil
 }
 
-func (inst *VoltDB) Del(rr dns.RR) (err error) {
+func (inst *VoltDB) Del(ctx context.Context, rr dns.RR) (err error) {
 	if !strings.HasSuffix(rr.Header().Name, ".") {
 		rr.Header().Name += "."
 	}
 
-	if err = inst.cleanupExpired(); err != nil {
+	if err = inst.cleanupExpired(ctx); err != nil {
 		log.Err(err).Caller().Msg("VoltDB存储器自动清理已过期记录")
 		return
 	}
 
 	rrData := strings.TrimPrefix(rr.String(), rr.Header().String())
+	result, err := inst.cli.ExecContext(ctx, "@AdHoc", "DELETE FROM "+inst.config.Table+" WHERE r_name=? AND r_class=? AND r_type=? AND r_data=?", rr.Header().Name, rr.Header().Class, rr.Header().Rrtype, rrData)
+	if err != nil {
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		inst.bumpVersion(ctx)
+	}
+	return
+}
+
+func (inst *VoltDB) Exists(ctx context.Context, name string, class uint16) (exist bool, err error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	// r_rname为小写并倒序的域名，该域名及其子域名的倒序都以reversed为前缀，
+	// 即落在[reversed, reversed末尾的点换成"/")的范围内，可使用(r_class, r_rname)索引
+	reversed := rrutil.ReverseName(strings.ToLower(name))
+	upper := strings.TrimSuffix(reversed, ".") + "/"
+	if global.Config().Storage.UseExpire {
+		err = inst.cli.QueryRowContext(ctx, "@AdHoc", "select 1 from "+inst.config.Table+" WHERE r_class=? AND r_rname>=? AND r_rname<? AND (expired_at=0 OR expired_at>?) LIMIT 1", class, reversed, upper, time.Now().Unix()).Scan(&exist)
+	} else {
+		err = inst.cli.QueryRowContext(ctx, "@AdHoc", "select 1 from "+inst.config.Table+" WHERE r_class=? AND r_rname>=? AND r_rname<? LIMIT 1", class, reversed, upper).Scan(&exist)
+	}
+	if err != nil && err.Error() == sql.ErrNoRows.Error() {
+		return false, nil
+	}
+	return
+}
+
+// 表中的域名保留了写入时的大小写，SQL中只按类型和过期时间过滤，域名的过滤及分页在查询结果中进行
+func (inst *VoltDB) List(ctx context.Context, opts rrutil.ListOptions) (result []dns.RR, total int, err error) {
+	var (
+		rName  string
+		rClass uint16
+		rType  uint16
+		rTTL   int
+		rData  string
+		rows   *sql.Rows
+		where  = []string{"1=1"}
+		args   []any
+	)
+
+	if opts.Type != 0 {
+		where = append(where, "r_type=?")
+		args = append(args, opts.Type)
+	}
+	if global.Config().Storage.UseExpire {
+		where = append(where, "(expired_at=0 OR expired_at>?)")
+		args = append(args, time.Now().Unix())
+	}
+
+	// @AdHoc的第一个参数为SQL语句，之后为语句中的参数
+	args = append([]any{"select r_name, r_class, r_type, r_ttl, r_data from " + inst.config.Table + " WHERE " + strings.Join(where, " AND ")}, args...)
+	rows, err = inst.cli.QueryContext(ctx, "@AdHoc", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			log.Warn().Err(closeErr).Caller().Send()
+		}
+	}()
+	for rows.Next() {
+		var rr dns.RR
+		if err = rows.Scan(&rName, &rClass, &rType, &rTTL, &rData); err != nil {
+			return nil, 0, err
+		}
+		rr, err = dns.NewRR(rName + " " + strconv.Itoa(rTTL) + " " + dns.ClassToString[rClass] + " " + dns.TypeToString[rType] + " " + rData)
+		if err != nil {
+			return nil, 0, err
+		}
+		result = append(result, rr)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	result, total = rrutil.PageRecords(result, &opts)
+	return
+}
+
+// 定期检查版本表中的版本号，变化时通知清空全部缓存
+// VoltDB没有变化通知，轮询的间隔即为其它实例写入的记录生效的延迟
+func (inst *VoltDB) Subscribe(fn func(name string)) {
+	go func() {
+		var (
+			last    int64
+			checked bool
+		)
+		ticker := time.NewTicker(time.Duration(inst.config.PollInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-inst.done:
+				return
+			case <-ticker.C:
+				current, err := inst.version()
+				if err != nil {
+					log.Err(err).Caller().Msg("VoltDB存储器检查记录变化")
+					continue
+				}
+				if checked && current != last {
+					fn("")
+				}
+				last, checked = current, true
+			}
+		}
+	}()
+}
+
+// 记录版本号的表，表中只有id为0的一行，每次写入或删除记录时递增版本号
+func (inst *VoltDB) versionTable() string {
+	return inst.config.Table + "_version"
+}
 
+// 当前的版本号
+func (inst *VoltDB) version() (version int64, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inst.config.Timeout)*time.Second)
 	defer cancel()
-	_, err = inst.cli.ExecContext(ctx, "@AdHoc", "DELETE FROM "+inst.config.Table+" WHERE r_data=? AND r_class AND r_type=?", rrData, rr.Header().Class, dns.TypeToString[rr.Header().Rrtype])
+	err = inst.cli.QueryRowContext(ctx, "@AdHoc", "select version from "+inst.versionTable()+" WHERE id=0").Scan(&version)
+	return
+}
+
+// 递增版本号，使其它实例的记录缓存失效，失败时只记录日志，不影响已完成的修改
+func (inst *VoltDB) bumpVersion(ctx context.Context) {
+	if _, err := inst.cli.ExecContext(ctx, "@AdHoc", "UPDATE "+inst.versionTable()+" SET version=version+1 WHERE id=0"); err != nil {
+		log.Warn().Err(err).Caller().Msg("VoltDB存储器递增版本号")
+	}
+}
+
+// 检查与VoltDB的连接
+func (inst *VoltDB) Ping(ctx context.Context) error {
+	return inst.cli.PingContext(ctx)
+}
+
+// 停止检查记录变化并关闭连接
+func (inst *VoltDB) Close() (err error) {
+	inst.once.Do(func() {
+		close(inst.done)
+		err = inst.cli.Close()
+	})
 	return
 }
 
 // 清除已过期的记录
-func (inst *VoltDB) cleanupExpired() (err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inst.config.Timeout)*time.Second)
-	defer cancel()
-	_, err = inst.cli.ExecContext(ctx, "@AdHoc", "DELETE FROM "+inst.config.Table+" WHERE expired_at<>0 AND expired_at<?", time.Now().Unix())
+// 升级旧的表：缺少r_rname列时添加该列及索引，再为r_rname为空的记录填充倒序的域名，
+// 缺少版本表时创建版本表，返回填充的记录数量。升级可以重复执行
+func (inst *VoltDB) Migrate() (count int, err error) {
+	ctx := context.Background()
+	table := inst.config.Table
+
+	var rName string
+	err = inst.cli.QueryRowContext(ctx, "@AdHoc", "select r_rname from "+table+" LIMIT 1").Scan(&rName)
+	if err != nil && err.Error() != sql.ErrNoRows.Error() {
+		log.Info().Err(err).Str("table", table).Msg("VoltDB存储器的表缺少r_rname列，添加该列及索引")
+		if _, err = inst.cli.ExecContext(ctx, "@AdHoc", "ALTER TABLE "+table+" ADD COLUMN r_rname VARCHAR(255) DEFAULT '' NOT NULL"); err != nil {
+			return
+		}
+		if _, err = inst.cli.ExecContext(ctx, "@AdHoc", "CREATE INDEX "+table+"_rname ON "+table+" (r_class, r_rname)"); err != nil {
+			return
+		}
+	}
+
+	// r_data为主键，先读出所有待填充的记录再逐条更新
+	rows, err := inst.cli.QueryContext(ctx, "@AdHoc", "select r_data, r_name from "+table+" WHERE r_rname=''")
+	if err != nil {
+		return
+	}
+	pending := make(map[string]string)
+	for rows.Next() {
+		var rData string
+		if err = rows.Scan(&rData, &rName); err != nil {
+			_ = rows.Close()
+			return
+		}
+		pending[rData] = rName
+	}
+	if err = rows.Close(); err != nil {
+		return
+	}
+	for rData, rName := range pending {
+		if _, err = inst.cli.ExecContext(ctx, "@AdHoc", "UPDATE "+table+" SET r_rname=? WHERE r_data=?", rrutil.ReverseName(strings.ToLower(rName)), rData); err != nil {
+			return
+		}
+		count++
+	}
+
+	var version int64
+	err = inst.cli.QueryRowContext(ctx, "@AdHoc", "select version from "+inst.versionTable()+" WHERE id=0").Scan(&version)
+	if err == nil {
+		return
+	}
+	if err.Error() != sql.ErrNoRows.Error() {
+		log.Info().Err(err).Str("table", inst.versionTable()).Msg("VoltDB存储器缺少版本表，创建版本表")
+		if _, err = inst.cli.ExecContext(ctx, "@AdHoc", "CREATE TABLE "+inst.versionTable()+" (id TINYINT PRIMARY KEY, version BIGINT NOT NULL)"); err != nil {
+			return
+		}
+	}
+	_, err = inst.cli.ExecContext(ctx, "@AdHoc", "INSERT INTO "+inst.versionTable()+" (id, version) VALUES (0, 0)")
+	return
+}
+
+func (inst *VoltDB) cleanupExpired(ctx context.Context) (err error) {
+	result, err := inst.cli.ExecContext(ctx, "@AdHoc", "DELETE FROM "+inst.config.Table+" WHERE expired_at<>0 AND expired_at<?", time.Now().Unix())
+	if err != nil {
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected > 0 {
+		inst.bumpVersion(ctx)
+	}
 	return
 }
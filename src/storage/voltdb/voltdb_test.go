@@ -0,0 +1,891 @@
+package voltdb
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"local/global"
+
+	"github.com/miekg/dns"
+)
+
+// 测试用的VoltDB，实现database/sql的驱动，在内存中执行存储器用到的@AdHoc语句
+// 只支持存储器用到的语法，WHERE条件按SQL的优先级计算，比较的类型不一致时返回错误
+type fakeVoltDB struct {
+	mutex   sync.Mutex
+	tables  map[string]*fakeTable
+	indexes map[string]struct{}
+}
+
+type fakeTable struct {
+	columns  []string
+	primary  string         // 主键列
+	defaults map[string]any // 列的默认值
+	rows     []map[string]any
+}
+
+// 执行一条语句，返回查询结果的列名、行及影响的行数
+func (db *fakeVoltDB) exec(query string, params []any) (columns []string, rows [][]driver.Value, affected int64, err error) {
+	tokens, err := fakeTokenize(query)
+	if err != nil {
+		return
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	p := &fakeParser{db: db, tokens: tokens, params: params}
+	switch strings.ToUpper(p.peek()) {
+	case "SELECT":
+		columns, rows, err = p.selectStmt()
+	case "INSERT":
+		affected, err = p.insertStmt()
+	case "UPDATE":
+		affected, err = p.updateStmt()
+	case "DELETE":
+		affected, err = p.deleteStmt()
+	case "CREATE":
+		err = p.createStmt()
+	case "ALTER":
+		err = p.alterStmt()
+	default:
+		err = fmt.Errorf("不支持的语句 %q", query)
+	}
+	if err == nil && p.pos < len(tokens) {
+		err = fmt.Errorf("语句 %q 中有多余的内容 %q", query, p.peek())
+	}
+	if err == nil && p.param != len(params) {
+		err = fmt.Errorf("语句 %q 的参数数量为 %d，实际传入 %d", query, p.param, len(params))
+	}
+	return
+}
+
+// 拆分语句中的标识符、数字、字符串及运算符
+func fakeTokenize(query string) (tokens []string, err error) {
+	isWord := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	for k := 0; k < len(query); {
+		c := query[k]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			k++
+		case c == '\'':
+			end := strings.IndexByte(query[k+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("字符串未结束")
+			}
+			tokens = append(tokens, query[k:k+end+2])
+			k += end + 2
+		case isWord(c):
+			start := k
+			for k < len(query) && isWord(query[k]) {
+				k++
+			}
+			tokens = append(tokens, query[start:k])
+		case strings.HasPrefix(query[k:], ">=") || strings.HasPrefix(query[k:], "<=") || strings.HasPrefix(query[k:], "<>"):
+			tokens = append(tokens, query[k:k+2])
+			k += 2
+		case strings.IndexByte("=<>(),?*+", c) >= 0:
+			tokens = append(tokens, string(c))
+			k++
+		default:
+			return nil, fmt.Errorf("无法识别的字符 %q", c)
+		}
+	}
+	return
+}
+
+type (
+	fakeValue func(row map[string]any) any
+	fakeCond  func(row map[string]any) (bool, error)
+)
+
+type fakeParser struct {
+	db     *fakeVoltDB
+	tokens []string
+	pos    int
+	params []any
+	param  int // 已使用的参数数量
+	table  *fakeTable
+}
+
+func (p *fakeParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *fakeParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *fakeParser) accept(keyword string) bool {
+	if p.pos < len(p.tokens) && strings.EqualFold(p.tokens[p.pos], keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *fakeParser) expect(keyword string) error {
+	if !p.accept(keyword) {
+		return fmt.Errorf("期望 %s，实际为 %q", keyword, p.peek())
+	}
+	return nil
+}
+
+func (p *fakeParser) useTable(name string) error {
+	table, exist := p.db.tables[strings.ToLower(name)]
+	if !exist {
+		return fmt.Errorf("表 %s 不存在", name)
+	}
+	p.table = table
+	return nil
+}
+
+// 参数、字符串、整数或当前表的列
+func (p *fakeParser) operand() (fakeValue, error) {
+	tok := p.next()
+	var value any
+	switch {
+	case tok == "?":
+		if p.param >= len(p.params) {
+			return nil, errors.New("参数不足")
+		}
+		value = p.params[p.param]
+		p.param++
+	case strings.HasPrefix(tok, "'"):
+		value = strings.Trim(tok, "'")
+	case tok != "" && tok[0] >= '0' && tok[0] <= '9':
+		n, err := strconv.ParseInt(tok, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		value = n
+	case p.table != nil && slices.Contains(p.table.columns, strings.ToLower(tok)):
+		column := strings.ToLower(tok)
+		return func(row map[string]any) any {
+			return row[column]
+		}, nil
+	default:
+		return nil, fmt.Errorf("无效的操作数 %q", tok)
+	}
+	return func(map[string]any) any {
+		return value
+	}, nil
+}
+
+// 值表达式，只支持整数的加法
+func (p *fakeParser) expr() (fakeValue, error) {
+	left, err := p.operand()
+	if err != nil || !p.accept("+") {
+		return left, err
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(row map[string]any) any {
+		a, _ := left(row).(int64)
+		b, _ := right(row).(int64)
+		return a + b
+	}, nil
+}
+
+func (p *fakeParser) or() (fakeCond, error) {
+	left, err := p.and()
+	for err == nil && p.accept("OR") {
+		var right fakeCond
+		if right, err = p.and(); err == nil {
+			l := left
+			left = func(row map[string]any) (bool, error) {
+				if ok, err := l(row); err != nil || ok {
+					return ok, err
+				}
+				return right(row)
+			}
+		}
+	}
+	return left, err
+}
+
+func (p *fakeParser) and() (fakeCond, error) {
+	left, err := p.compare()
+	for err == nil && p.accept("AND") {
+		var right fakeCond
+		if right, err = p.compare(); err == nil {
+			l := left
+			left = func(row map[string]any) (bool, error) {
+				if ok, err := l(row); err != nil || !ok {
+					return ok, err
+				}
+				return right(row)
+			}
+		}
+	}
+	return left, err
+}
+
+// 比较两个操作数，任一为NULL时不匹配
+func (p *fakeParser) compare() (fakeCond, error) {
+	if p.accept("(") {
+		cond, err := p.or()
+		if err == nil {
+			err = p.expect(")")
+		}
+		return cond, err
+	}
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if !slices.Contains([]string{"=", "<>", "<", "<=", ">", ">="}, op) {
+		return nil, fmt.Errorf("无效的比较运算符 %q", op)
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return func(row map[string]any) (bool, error) {
+		a, b := left(row), right(row)
+		if a == nil || b == nil {
+			return false, nil
+		}
+		var result int
+		switch x := a.(type) {
+		case int64:
+			y, ok := b.(int64)
+			if !ok {
+				return false, fmt.Errorf("类型不匹配：%v 与 %v", a, b)
+			}
+			result = cmp.Compare(x, y)
+		case string:
+			y, ok := b.(string)
+			if !ok {
+				return false, fmt.Errorf("类型不匹配：%v 与 %v", a, b)
+			}
+			result = strings.Compare(x, y)
+		default:
+			return false, fmt.Errorf("不支持比较的类型 %T", a)
+		}
+		switch op {
+		case "=":
+			return result == 0, nil
+		case "<>":
+			return result != 0, nil
+		case "<":
+			return result < 0, nil
+		case "<=":
+			return result <= 0, nil
+		case ">":
+			return result > 0, nil
+		default:
+			return result >= 0, nil
+		}
+	}, nil
+}
+
+// 解析WHERE条件并返回匹配的行的序号
+func (p *fakeParser) where() (matched []int, err error) {
+	cond := fakeCond(func(map[string]any) (bool, error) {
+		return true, nil
+	})
+	if p.accept("WHERE") {
+		if cond, err = p.or(); err != nil {
+			return
+		}
+	}
+	for k, row := range p.table.rows {
+		ok, err := cond(row)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, k)
+		}
+	}
+	return
+}
+
+func (p *fakeParser) selectStmt() (columns []string, rows [][]driver.Value, err error) {
+	// 先定位FROM后的表名，以便解析选择的列
+	from := slices.IndexFunc(p.tokens, func(tok string) bool {
+		return strings.EqualFold(tok, "FROM")
+	})
+	if from < 0 || from+1 >= len(p.tokens) {
+		return nil, nil, errors.New("缺少FROM")
+	}
+	if err = p.useTable(p.tokens[from+1]); err != nil {
+		return
+	}
+
+	p.next()
+	var items []fakeValue
+	for {
+		columns = append(columns, p.peek())
+		item, err := p.expr()
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if err = p.expect("FROM"); err != nil {
+		return
+	}
+	p.next()
+	matched, err := p.where()
+	if err != nil {
+		return
+	}
+	if p.accept("LIMIT") {
+		limit, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, nil, err
+		}
+		matched = matched[:min(limit, len(matched))]
+	}
+	for _, k := range matched {
+		values := make([]driver.Value, len(items))
+		for i, item := range items {
+			values[i] = item(p.table.rows[k])
+		}
+		rows = append(rows, values)
+	}
+	return
+}
+
+func (p *fakeParser) insertStmt() (int64, error) {
+	p.next()
+	if err := p.expect("INTO"); err != nil {
+		return 0, err
+	}
+	if err := p.useTable(p.next()); err != nil {
+		return 0, err
+	}
+	if err := p.expect("("); err != nil {
+		return 0, err
+	}
+	var columns []string
+	for {
+		column := strings.ToLower(p.next())
+		if !slices.Contains(p.table.columns, column) {
+			return 0, fmt.Errorf("列 %s 不存在", column)
+		}
+		columns = append(columns, column)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return 0, err
+	}
+	if err := p.expect("VALUES"); err != nil {
+		return 0, err
+	}
+	if err := p.expect("("); err != nil {
+		return 0, err
+	}
+	row := p.table.newRow()
+	for k, column := range columns {
+		if k > 0 {
+			if err := p.expect(","); err != nil {
+				return 0, err
+			}
+		}
+		value, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		row[column] = value(nil)
+	}
+	if err := p.expect(")"); err != nil {
+		return 0, err
+	}
+	if p.table.primary != "" {
+		for _, item := range p.table.rows {
+			if item[p.table.primary] == row[p.table.primary] {
+				return 0, fmt.Errorf("主键 %v 重复", row[p.table.primary])
+			}
+		}
+	}
+	p.table.rows = append(p.table.rows, row)
+	return 1, nil
+}
+
+func (p *fakeParser) updateStmt() (int64, error) {
+	p.next()
+	if err := p.useTable(p.next()); err != nil {
+		return 0, err
+	}
+	if err := p.expect("SET"); err != nil {
+		return 0, err
+	}
+	var (
+		columns []string
+		values  []fakeValue
+	)
+	for {
+		column := strings.ToLower(p.next())
+		if !slices.Contains(p.table.columns, column) {
+			return 0, fmt.Errorf("列 %s 不存在", column)
+		}
+		if err := p.expect("="); err != nil {
+			return 0, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		columns = append(columns, column)
+		values = append(values, value)
+		if !p.accept(",") {
+			break
+		}
+	}
+	matched, err := p.where()
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range matched {
+		row := p.table.rows[k]
+		result := make([]any, len(values))
+		for i, value := range values {
+			result[i] = value(row)
+		}
+		for i, column := range columns {
+			row[column] = result[i]
+		}
+	}
+	return int64(len(matched)), nil
+}
+
+func (p *fakeParser) deleteStmt() (int64, error) {
+	p.next()
+	if err := p.expect("FROM"); err != nil {
+		return 0, err
+	}
+	if err := p.useTable(p.next()); err != nil {
+		return 0, err
+	}
+	matched, err := p.where()
+	if err != nil {
+		return 0, err
+	}
+	for k := len(matched) - 1; k >= 0; k-- {
+		p.table.rows = slices.Delete(p.table.rows, matched[k], matched[k]+1)
+	}
+	return int64(len(matched)), nil
+}
+
+// CREATE TABLE及CREATE INDEX，索引只检查名称是否重复
+func (p *fakeParser) createStmt() error {
+	p.next()
+	if p.accept("INDEX") {
+		name := strings.ToLower(p.next())
+		if _, exist := p.db.indexes[name]; exist {
+			return fmt.Errorf("索引 %s 已存在", name)
+		}
+		if err := p.expect("ON"); err != nil {
+			return err
+		}
+		if err := p.useTable(p.next()); err != nil {
+			return err
+		}
+		p.pos = len(p.tokens)
+		p.db.indexes[name] = struct{}{}
+		return nil
+	}
+	if err := p.expect("TABLE"); err != nil {
+		return err
+	}
+	name := strings.ToLower(p.next())
+	if _, exist := p.db.tables[name]; exist {
+		return fmt.Errorf("表 %s 已存在", name)
+	}
+	table := &fakeTable{defaults: make(map[string]any)}
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for {
+		if err := p.columnDef(table); err != nil {
+			return err
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return err
+	}
+	p.db.tables[name] = table
+	return nil
+}
+
+// ALTER TABLE ... ADD COLUMN，已有的行使用列的默认值
+func (p *fakeParser) alterStmt() error {
+	p.next()
+	if err := p.expect("TABLE"); err != nil {
+		return err
+	}
+	if err := p.useTable(p.next()); err != nil {
+		return err
+	}
+	if err := p.expect("ADD"); err != nil {
+		return err
+	}
+	if err := p.expect("COLUMN"); err != nil {
+		return err
+	}
+	column := strings.ToLower(p.peek())
+	if slices.Contains(p.table.columns, column) {
+		return fmt.Errorf("列 %s 已存在", column)
+	}
+	if err := p.columnDef(p.table); err != nil {
+		return err
+	}
+	for _, row := range p.table.rows {
+		row[column] = p.table.defaults[column]
+	}
+	return nil
+}
+
+// 列定义：列名 类型[(长度)] [DEFAULT 值] [NOT NULL] [PRIMARY KEY]
+func (p *fakeParser) columnDef(table *fakeTable) error {
+	column := strings.ToLower(p.next())
+	table.columns = append(table.columns, column)
+	p.next()
+	if p.accept("(") {
+		p.next()
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+	}
+	for {
+		switch {
+		case p.accept("DEFAULT"):
+			value, err := p.operand()
+			if err != nil {
+				return err
+			}
+			table.defaults[column] = value(nil)
+		case p.accept("NOT"):
+			if err := p.expect("NULL"); err != nil {
+				return err
+			}
+		case p.accept("PRIMARY"):
+			if err := p.expect("KEY"); err != nil {
+				return err
+			}
+			table.primary = column
+		default:
+			return nil
+		}
+	}
+}
+
+func (table *fakeTable) newRow() map[string]any {
+	row := make(map[string]any, len(table.columns))
+	for _, column := range table.columns {
+		row[column] = table.defaults[column]
+	}
+	return row
+}
+
+// database/sql的驱动，@AdHoc的第一个参数为SQL语句，之后为语句中的参数
+type fakeConnector struct {
+	db *fakeVoltDB
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: c.db}, nil
+}
+
+func (c fakeConnector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("只能通过fakeConnector连接")
+}
+
+type fakeConn struct {
+	db *fakeVoltDB
+}
+
+func (conn *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("不支持预处理语句")
+}
+
+func (conn *fakeConn) Close() error {
+	return nil
+}
+
+func (conn *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("不支持事务")
+}
+
+func (conn *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	statement, params, err := fakeAdHoc(query, args)
+	if err != nil {
+		return nil, err
+	}
+	_, _, affected, err := conn.db.exec(statement, params)
+	return driver.RowsAffected(affected), err
+}
+
+func (conn *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	statement, params, err := fakeAdHoc(query, args)
+	if err != nil {
+		return nil, err
+	}
+	columns, rows, _, err := conn.db.exec(statement, params)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+func fakeAdHoc(query string, args []driver.NamedValue) (statement string, params []any, err error) {
+	if query != "@AdHoc" || len(args) == 0 {
+		return "", nil, fmt.Errorf("不支持的存储过程 %s", query)
+	}
+	statement, ok := args[0].Value.(string)
+	if !ok {
+		return "", nil, errors.New("@AdHoc的第一个参数不是SQL语句")
+	}
+	for _, arg := range args[1:] {
+		params = append(params, arg.Value)
+	}
+	return
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (rows *fakeRows) Columns() []string {
+	return rows.columns
+}
+
+func (rows *fakeRows) Close() error {
+	return nil
+}
+
+func (rows *fakeRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
+
+// 按建表语句构建测试用的VoltDB及存储器
+func newTestVoltDB(t *testing.T, schema string) (*VoltDB, *fakeVoltDB) {
+	db := &fakeVoltDB{tables: make(map[string]*fakeTable), indexes: make(map[string]struct{})}
+	for _, statement := range strings.Split(schema, ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		if _, _, _, err := db.exec(statement, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db.open(t), db
+}
+
+// 构建连接到同一测试用VoltDB的存储器，模拟多个实例共用存储器
+func (db *fakeVoltDB) open(t *testing.T) *VoltDB {
+	inst := &VoltDB{
+		config: &Config{Table: "domain", Timeout: 5, PollInterval: 1},
+		cli:    sql.OpenDB(fakeConnector{db: db}),
+		done:   make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		_ = inst.Close()
+	})
+	return inst
+}
+
+// 项目根目录下的建表语句
+func readSchema(t *testing.T) string {
+	data, err := os.ReadFile("../../../voltdb.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func mustRR(t *testing.T, str string) dns.RR {
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// 测试按记录删除及按域名查询只作用于匹配的记录，区域的SOA记录可以通过删除后写入递增序列号
+func TestVoltDBSOABump(t *testing.T) {
+	conf := new(global.Configuration)
+	conf.Storage.UseExpire = true
+	global.SetConfig(conf)
+	defer global.SetConfig(nil)
+
+	inst, db := newTestVoltDB(t, readSchema(t))
+	ctx := t.Context()
+	soaQuestion := dns.Question{Name: "a.test.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}
+	for _, str := range []string{
+		"a.test. 3600 IN SOA ns1.a.test. hostmaster.a.test. 1 3600 600 604800 60",
+		"b.test. 3600 IN SOA ns1.b.test. hostmaster.b.test. 7 3600 600 604800 60",
+		"www.a.test. 300 IN A 10.0.0.1",
+	} {
+		if err := inst.Set(ctx, mustRR(t, str)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr, err := inst.Get(ctx, soaQuestion)
+	if err != nil || len(rr) != 1 || rr[0].(*dns.SOA).Serial != 1 {
+		t.Fatal("查询到了其它域名的记录", rr, err)
+	}
+	// SOA记录保存区域的序列号，不设置过期时间
+	for _, row := range db.tables["domain"].rows {
+		if expired := row["expired_at"].(int64); (row["r_type"] == int64(dns.TypeSOA)) != (expired == 0) {
+			t.Fatal("记录的过期时间错误", row)
+		}
+	}
+
+	next := dns.Copy(rr[0]).(*dns.SOA)
+	next.Serial++
+	if err = inst.Del(ctx, rr[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err = inst.Set(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if rr, err = inst.Get(ctx, soaQuestion); err != nil || len(rr) != 1 || rr[0].(*dns.SOA).Serial != 2 {
+		t.Fatal("递增序列号后的SOA记录错误", rr, err)
+	}
+	rr, err = inst.Get(ctx, dns.Question{Name: "b.test.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET})
+	if err != nil || len(rr) != 1 || rr[0].(*dns.SOA).Serial != 7 {
+		t.Fatal("删除了其它区域的SOA记录", rr, err)
+	}
+}
+
+// 测试升级缺少r_rname列的旧表，升级后可按索引判断子域名是否存在，重复执行不再修改
+func TestVoltDBMigrate(t *testing.T) {
+	global.SetConfig(new(global.Configuration))
+	defer global.SetConfig(nil)
+
+	inst, db := newTestVoltDB(t, `
+CREATE TABLE domain (
+    r_data VARCHAR(255) PRIMARY KEY,
+    r_name VARCHAR(255) NOT NULL,
+    r_class TINYINT DEFAULT 1,
+    r_type TINYINT NOT NULL,
+    r_ttl INTEGER NOT NULL,
+    expired_at BIGINT DEFAULT 0
+)`)
+	for _, params := range [][]any{
+		{"10.0.0.1", "WWW.App.test.", int64(dns.TypeA)},
+		{"10.0.0.2", "api.app.test.", int64(dns.TypeA)},
+	} {
+		if _, _, _, err := db.exec("INSERT INTO domain (r_data, r_name, r_type, r_ttl) VALUES (?, ?, ?, 300)", params); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := inst.Exists(t.Context(), "app.test.", dns.ClassINET); err == nil {
+		t.Fatal("旧的表缺少r_rname列时未返回错误")
+	}
+
+	count, err := inst.Migrate()
+	if err != nil || count != 2 {
+		t.Fatal("升级旧的表失败", count, err)
+	}
+	if exist, err := inst.Exists(t.Context(), "app.test.", dns.ClassINET); err != nil || !exist {
+		t.Fatal("升级后未找到子域名", err)
+	}
+	if count, err = inst.Migrate(); err != nil || count != 0 {
+		t.Fatal("重复升级时修改了记录", count, err)
+	}
+	if version, err := inst.version(); err != nil || version != 0 {
+		t.Fatal("升级后未创建版本表", version, err)
+	}
+
+	// 更新已有记录时同时写入r_rname
+	if _, _, _, err = db.exec("UPDATE domain SET r_rname='' WHERE r_data='10.0.0.2'", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = inst.Set(t.Context(), mustRR(t, "api.app.test. 600 IN A 10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := inst.Exists(t.Context(), "api.app.test.", dns.ClassINET); !exist {
+		t.Fatal("更新记录时未写入r_rname")
+	}
+}
+
+// 测试其它实例修改记录后，即使记录数量及TTL不变也能通过版本号发现变化
+func TestVoltDBSubscribe(t *testing.T) {
+	global.SetConfig(new(global.Configuration))
+	defer global.SetConfig(nil)
+
+	writer, db := newTestVoltDB(t, readSchema(t))
+	reader := db.open(t)
+	old := mustRR(t, "www.app.test. 300 IN A 10.0.0.1")
+	if err := writer.Set(t.Context(), old); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan struct{}, 10)
+	reader.Subscribe(func(string) {
+		changes <- struct{}{}
+	})
+	// 等待首次轮询记下当前的版本号
+	time.Sleep(1100 * time.Millisecond)
+
+	// 替换记录的数据，记录数量及TTL的总和都不变
+	if err := writer.Del(t.Context(), old); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Set(t.Context(), mustRR(t, "www.app.test. 300 IN A 10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := reader.version(); version != 3 {
+		t.Fatal("修改记录时未递增版本号", version)
+	}
+	select {
+	case <-changes:
+	case <-time.After(3 * time.Second):
+		t.Fatal("未通知记录的变化")
+	}
+
+	// 删除不存在的记录时版本号不变
+	if err := writer.Del(t.Context(), old); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := reader.version(); version != 3 {
+		t.Fatal("未修改记录时递增了版本号", version)
+	}
+}
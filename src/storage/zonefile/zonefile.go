@@ -0,0 +1,429 @@
+package zonefile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"local/global"
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+type ZoneFile struct {
+	config *Config
+
+	mutex   sync.RWMutex
+	zones   []*zone
+	records map[string][]dns.RR // 域名:类别-类型 -> 记录
+	nodes   map[string]int      // 域名:类别 -> 该域名及其子域名的记录数，用于判断空非终端节点
+
+	notify func(name string) // 区域文件重新加载时调用
+	done   chan struct{}
+	once   sync.Once
+}
+
+type Config struct {
+	Zones    []ZoneConfig `json:"zones"`
+	Interval uint16       `json:"interval,omitempty"` // 检查文件变化的间隔秒数
+	Writable bool         `json:"writable,omitempty"` // 是否将设置和删除的记录写回区域文件，否则为只读
+}
+
+type ZoneConfig struct {
+	Origin string `json:"origin"` // 区域的起点，文件中未使用$ORIGIN时用于补全相对域名
+	File   string `json:"file"`
+}
+
+// 区域文件
+type zone struct {
+	origin  string
+	file    string
+	version string // 文件的修改时间和大小，变化时重新加载
+	records []dns.RR
+}
+
+func New(config *Config) (*ZoneFile, error) {
+	if len(config.Zones) == 0 {
+		return nil, errors.New("zones参数值不能为空")
+	}
+	inst := ZoneFile{
+		config: config,
+		done:   make(chan struct{}),
+	}
+	if inst.config.Interval == 0 {
+		inst.config.Interval = 5
+	}
+	for k := range config.Zones {
+		if config.Zones[k].File == "" {
+			return nil, errors.New("区域的file参数值不能为空")
+		}
+		z := &zone{
+			origin: strings.ToLower(config.Zones[k].Origin),
+			file:   config.Zones[k].File,
+		}
+		if z.origin != "" {
+			z.origin = dns.Fqdn(z.origin)
+		}
+		var err error
+		if z.records, z.version, err = parseZone(z.file, z.origin); err != nil {
+			log.Err(err).Caller().Str("file", z.file).Msg("加载区域文件失败")
+			return nil, err
+		}
+		inst.zones = append(inst.zones, z)
+	}
+	inst.rebuild()
+	go inst.watch()
+	return &inst, nil
+}
+
+func NewWithJSON(jsonStr string) (*ZoneFile, error) {
+	var (
+		err    error
+		config Config
+	)
+	err = json.Unmarshal(global.StrToBytes(jsonStr), &config)
+	if err != nil {
+		return nil, err
+	}
+	return New(&config)
+}
+
+func (inst *ZoneFile) Set(_ context.Context, rr dns.RR) (err error) {
+	if !inst.config.Writable {
+		return rrutil.ErrReadOnly
+	}
+	if !strings.HasSuffix(rr.Header().Name, ".") {
+		rr.Header().Name += "."
+	}
+	keySign, err := global.KeySign(rr)
+	if err != nil {
+		return
+	}
+
+	inst.mutex.Lock()
+	defer inst.mutex.Unlock()
+	z := inst.findZone(rr.Header().Name)
+	if z == nil {
+		return errors.New("域名不属于任何区域文件 " + rr.Header().Name)
+	}
+
+	// 相同域名、类别、类型和数据的记录只保留一条
+	records := make([]dns.RR, 0, len(z.records)+1)
+	for _, item := range z.records {
+		if same, err := sameRecord(item, rr, keySign); err != nil {
+			return err
+		} else if !same {
+			records = append(records, item)
+		}
+	}
+	records = append(records, dns.Copy(rr))
+	return inst.save(z, records, rr.Header().Rrtype != dns.TypeSOA)
+}
+
+func (inst *ZoneFile) Get(_ context.Context, question dns.Question) (result []dns.RR, err error) {
+	if !strings.HasSuffix(question.Name, ".") {
+		question.Name += "."
+	}
+	inst.mutex.RLock()
+	defer inst.mutex.RUnlock()
+	for _, item := range inst.records[recordKey(question.Name, question.Qclass, question.Qtype)] {
+		result = append(result, dns.Copy(item))
+	}
+	return
+}
+
+func (inst *ZoneFile) Del(_ context.Context, rr dns.RR) (err error) {
+	if !inst.config.Writable {
+		return rrutil.ErrReadOnly
+	}
+	if !strings.HasSuffix(rr.Header().Name, ".") {
+		rr.Header().Name += "."
+	}
+	keySign, err := global.KeySign(rr)
+	if err != nil {
+		return
+	}
+
+	inst.mutex.Lock()
+	defer inst.mutex.Unlock()
+	z := inst.findZone(rr.Header().Name)
+	if z == nil {
+		return nil
+	}
+	records := make([]dns.RR, 0, len(z.records))
+	for _, item := range z.records {
+		if same, err := sameRecord(item, rr, keySign); err != nil {
+			return err
+		} else if !same {
+			records = append(records, item)
+		}
+	}
+	if len(records) == len(z.records) {
+		return nil
+	}
+	return inst.save(z, records, true)
+}
+
+func (inst *ZoneFile) Exists(_ context.Context, name string, class uint16) (bool, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	inst.mutex.RLock()
+	defer inst.mutex.RUnlock()
+	return inst.nodes[nodeKey(name, class)] > 0, nil
+}
+
+func (inst *ZoneFile) List(_ context.Context, opts rrutil.ListOptions) (result []dns.RR, total int, err error) {
+	inst.mutex.RLock()
+	var records []dns.RR
+	for _, items := range inst.records {
+		for _, item := range items {
+			if opts.Match(item) {
+				records = append(records, item)
+			}
+		}
+	}
+	inst.mutex.RUnlock()
+
+	records, total = rrutil.PageRecords(records, &opts)
+	result = make([]dns.RR, len(records))
+	for k := range records {
+		result[k] = dns.Copy(records[k])
+	}
+	return
+}
+
+// 订阅区域文件的变化，文件重新加载后通知清空全部缓存
+func (inst *ZoneFile) Subscribe(fn func(name string)) {
+	inst.mutex.Lock()
+	defer inst.mutex.Unlock()
+	inst.notify = fn
+}
+
+// 检查区域文件是否可以访问
+func (inst *ZoneFile) Ping(_ context.Context) error {
+	for k := range inst.config.Zones {
+		if _, err := os.Stat(inst.config.Zones[k].File); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 停止检查文件变化
+func (inst *ZoneFile) Close() error {
+	inst.once.Do(func() {
+		close(inst.done)
+	})
+	return nil
+}
+
+// 定期检查区域文件是否变化，变化时重新加载，加载失败时继续使用已加载的记录
+func (inst *ZoneFile) watch() {
+	ticker := time.NewTicker(time.Duration(inst.config.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-inst.done:
+			return
+		case <-ticker.C:
+			inst.reload()
+		}
+	}
+}
+
+// 重新加载已变化的区域文件，解析期间不阻塞查询
+func (inst *ZoneFile) reload() {
+	for _, z := range inst.zones {
+		inst.mutex.RLock()
+		version := z.version
+		inst.mutex.RUnlock()
+		if global.FileVersion(z.file) == version {
+			continue
+		}
+
+		records, newVersion, err := parseZone(z.file, z.origin)
+		if err != nil {
+			log.Err(err).Caller().Str("file", z.file).Msg("重新加载区域文件失败")
+			continue
+		}
+		inst.mutex.Lock()
+		// 解析期间记录被写回文件时以写回的内容为准
+		reloaded := z.version == version
+		if reloaded {
+			z.records = records
+			z.version = newVersion
+			inst.rebuild()
+			log.Info().Str("file", z.file).Int("count", len(records)).Msg("已重新加载区域文件")
+		}
+		notify := inst.notify
+		inst.mutex.Unlock()
+		if reloaded && notify != nil {
+			notify("")
+		}
+	}
+}
+
+// 按最长匹配查找域名所属的区域文件，没有设置origin的区域按文件中的SOA记录确定
+func (inst *ZoneFile) findZone(name string) (result *zone) {
+	length := -1
+	for _, z := range inst.zones {
+		origin := z.apex()
+		if origin != "" && dns.IsSubDomain(origin, name) && len(origin) > length {
+			result = z
+			length = len(origin)
+		}
+	}
+	return
+}
+
+// 将记录写回区域文件，写入成功后更新内存中的记录
+// bumpSerial为true且区域中有SOA记录时递增序列号，以便从服务器感知变化
+func (inst *ZoneFile) save(z *zone, records []dns.RR, bumpSerial bool) error {
+	for k, item := range records {
+		if soa, ok := item.(*dns.SOA); ok && bumpSerial {
+			soa = dns.Copy(soa).(*dns.SOA)
+			soa.Serial++
+			records[k] = soa
+		}
+	}
+	if err := writeZone(z.file, z.apex(), records); err != nil {
+		return err
+	}
+	z.records = records
+	z.version = global.FileVersion(z.file)
+	inst.rebuild()
+	return nil
+}
+
+// 根据所有区域的记录重建索引
+func (inst *ZoneFile) rebuild() {
+	records := make(map[string][]dns.RR)
+	nodes := make(map[string]int)
+	for _, z := range inst.zones {
+		for _, item := range z.records {
+			name := strings.ToLower(item.Header().Name)
+			key := recordKey(name, item.Header().Class, item.Header().Rrtype)
+			records[key] = append(records[key], item)
+			for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+				nodes[nodeKey(name[off:], item.Header().Class)]++
+			}
+		}
+	}
+	inst.records = records
+	inst.nodes = nodes
+}
+
+// 区域的顶点，未配置origin时使用文件中SOA记录的所有者
+func (z *zone) apex() string {
+	if z.origin != "" {
+		return z.origin
+	}
+	for _, item := range z.records {
+		if item.Header().Rrtype == dns.TypeSOA {
+			return strings.ToLower(item.Header().Name)
+		}
+	}
+	return ""
+}
+
+// 解析区域文件，同时返回文件的版本标识
+func parseZone(path string, origin string) (records []dns.RR, version string, err error) {
+	version = global.FileVersion(path)
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	parser := dns.NewZoneParser(file, origin, path)
+	parser.SetIncludeAllowed(true)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, rr)
+	}
+	if err = parser.Err(); err != nil {
+		return nil, "", err
+	}
+	return
+}
+
+// 将记录写入区域文件，先写入临时文件再替换，文件中原有的注释和格式不会保留
+func writeZone(path string, origin string, records []dns.RR) error {
+	var buf strings.Builder
+	buf.WriteString("; 由 tsing-dns 生成于 " + time.Now().Format(time.RFC3339) + "\n")
+	if origin != "" {
+		buf.WriteString("$ORIGIN " + origin + "\n")
+	}
+
+	// SOA记录在前，其余按域名和类型排序
+	sorted := make([]dns.RR, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].Header(), sorted[j].Header()
+		if (a.Rrtype == dns.TypeSOA) != (b.Rrtype == dns.TypeSOA) {
+			return a.Rrtype == dns.TypeSOA
+		}
+		if nameA, nameB := strings.ToLower(a.Name), strings.ToLower(b.Name); nameA != nameB {
+			return nameA < nameB
+		}
+		return a.Rrtype < b.Rrtype
+	})
+	for _, item := range sorted {
+		buf.WriteString(item.String())
+		buf.WriteString("\n")
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(buf.String()); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	if info, err := os.Stat(path); err == nil {
+		_ = os.Chmod(file.Name(), info.Mode())
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		_ = os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// 两条记录的域名、类别、类型和数据是否相同，keySign为b的数据签名
+func sameRecord(a dns.RR, b dns.RR, keySign string) (bool, error) {
+	if !strings.EqualFold(a.Header().Name, b.Header().Name) ||
+		a.Header().Class != b.Header().Class ||
+		a.Header().Rrtype != b.Header().Rrtype {
+		return false, nil
+	}
+	sign, err := global.KeySign(a)
+	if err != nil {
+		return false, err
+	}
+	return sign == keySign, nil
+}
+
+func recordKey(name string, class uint16, rrtype uint16) string {
+	return strings.ToLower(name) + ":" + dns.ClassToString[class] + "-" + dns.TypeToString[rrtype]
+}
+
+func nodeKey(name string, class uint16) string {
+	return strings.ToLower(name) + ":" + dns.ClassToString[class]
+}
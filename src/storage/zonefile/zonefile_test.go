@@ -0,0 +1,125 @@
+package zonefile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"local/storage/rrutil"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 300
+@       IN SOA ns1 hostmaster 1 3600 600 604800 60
+@       IN NS  ns1
+ns1     IN A   10.0.0.53
+www.web IN A   10.0.0.1
+`
+
+func newRR(t *testing.T, str string) dns.RR {
+	rr, err := dns.NewRR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func newZoneFile(t *testing.T, writable bool) (*ZoneFile, string) {
+	path := filepath.Join(t.TempDir(), "app.test.zone")
+	if err := os.WriteFile(path, []byte(testZone), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := New(&Config{
+		Zones:    []ZoneConfig{{Origin: "app.test.", File: path}},
+		Interval: 1,
+		Writable: writable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = inst.Close()
+	})
+	return inst, path
+}
+
+// 测试只读模式下的查询及文件变化后的重新加载
+func TestZoneFileReadOnly(t *testing.T) {
+	inst, path := newZoneFile(t, false)
+
+	rr, _ := inst.Get(t.Context(), dns.Question{Name: "WWW.web.app.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if len(rr) != 1 || rr[0].Header().Ttl != 300 {
+		t.Fatal("查询到的记录错误", rr)
+	}
+	if exist, _ := inst.Exists(t.Context(), "web.app.test.", dns.ClassINET); !exist {
+		t.Fatal("空非终端节点被判断为不存在")
+	}
+	if rr, total, _ := inst.List(t.Context(), rrutil.ListOptions{Type: dns.TypeA, Limit: 1}); total != 2 || len(rr) != 1 || rr[0].Header().Name != "ns1.app.test." {
+		t.Fatal("列出的记录错误", rr, total)
+	}
+	if err := inst.Set(t.Context(), newRR(t, "new.app.test. 300 IN A 10.0.0.2")); !errors.Is(err, rrutil.ErrReadOnly) {
+		t.Fatal("只读模式下允许写入记录", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := os.WriteFile(path, []byte(testZone+"new IN A 10.0.0.2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if rr, _ = inst.Get(t.Context(), dns.Question{Name: "new.app.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}); len(rr) != 1 {
+		t.Fatal("文件变化后未重新加载")
+	}
+
+	if err := inst.Ping(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Ping(t.Context()); err == nil {
+		t.Fatal("区域文件被删除后检查未返回错误")
+	}
+}
+
+// 测试写回模式下记录的写入、删除及SOA序列号递增
+func TestZoneFileWritable(t *testing.T) {
+	inst, path := newZoneFile(t, true)
+
+	if err := inst.Set(t.Context(), newRR(t, "new.app.test. 60 IN A 10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.Set(t.Context(), newRR(t, "other.example. 60 IN A 10.0.0.2")); err == nil {
+		t.Fatal("允许写入不属于任何区域文件的记录")
+	}
+	if err := inst.Del(t.Context(), newRR(t, "www.web.app.test. 300 IN A 10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	records, _, err := parseZone(path, "app.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, item := range records {
+		switch record := item.(type) {
+		case *dns.SOA:
+			if record.Serial != 3 {
+				t.Fatal("SOA序列号未递增", record.Serial)
+			}
+		case *dns.A:
+			if record.Hdr.Name == "www.web.app.test." {
+				t.Fatal("删除的记录仍在文件中")
+			}
+			found = found || record.Hdr.Name == "new.app.test."
+		}
+	}
+	if !found {
+		t.Fatal("写入的记录不在文件中")
+	}
+	if exist, _ := inst.Exists(t.Context(), "web.app.test.", dns.ClassINET); exist {
+		t.Fatal("删除记录后空非终端节点仍然存在")
+	}
+}
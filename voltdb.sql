@@ -1,8 +1,16 @@
 CREATE TABLE domain (
     r_data VARCHAR(255) PRIMARY KEY,
     r_name VARCHAR(255) NOT NULL,
+    r_rname VARCHAR(255) NOT NULL,
     r_class TINYINT DEFAULT 1,
     r_type TINYINT NOT NULL,
     r_ttl INTEGER NOT NULL,
     expired_at BIGINT DEFAULT 0
 );
+CREATE INDEX domain_rname ON domain (r_class, r_rname);
+
+CREATE TABLE domain_version (
+    id TINYINT PRIMARY KEY,
+    version BIGINT NOT NULL
+);
+INSERT INTO domain_version (id, version) VALUES (0, 0);